@@ -0,0 +1,78 @@
+package artifact
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const HTTPArtifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+
+// MaxArtifactAge is how long after it is issued an artifact can be resolved.
+const MaxArtifactAge = time.Minute
+
+// ResolutionServiceIndex is the index of the ArtifactResolutionService in the IdP
+// metadata, which every artifact refers to.
+const ResolutionServiceIndex = 0
+
+const typeCode = 0x0004
+
+// issuedArtifact is stored under /artifacts/<message handle> until it is resolved.
+type issuedArtifact struct {
+	ServiceProvider string
+	Response        []byte
+	Expires         time.Time
+}
+
+func artifactKey(messageHandle string) string {
+	return fmt.Sprintf("/artifacts/%s", messageHandle)
+}
+
+// newArtifact returns a type 0x0004 artifact issued by entityID and its message handle,
+// hex encoded.
+func newArtifact(entityID string) (string, string) {
+	sourceID := sha1.Sum([]byte(entityID))
+	messageHandle := randomBytes(20)
+
+	buffer := &bytes.Buffer{}
+	binary.Write(buffer, binary.BigEndian, uint16(typeCode))
+	binary.Write(buffer, binary.BigEndian, uint16(ResolutionServiceIndex))
+	buffer.Write(sourceID[:])
+	buffer.Write(messageHandle)
+	return base64.StdEncoding.EncodeToString(buffer.Bytes()), hex.EncodeToString(messageHandle)
+}
+
+// parseArtifact returns the hex encoded message handle of an artifact issued by entityID.
+func parseArtifact(artifact string, entityID string) (string, error) {
+	buffer, err := base64.StdEncoding.DecodeString(artifact)
+	if err != nil {
+		return "", errors.Wrap(err, "cannot decode artifact")
+	}
+	if len(buffer) != 44 || binary.BigEndian.Uint16(buffer) != typeCode {
+		return "", errors.New("artifact is not a type 0x0004 artifact")
+	}
+	sourceID := sha1.Sum([]byte(entityID))
+	if !bytes.Equal(buffer[4:24], sourceID[:]) {
+		return "", errors.New("artifact was issued by another identity provider")
+	}
+	return hex.EncodeToString(buffer[24:]), nil
+}
+
+func newID() string {
+	return fmt.Sprintf("id-%x", randomBytes(20))
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
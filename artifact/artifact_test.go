@@ -0,0 +1,334 @@
+package artifact_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/artifact"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+)
+
+type serviceProviders map[string]*saml.EntityDescriptor
+
+func (s serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProvider, ok := s[serviceProviderID]; ok {
+		return serviceProvider, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+type sessionProvider struct{}
+
+func (sessionProvider) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	return &saml.Session{ID: "session-id", Index: "session-index", NameID: "bob", CreateTime: time.Now(), ExpireTime: time.Now().Add(time.Hour)}
+}
+
+func readFixture(name string) []byte {
+	contents, err := ioutil.ReadFile("../signing/fixtures/" + name)
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
+
+func readCertificate(name string) *x509.Certificate {
+	block, _ := pem.Decode(readFixture(name))
+	Expect(block).NotTo(BeNil())
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+func serviceProvider(entityID string, cert *x509.Certificate) *saml.EntityDescriptor {
+	return &saml.EntityDescriptor{
+		EntityID: entityID,
+		SPSSODescriptors: []saml.SPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{KeyDescriptors: []saml.KeyDescriptor{
+					{Use: "signing", KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(cert.Raw)}},
+				}},
+			},
+			AssertionConsumerServices: []saml.IndexedEndpoint{
+				{Binding: saml.HTTPPostBinding, Location: entityID + "/acs", Index: 1},
+				{Binding: HTTPArtifactBinding, Location: entityID + "/acs", Index: 2},
+			},
+		}},
+	}
+}
+
+// slowStore holds up every read after it is made, widening the window between reading
+// an artifact and deleting it.
+type slowStore struct {
+	*samlidp.MemoryStore
+}
+
+func (s slowStore) Get(key string, value interface{}) error {
+	err := s.MemoryStore.Get(key, value)
+	time.Sleep(50 * time.Millisecond)
+	return err
+}
+
+func soapEnvelope(el *etree.Element) string {
+	doc := etree.NewDocument()
+	envelope := doc.CreateElement("soap:Envelope")
+	envelope.CreateAttr("xmlns:soap", "http://schemas.xmlsoap.org/soap/envelope/")
+	envelope.CreateElement("soap:Body").AddChild(el)
+	buffer, err := doc.WriteToString()
+	Expect(err).NotTo(HaveOccurred())
+	return buffer
+}
+
+// declareNamespacesOnEnvelope moves the prefixed namespace declarations in the body of a
+// SOAP envelope up to the Envelope, where many SOAP clients put them.
+func declareNamespacesOnEnvelope(buffer string) string {
+	doc := etree.NewDocument()
+	Expect(doc.ReadFromString(buffer)).To(Succeed())
+	envelope := doc.Root()
+	for _, el := range envelope.FindElements("./Body//*") {
+		attrs := []etree.Attr{}
+		for _, attr := range el.Attr {
+			if attr.Space == "xmlns" {
+				envelope.CreateAttr("xmlns:"+attr.Key, attr.Value)
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		el.Attr = attrs
+	}
+	buffer, err := doc.WriteToString()
+	Expect(err).NotTo(HaveOccurred())
+	return buffer
+}
+
+var _ = Describe("Artifact binding", func() {
+	var store *samlidp.MemoryStore
+	var idp *saml.IdentityProvider
+	var ssoHandler *SSOHandler
+	var resolutionHandler *ResolutionHandler
+	var spSigner signing.Signer
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+
+		idpKey, err := signing.ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		idpCert := readCertificate("ec.crt")
+		keyRing, err := signing.NewKeyRing([]signing.Key{{State: signing.KeyStateActive, Signer: idpKey, Certificate: idpCert}})
+		Expect(err).NotTo(HaveOccurred())
+
+		spKey, err := signing.ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		spSigner = signing.Signer{Key: spKey, Certificate: readCertificate("rsa.crt")}
+
+		metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+		ssoURL, _ := url.Parse("https://idp.example.com/sso")
+		idp = &saml.IdentityProvider{
+			Key:             idpKey,
+			Certificate:     idpCert,
+			Logger:          logger.DefaultLogger,
+			MetadataURL:     *metadataURL,
+			SSOURL:          *ssoURL,
+			SessionProvider: sessionProvider{},
+			AssertionMaker:  signing.AssertionMaker{Keys: keyRing},
+			ServiceProviderProvider: serviceProviders{
+				"https://sp1.example.com": serviceProvider("https://sp1.example.com", spSigner.Certificate),
+				"https://sp2.example.com": serviceProvider("https://sp2.example.com", spSigner.Certificate),
+			},
+		}
+		ssoHandler = &SSOHandler{IDP: idp, Store: store, Logger: logger.DefaultLogger}
+		resolutionHandler = &ResolutionHandler{IDP: idp, Store: store, Keys: keyRing, Logger: logger.DefaultLogger}
+	})
+
+	authnRequest := func(protocolBinding string) *http.Request {
+		request := &saml.AuthnRequest{
+			ID:                          "id-authn-request",
+			Version:                     "2.0",
+			IssueInstant:                time.Now(),
+			Destination:                 "https://idp.example.com/sso",
+			AssertionConsumerServiceURL: "https://sp1.example.com/acs",
+			ProtocolBinding:             protocolBinding,
+			Issuer:                      &saml.Issuer{Value: "https://sp1.example.com"},
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(request.Element())
+		buffer, err := doc.WriteToBytes()
+		Expect(err).NotTo(HaveOccurred())
+
+		httpRequest := httptest.NewRequest("POST", "https://idp.example.com/sso", strings.NewReader(url.Values{
+			"SAMLRequest": {base64.StdEncoding.EncodeToString(buffer)},
+			"RelayState":  {"sp1-state"},
+		}.Encode()))
+		httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return httpRequest
+	}
+
+	issueArtifact := func() string {
+		recorder := httptest.NewRecorder()
+		ssoHandler.ServeHTTP(recorder, authnRequest(HTTPArtifactBinding))
+		Expect(recorder.Code).To(Equal(http.StatusFound))
+		location, err := url.Parse(recorder.Header().Get("Location"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(location.Host + location.Path).To(Equal("sp1.example.com/acs"))
+		Expect(location.Query().Get("RelayState")).To(Equal("sp1-state"))
+		return location.Query().Get("SAMLart")
+	}
+
+	resolveRequest := func(issuer string, samlArt string, signed bool) *http.Request {
+		artifactResolve := &ArtifactResolve{
+			ID:           "id-artifact-resolve",
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Destination:  "https://idp.example.com/artifact",
+			Issuer:       &saml.Issuer{Value: issuer},
+			Artifact:     samlArt,
+		}
+		if signed {
+			signature, err := spSigner.Sign(artifactResolve.Element())
+			Expect(err).NotTo(HaveOccurred())
+			artifactResolve.Signature = signature
+		}
+		return httptest.NewRequest("POST", "https://idp.example.com/artifact", strings.NewReader(soapEnvelope(artifactResolve.Element())))
+	}
+
+	resolve := func(request *http.Request) *ArtifactResponse {
+		recorder := httptest.NewRecorder()
+		resolutionHandler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		doc := etree.NewDocument()
+		Expect(doc.ReadFromBytes(recorder.Body.Bytes())).To(Succeed())
+		el := doc.FindElement("./Envelope/Body/ArtifactResponse")
+		Expect(el).NotTo(BeNil())
+		Expect(el.SelectElement("Signature")).NotTo(BeNil())
+
+		responseDoc := etree.NewDocument()
+		responseDoc.SetRoot(el.Copy())
+		buffer, err := responseDoc.WriteToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		artifactResponse := &ArtifactResponse{}
+		Expect(xml.Unmarshal(buffer, artifactResponse)).To(Succeed())
+		Expect(artifactResponse.InResponseTo).To(Equal("id-artifact-resolve"))
+		Expect(artifactResponse.Status.StatusCode.Value).To(Equal(saml.StatusSuccess))
+		artifactResponse.Message = el.SelectElement("Response")
+		return artifactResponse
+	}
+
+	It("should send a POST response when the SP does not ask for an artifact", func() {
+		recorder := httptest.NewRecorder()
+		ssoHandler.ServeHTTP(recorder, authnRequest(""))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Body.String()).To(ContainSubstring(`name="SAMLResponse"`))
+	})
+
+	It("should resolve an artifact once for a signed ArtifactResolve", func() {
+		samlArt := issueArtifact()
+
+		artifactResponse := resolve(resolveRequest("https://sp1.example.com", samlArt, true))
+		Expect(artifactResponse.Message).NotTo(BeNil())
+		Expect(artifactResponse.Message.SelectAttrValue("InResponseTo", "")).To(Equal("id-authn-request"))
+		Expect(artifactResponse.Message.SelectAttrValue("Destination", "")).To(Equal("https://sp1.example.com/acs"))
+
+		artifactResponse = resolve(resolveRequest("https://sp1.example.com", samlArt, true))
+		Expect(artifactResponse.Message).To(BeNil())
+	})
+
+	It("should authenticate the SP by its TLS client certificate", func() {
+		request := resolveRequest("https://sp1.example.com", issueArtifact(), false)
+		request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{spSigner.Certificate}}
+
+		Expect(resolve(request).Message).NotTo(BeNil())
+	})
+
+	It("should reject an SP that does not authenticate", func() {
+		request := resolveRequest("https://sp1.example.com", issueArtifact(), false)
+		request.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{readCertificate("ec.crt")}}
+
+		recorder := httptest.NewRecorder()
+		resolutionHandler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should resolve an artifact once when it is resolved concurrently", func() {
+		samlArt := issueArtifact()
+		resolutionHandler.Store = slowStore{store}
+
+		requests := []*http.Request{}
+		for i := 0; i < 5; i++ {
+			requests = append(requests, resolveRequest("https://sp1.example.com", samlArt, true))
+		}
+		messages := make(chan *etree.Element, len(requests))
+		wg := sync.WaitGroup{}
+		for _, request := range requests {
+			wg.Add(1)
+			go func(request *http.Request) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				messages <- resolve(request).Message
+			}(request)
+		}
+		wg.Wait()
+		close(messages)
+
+		resolved := 0
+		for message := range messages {
+			if message != nil {
+				resolved++
+			}
+		}
+		Expect(resolved).To(Equal(1))
+	})
+
+	It("should resolve an ArtifactResolve whose namespaces are declared on the envelope", func() {
+		samlArt := issueArtifact()
+
+		request := resolveRequest("https://sp1.example.com", samlArt, true)
+		body, err := ioutil.ReadAll(request.Body)
+		Expect(err).NotTo(HaveOccurred())
+		envelope := declareNamespacesOnEnvelope(string(body))
+		Expect(envelope).To(ContainSubstring(`xmlns:samlp=`))
+		request = httptest.NewRequest("POST", "https://idp.example.com/artifact", strings.NewReader(envelope))
+
+		Expect(resolve(request).Message).NotTo(BeNil())
+	})
+
+	It("should not resolve an artifact issued to another SP", func() {
+		samlArt := issueArtifact()
+
+		Expect(resolve(resolveRequest("https://sp2.example.com", samlArt, true)).Message).To(BeNil())
+		Expect(resolve(resolveRequest("https://sp1.example.com", samlArt, true)).Message).NotTo(BeNil())
+		Expect(resolve(resolveRequest("https://sp1.example.com", samlArt, true)).Message).To(BeNil())
+	})
+
+	It("should not resolve an expired artifact", func() {
+		samlArt := issueArtifact()
+
+		defer func() { saml.TimeNow = func() time.Time { return time.Now().UTC() } }()
+		saml.TimeNow = func() time.Time { return time.Now().UTC().Add(MaxArtifactAge + time.Second) }
+		Expect(resolve(resolveRequest("https://sp1.example.com", samlArt, true)).Message).To(BeNil())
+	})
+
+	It("should reject an artifact issued by another IdP", func() {
+		samlArt := issueArtifact()
+		idp.MetadataURL.Host = "other.example.com"
+
+		recorder := httptest.NewRecorder()
+		resolutionHandler.ServeHTTP(recorder, resolveRequest("https://sp1.example.com", samlArt, true))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+})
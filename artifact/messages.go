@@ -0,0 +1,82 @@
+package artifact
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+const timeFormat = "2006-01-02T15:04:05.999Z07:00"
+
+// ArtifactResolve is the SAML ArtifactResolve, which the vendored saml package lacks.
+type ArtifactResolve struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResolve"`
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Issuer       *saml.Issuer
+	Signature    *etree.Element `xml:"-"`
+	Artifact     string         `xml:"urn:oasis:names:tc:SAML:2.0:protocol Artifact"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *ArtifactResolve) Element() *etree.Element {
+	el := etree.NewElement("samlp:ArtifactResolve")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.UTC().Format(timeFormat))
+	if r.Destination != "" {
+		el.CreateAttr("Destination", r.Destination)
+	}
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	el.CreateElement("samlp:Artifact").SetText(r.Artifact)
+	return el
+}
+
+// ArtifactResponse is the SAML ArtifactResponse, which the vendored saml package lacks.
+// Message is the message the artifact stood for, and is nil when it cannot be resolved.
+type ArtifactResponse struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResponse"`
+	ID           string    `xml:",attr"`
+	InResponseTo string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Issuer       *saml.Issuer
+	Signature    *etree.Element `xml:"-"`
+	Status       saml.Status
+	Message      *etree.Element `xml:"-"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (r *ArtifactResponse) Element() *etree.Element {
+	el := etree.NewElement("samlp:ArtifactResponse")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", r.ID)
+	if r.InResponseTo != "" {
+		el.CreateAttr("InResponseTo", r.InResponseTo)
+	}
+	el.CreateAttr("Version", r.Version)
+	el.CreateAttr("IssueInstant", r.IssueInstant.UTC().Format(timeFormat))
+	if r.Issuer != nil {
+		el.AddChild(r.Issuer.Element())
+	}
+	if r.Signature != nil {
+		el.AddChild(r.Signature)
+	}
+	el.AddChild(r.Status.Element())
+	if r.Message != nil {
+		el.AddChild(r.Message.Copy())
+	}
+	return el
+}
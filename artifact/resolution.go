@@ -0,0 +1,165 @@
+package artifact
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/DennisDenuto/saml-idp/soap"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+// ResolutionHandler is the SOAP ArtifactResolutionService. An artifact is resolved
+// once, and only for the SP it was issued to. The SP authenticates with a signing
+// certificate from its metadata, either as the TLS client certificate or by signing
+// the ArtifactResolve.
+type ResolutionHandler struct {
+	IDP    *saml.IdentityProvider
+	Store  samlidp.Store
+	Keys   *signing.KeyRing
+	Logger logger.Interface
+
+	// mu makes take a single step, so concurrent ArtifactResolves for one artifact
+	// cannot both read it before it is deleted.
+	mu sync.Mutex
+}
+
+func (h *ResolutionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	buffer, err := h.resolve(r)
+	if err != nil {
+		h.Logger.Printf("ERROR: artifact resolution failed: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buffer)
+}
+
+func (h *ResolutionHandler) resolve(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	el, err := soap.ReadBody(body)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	requestBuffer, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	artifactResolve := ArtifactResolve{}
+	if err := xml.Unmarshal(requestBuffer, &artifactResolve); err != nil {
+		return nil, errors.Wrap(err, "cannot parse ArtifactResolve")
+	}
+	if artifactResolve.Issuer == nil {
+		return nil, errors.New("ArtifactResolve has no issuer")
+	}
+
+	serviceProvider, err := h.IDP.ServiceProviderProvider.GetServiceProvider(r, artifactResolve.Issuer.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find service provider %s", artifactResolve.Issuer.Value)
+	}
+	if err := authenticate(r, el, serviceProvider); err != nil {
+		return nil, err
+	}
+	messageHandle, err := parseArtifact(artifactResolve.Artifact, h.IDP.MetadataURL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	artifactResponse := &ArtifactResponse{
+		ID:           newID(),
+		InResponseTo: artifactResolve.ID,
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  h.IDP.MetadataURL.String(),
+		},
+		Status: saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	artifactResponse.Message, err = h.take(messageHandle, artifactResolve.Issuer.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	activeKey := h.Keys.Active()
+	signer := signing.Signer{Key: activeKey.Signer, Certificate: activeKey.Certificate}
+	artifactResponse.Signature, err = signer.Sign(artifactResponse.Element())
+	if err != nil {
+		return nil, err
+	}
+	return soap.WriteEnvelope(artifactResponse.Element())
+}
+
+// take deletes the artifact and returns the response it stood for. An artifact that is
+// unknown, expired or was issued to another SP resolves to no message and is kept until
+// it expires, so another SP cannot use up an artifact that is not its own.
+func (h *ResolutionHandler) take(messageHandle string, serviceProvider string) (*etree.Element, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	issued := issuedArtifact{}
+	err := h.Store.Get(artifactKey(messageHandle), &issued)
+	if err == samlidp.ErrNotFound {
+		h.Logger.Printf("artifact %s of %s is unknown or already resolved", messageHandle, serviceProvider)
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if issued.ServiceProvider != serviceProvider {
+		h.Logger.Printf("artifact %s was issued to %s, not %s", messageHandle, issued.ServiceProvider, serviceProvider)
+		return nil, nil
+	}
+	if saml.TimeNow().After(issued.Expires) {
+		h.Logger.Printf("artifact %s of %s expired", messageHandle, serviceProvider)
+		return nil, nil
+	}
+	if err := h.Store.Delete(artifactKey(messageHandle)); err != nil {
+		return nil, err
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(issued.Response); err != nil {
+		return nil, err
+	}
+	return doc.Root(), nil
+}
+
+// authenticate checks that the SP sent a signing certificate from its metadata as the
+// TLS client certificate, or signed the ArtifactResolve with one.
+func authenticate(r *http.Request, el *etree.Element, serviceProvider *saml.EntityDescriptor) error {
+	certs, err := signing.SPSigningCertificates(serviceProvider)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return errors.Errorf("service provider %s publishes no signing certificate", serviceProvider.EntityID)
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		for _, cert := range certs {
+			if bytes.Equal(cert.Raw, r.TLS.PeerCertificates[0].Raw) {
+				return nil
+			}
+		}
+	}
+	if el.SelectElement("Signature") == nil {
+		return errors.Errorf("service provider %s neither signed the ArtifactResolve nor sent a signing certificate as TLS client certificate", serviceProvider.EntityID)
+	}
+	return signing.VerifyEnvelopedSignature(el, certs)
+}
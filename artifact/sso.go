@@ -0,0 +1,143 @@
+package artifact
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+)
+
+// SSOHandler handles AuthnRequests like saml.IdentityProvider.ServeSSO, which can
+// only send responses with the HTTP-POST binding. When the SP asks for the
+// HTTP-Artifact binding the response is stored instead, and the browser only carries
+// an artifact that the SP resolves at the ResolutionHandler.
+type SSOHandler struct {
+	IDP    *saml.IdentityProvider
+	Store  samlidp.Store
+	Logger logger.Interface
+}
+
+func (h *SSOHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req, err := saml.NewIdpAuthnRequest(h.IDP, r)
+	if err != nil {
+		h.Logger.Printf("failed to parse request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		h.Logger.Printf("failed to validate request: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	if endpoint := artifactEndpoint(req); endpoint != nil {
+		req.ACSEndpoint = endpoint
+	}
+
+	session := h.IDP.SessionProvider.GetSession(w, r, req)
+	if session == nil {
+		return
+	}
+
+	assertionMaker := h.IDP.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		h.Logger.Printf("failed to make assertion: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	if req.ACSEndpoint.Binding == HTTPArtifactBinding {
+		err = h.sendArtifact(w, r, req)
+	} else {
+		err = req.WriteResponse(w)
+	}
+	if err != nil {
+		h.Logger.Printf("failed to write response: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// artifactEndpoint returns the HTTP-Artifact assertion consumer service of the SP when
+// the request asks for that binding, or nil. The saml package picks the endpoint by
+// URL or index alone, so it can pick another endpoint at the same URL.
+func artifactEndpoint(req *saml.IdpAuthnRequest) *saml.IndexedEndpoint {
+	if req.Request.ProtocolBinding != HTTPArtifactBinding || req.Request.AssertionConsumerServiceIndex != "" {
+		return nil
+	}
+	for _, endpoint := range req.SPSSODescriptor.AssertionConsumerServices {
+		if endpoint.Binding != HTTPArtifactBinding {
+			continue
+		}
+		if req.Request.AssertionConsumerServiceURL == "" || endpoint.Location == req.Request.AssertionConsumerServiceURL {
+			return &endpoint
+		}
+	}
+	return nil
+}
+
+// sendArtifact stores the response and redirects the browser to the SP with an
+// artifact referring to it.
+func (h *SSOHandler) sendArtifact(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) error {
+	if req.ResponseEl == nil {
+		if err := req.MakeResponse(); err != nil {
+			return err
+		}
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(req.ResponseEl)
+	responseBuffer, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	if err := h.deleteExpired(); err != nil {
+		return err
+	}
+	artifact, messageHandle := newArtifact(h.IDP.MetadataURL.String())
+	err = h.Store.Put(artifactKey(messageHandle), &issuedArtifact{
+		ServiceProvider: req.ServiceProviderMetadata.EntityID,
+		Response:        responseBuffer,
+		Expires:         saml.TimeNow().Add(MaxArtifactAge),
+	})
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{"SAMLart": {artifact}}
+	if req.RelayState != "" {
+		query.Set("RelayState", req.RelayState)
+	}
+	separator := "?"
+	if strings.Contains(req.ACSEndpoint.Location, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, req.ACSEndpoint.Location+separator+query.Encode(), http.StatusFound)
+	return nil
+}
+
+// deleteExpired deletes the artifacts that were never resolved.
+func (h *SSOHandler) deleteExpired() error {
+	messageHandles, err := h.Store.List(artifactKey(""))
+	if err != nil {
+		return err
+	}
+	now := saml.TimeNow()
+	for _, messageHandle := range messageHandles {
+		issued := issuedArtifact{}
+		if err := h.Store.Get(artifactKey(messageHandle), &issued); err != nil {
+			continue
+		}
+		if now.After(issued.Expires) {
+			if err := h.Store.Delete(artifactKey(messageHandle)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
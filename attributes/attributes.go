@@ -0,0 +1,113 @@
+package attributes
+
+import (
+	"strings"
+
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/crewjam/saml"
+)
+
+const URINameFormat = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+
+type definition struct {
+	friendlyName string
+	name         string
+	source       string
+	values       func(user users.User) []string
+}
+
+// definitions are the attributes of a samlidp.User, named as saml.DefaultAssertionMaker
+// names them, plus mail for the email address. The source is the users file field.
+// Custom attributes of a user are not listed; their source is attributes.<name>.
+var definitions = []definition{
+	{"uid", "urn:oid:0.9.2342.19200300.100.1.1", "name", func(user users.User) []string { return []string{user.Name} }},
+	{"mail", "urn:oid:0.9.2342.19200300.100.1.3", "email", func(user users.User) []string { return []string{user.Email} }},
+	{"eduPersonPrincipalName", "urn:oid:1.3.6.1.4.1.5923.1.1.1.6", "email", func(user users.User) []string { return []string{user.Email} }},
+	{"sn", "urn:oid:2.5.4.4", "surname", func(user users.User) []string { return []string{user.Surname} }},
+	{"givenName", "urn:oid:2.5.4.42", "given_name", func(user users.User) []string { return []string{user.GivenName} }},
+	{"cn", "urn:oid:2.5.4.3", "common_name", func(user users.User) []string { return []string{user.CommonName} }},
+	{"eduPersonAffiliation", "urn:oid:1.3.6.1.4.1.5923.1.1.1.1", "groups", func(user users.User) []string { return user.Groups }},
+}
+
+const customSourcePrefix = "attributes."
+
+// customDefinition returns the definition of the custom attribute the source
+// attributes.<name> refers to, named after it, or nil for other sources.
+func customDefinition(source string) *definition {
+	name := strings.TrimPrefix(source, customSourcePrefix)
+	if name == source || name == "" {
+		return nil
+	}
+	return &definition{name, name, source, func(user users.User) []string { return user.Attributes[name] }}
+}
+
+// Supported returns the attributes the IdP knows, without values.
+func Supported() []saml.Attribute {
+	attributes := []saml.Attribute{}
+	for _, definition := range definitions {
+		attributes = append(attributes, saml.Attribute{
+			FriendlyName: definition.friendlyName,
+			Name:         definition.name,
+			NameFormat:   URINameFormat,
+		})
+	}
+	return attributes
+}
+
+// Release returns the attributes of user named in release, by friendly name or name,
+// and the custom attributes named in release as attributes.<name>. Attributes without
+// a value are left out.
+func Release(user users.User, release []string) []saml.Attribute {
+	attributes := []saml.Attribute{}
+	for _, definition := range definitions {
+		if !contains(release, definition.friendlyName) && !contains(release, definition.name) {
+			continue
+		}
+		values := attributeValues(definition.values(user))
+		if len(values) == 0 {
+			continue
+		}
+		attributes = append(attributes, saml.Attribute{
+			FriendlyName: definition.friendlyName,
+			Name:         definition.name,
+			NameFormat:   URINameFormat,
+			Values:       values,
+		})
+	}
+	for _, source := range release {
+		definition := customDefinition(source)
+		if definition == nil {
+			continue
+		}
+		values := attributeValues(definition.values(user))
+		if len(values) == 0 {
+			continue
+		}
+		attributes = append(attributes, saml.Attribute{
+			FriendlyName: definition.friendlyName,
+			Name:         definition.name,
+			NameFormat:   nameFormats["basic"],
+			Values:       values,
+		})
+	}
+	return attributes
+}
+
+func attributeValues(values []string) []saml.AttributeValue {
+	attributeValues := []saml.AttributeValue{}
+	for _, value := range values {
+		if value != "" {
+			attributeValues = append(attributeValues, saml.AttributeValue{Type: "xs:string", Value: value})
+		}
+	}
+	return attributeValues
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
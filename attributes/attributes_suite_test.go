@@ -0,0 +1,13 @@
+package attributes_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestAttributes(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Attributes Suite")
+}
@@ -0,0 +1,60 @@
+package attributes_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/attributes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("Release", func() {
+	user := users.User{
+		User: samlidp.User{
+			Name:      "bob",
+			Email:     "bob@example.com",
+			GivenName: "Bob",
+			Groups:    []string{"staff", "member"},
+		},
+		Attributes: map[string][]string{"department": {"Engineering"}},
+	}
+
+	It("should release the listed attributes by friendly name or name", func() {
+		Expect(Release(user, []string{"mail", "urn:oid:1.3.6.1.4.1.5923.1.1.1.1"})).To(Equal([]saml.Attribute{
+			{
+				FriendlyName: "mail",
+				Name:         "urn:oid:0.9.2342.19200300.100.1.3",
+				NameFormat:   URINameFormat,
+				Values:       []saml.AttributeValue{{Type: "xs:string", Value: "bob@example.com"}},
+			},
+			{
+				FriendlyName: "eduPersonAffiliation",
+				Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.1",
+				NameFormat:   URINameFormat,
+				Values: []saml.AttributeValue{
+					{Type: "xs:string", Value: "staff"},
+					{Type: "xs:string", Value: "member"},
+				},
+			},
+		}))
+	})
+
+	It("should leave out attributes without a value", func() {
+		Expect(Release(user, []string{"sn", "givenName"})).To(HaveLen(1))
+	})
+
+	It("should release nothing when nothing is listed", func() {
+		Expect(Release(user, nil)).To(BeEmpty())
+	})
+
+	It("should release the listed custom attributes", func() {
+		Expect(Release(user, []string{"attributes.department", "attributes.phone"})).To(Equal([]saml.Attribute{{
+			FriendlyName: "department",
+			Name:         "department",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+			Values:       []saml.AttributeValue{{Type: "xs:string", Value: "Engineering"}},
+		}}))
+	})
+})
@@ -0,0 +1,173 @@
+package attributes
+
+import (
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/DennisDenuto/saml-idp/nameid"
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/DennisDenuto/saml-idp/soap"
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+// Handler is the SOAP AttributeService of the IdP's Attribute Authority role. It answers
+// AttributeQuery messages signed by an SP with the attributes of the user the NameID,
+// in any format the IdP issues, refers to that the SP's policy releases, or without a
+// policy, the ones Release lists for that SP by entity ID.
+type Handler struct {
+	IDP      *saml.IdentityProvider
+	Store    samlidp.Store
+	Keys     *signing.KeyRing
+	Policies *Policies
+	Release  map[string][]string
+	Logger   logger.Interface
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	buffer, err := h.answer(r)
+	if err != nil {
+		h.Logger.Printf("ERROR: attribute query failed: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buffer)
+}
+
+func (h *Handler) answer(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	el, err := soap.ReadBody(body)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	queryBuffer, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+	query := AttributeQuery{}
+	if err := xml.Unmarshal(queryBuffer, &query); err != nil {
+		return nil, errors.Wrap(err, "cannot parse AttributeQuery")
+	}
+	if query.Issuer == nil {
+		return nil, errors.New("AttributeQuery has no issuer")
+	}
+	if query.Subject == nil || query.Subject.NameID == nil {
+		return nil, errors.New("AttributeQuery has no NameID")
+	}
+
+	serviceProvider, err := h.IDP.ServiceProviderProvider.GetServiceProvider(r, query.Issuer.Value)
+	if err != nil {
+		return nil, errors.Wrapf(err, "cannot find service provider %s", query.Issuer.Value)
+	}
+	if el.SelectElement("Signature") == nil {
+		return nil, errors.New("AttributeQuery is not signed")
+	}
+	certs, err := signing.SPSigningCertificates(serviceProvider)
+	if err != nil {
+		return nil, err
+	}
+	if err := signing.VerifyEnvelopedSignature(el, certs); err != nil {
+		return nil, err
+	}
+
+	now := saml.TimeNow()
+	response := &saml.Response{
+		ID:           newID(),
+		InResponseTo: query.ID,
+		Version:      "2.0",
+		IssueInstant: now,
+		Issuer:       h.issuer(),
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	signer := h.signer()
+
+	user := users.User{}
+	userName, err := nameid.UserName(h.Store, query.Subject.NameID, serviceProvider.EntityID)
+	if err == nil {
+		err = h.Store.Get(fmt.Sprintf("/users/%s", userName), &user)
+	}
+	if err == samlidp.ErrNotFound {
+		response.Status.StatusCode = saml.StatusCode{
+			Value:      saml.StatusRequester,
+			StatusCode: &saml.StatusCode{Value: saml.StatusUnknownPrincipal},
+		}
+	} else if err != nil {
+		return nil, err
+	} else {
+		assertion := &saml.Assertion{
+			ID:           newID(),
+			IssueInstant: now,
+			Version:      "2.0",
+			Issuer:       *h.issuer(),
+			Subject:      &saml.Subject{NameID: query.Subject.NameID},
+			Conditions: &saml.Conditions{
+				NotBefore:    now.Add(-saml.MaxClockSkew),
+				NotOnOrAfter: now.Add(saml.MaxIssueDelay),
+				AudienceRestrictions: []saml.AudienceRestriction{
+					{Audience: saml.Audience{Value: serviceProvider.EntityID}},
+				},
+			},
+		}
+		var released []saml.Attribute
+		if policy, ok := h.Policies.Get(serviceProvider.EntityID); ok {
+			released = query.Requested(policy.Release(user))
+		} else {
+			released = query.Requested(Release(user, h.Release[serviceProvider.EntityID]))
+		}
+		if len(released) > 0 {
+			assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: released}}
+		}
+		assertion.Signature, err = signer.Sign(assertion.Element())
+		if err != nil {
+			return nil, err
+		}
+		response.Assertion = assertion
+	}
+
+	response.Signature, err = signer.Sign(response.Element())
+	if err != nil {
+		return nil, err
+	}
+	return soap.WriteEnvelope(response.Element())
+}
+
+func (h *Handler) issuer() *saml.Issuer {
+	return &saml.Issuer{
+		Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+		Value:  h.IDP.MetadataURL.String(),
+	}
+}
+
+func (h *Handler) signer() signing.Signer {
+	activeKey := h.Keys.Active()
+	return signing.Signer{Key: activeKey.Signer, Certificate: activeKey.Certificate}
+}
+
+func newID() string {
+	return fmt.Sprintf("id-%x", randomBytes(20))
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
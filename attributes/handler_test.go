@@ -0,0 +1,229 @@
+package attributes_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/attributes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/DennisDenuto/saml-idp/soap"
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+)
+
+type serviceProviders map[string]*saml.EntityDescriptor
+
+func (s serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProvider, ok := s[serviceProviderID]; ok {
+		return serviceProvider, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func readFixture(name string) []byte {
+	contents, err := ioutil.ReadFile("../signing/fixtures/" + name)
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
+
+func readCertificate(name string) *x509.Certificate {
+	block, _ := pem.Decode(readFixture(name))
+	Expect(block).NotTo(BeNil())
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+// declareNamespacesOnEnvelope moves the prefixed namespace declarations in the body of a
+// SOAP envelope up to the Envelope, where many SOAP clients put them.
+func declareNamespacesOnEnvelope(buffer string) string {
+	doc := etree.NewDocument()
+	Expect(doc.ReadFromString(buffer)).To(Succeed())
+	envelope := doc.Root()
+	for _, el := range envelope.FindElements("./Body//*") {
+		attrs := []etree.Attr{}
+		for _, attr := range el.Attr {
+			if attr.Space == "xmlns" {
+				envelope.CreateAttr("xmlns:"+attr.Key, attr.Value)
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		el.Attr = attrs
+	}
+	buffer, err := doc.WriteToString()
+	Expect(err).NotTo(HaveOccurred())
+	return buffer
+}
+
+var _ = Describe("Handler", func() {
+	var store *samlidp.MemoryStore
+	var handler *Handler
+	var spSigner signing.Signer
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		Expect(store.Put("/users/bob", users.User{
+			User:       samlidp.User{Name: "bob", Email: "bob@example.com", Surname: "Smith", Groups: []string{"staff"}},
+			Attributes: map[string][]string{"department": {"Engineering"}},
+		})).To(Succeed())
+
+		idpKey, err := signing.ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		keyRing, err := signing.NewKeyRing([]signing.Key{{State: signing.KeyStateActive, Signer: idpKey, Certificate: readCertificate("ec.crt")}})
+		Expect(err).NotTo(HaveOccurred())
+
+		spKey, err := signing.ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		spSigner = signing.Signer{Key: spKey, Certificate: readCertificate("rsa.crt")}
+
+		metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+		handler = &Handler{
+			IDP: &saml.IdentityProvider{
+				MetadataURL: *metadataURL,
+				ServiceProviderProvider: serviceProviders{
+					"https://sp.example.com": {
+						EntityID: "https://sp.example.com",
+						SPSSODescriptors: []saml.SPSSODescriptor{{
+							SSODescriptor: saml.SSODescriptor{
+								RoleDescriptor: saml.RoleDescriptor{KeyDescriptors: []saml.KeyDescriptor{
+									{Use: "signing", KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(spSigner.Certificate.Raw)}},
+								}},
+							},
+						}},
+					},
+				},
+			},
+			Store:   store,
+			Keys:    keyRing,
+			Release: map[string][]string{"https://sp.example.com": {"mail", "sn", "eduPersonAffiliation", "attributes.department"}},
+			Logger:  logger.DefaultLogger,
+		}
+	})
+
+	queryRequest := func(nameID string, requested []saml.Attribute, signed bool) *http.Request {
+		query := &AttributeQuery{
+			ID:           "id-attribute-query",
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       &saml.Issuer{Value: "https://sp.example.com"},
+			Subject:      &saml.Subject{NameID: &saml.NameID{Value: nameID}},
+			Attributes:   requested,
+		}
+		if signed {
+			signature, err := spSigner.Sign(query.Element())
+			Expect(err).NotTo(HaveOccurred())
+			query.Signature = signature
+		}
+		buffer, err := soap.WriteEnvelope(query.Element())
+		Expect(err).NotTo(HaveOccurred())
+		return httptest.NewRequest("POST", "https://idp.example.com/attributes", strings.NewReader(string(buffer)))
+	}
+
+	answer := func(request *http.Request) *saml.Response {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		el, err := soap.ReadBody(recorder.Body.Bytes())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(el.SelectElement("Signature")).NotTo(BeNil())
+		doc := etree.NewDocument()
+		doc.SetRoot(el.Copy())
+		buffer, err := doc.WriteToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		response := &saml.Response{}
+		Expect(xml.Unmarshal(buffer, response)).To(Succeed())
+		Expect(response.InResponseTo).To(Equal("id-attribute-query"))
+		return response
+	}
+
+	released := func(response *saml.Response) map[string][]string {
+		values := map[string][]string{}
+		for _, attributeStatement := range response.Assertion.AttributeStatements {
+			for _, attribute := range attributeStatement.Attributes {
+				for _, value := range attribute.Values {
+					values[attribute.FriendlyName] = append(values[attribute.FriendlyName], value.Value)
+				}
+			}
+		}
+		return values
+	}
+
+	It("should answer with the attributes released to the SP", func() {
+		response := answer(queryRequest("bob", nil, true))
+		Expect(response.Status.StatusCode.Value).To(Equal(saml.StatusSuccess))
+		Expect(response.Assertion.Subject.NameID.Value).To(Equal("bob"))
+		Expect(response.Assertion.Conditions.AudienceRestrictions[0].Audience.Value).To(Equal("https://sp.example.com"))
+		Expect(released(response)).To(Equal(map[string][]string{
+			"mail":                 {"bob@example.com"},
+			"sn":                   {"Smith"},
+			"eduPersonAffiliation": {"staff"},
+			"department":           {"Engineering"},
+		}))
+	})
+
+	It("should only answer with the attributes asked for", func() {
+		response := answer(queryRequest("bob", []saml.Attribute{
+			{Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: URINameFormat},
+			{Name: "urn:oid:0.9.2342.19200300.100.1.1", NameFormat: URINameFormat},
+		}, true))
+		Expect(released(response)).To(Equal(map[string][]string{"mail": {"bob@example.com"}}))
+	})
+
+	It("should release nothing to an SP without a release list", func() {
+		handler.Release = nil
+		response := answer(queryRequest("bob", nil, true))
+		Expect(response.Assertion.AttributeStatements).To(BeEmpty())
+	})
+
+	It("should answer with the attributes the SP's policy releases", func() {
+		var err error
+		handler.Policies, err = NewPolicies(map[string]Policy{
+			"https://sp.example.com": {Rules: []Rule{{Source: "name", FriendlyName: "username", Name: "username"}}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		response := answer(queryRequest("bob", nil, true))
+		Expect(released(response)).To(Equal(map[string][]string{"username": {"bob"}}))
+	})
+
+	It("should answer UnknownPrincipal for an unknown user", func() {
+		response := answer(queryRequest("alice", nil, true))
+		Expect(response.Status.StatusCode.Value).To(Equal(saml.StatusRequester))
+		Expect(response.Status.StatusCode.StatusCode.Value).To(Equal(saml.StatusUnknownPrincipal))
+		Expect(response.Assertion).To(BeNil())
+	})
+
+	It("should answer a query whose namespaces are declared on the envelope", func() {
+		body, err := ioutil.ReadAll(queryRequest("bob", nil, true).Body)
+		Expect(err).NotTo(HaveOccurred())
+		envelope := declareNamespacesOnEnvelope(string(body))
+		Expect(envelope).To(ContainSubstring(`xmlns:samlp=`))
+		request := httptest.NewRequest("POST", "https://idp.example.com/attributes", strings.NewReader(envelope))
+
+		response := answer(request)
+		Expect(response.Status.StatusCode.Value).To(Equal(saml.StatusSuccess))
+		Expect(response.Assertion.Subject.NameID.Value).To(Equal("bob"))
+	})
+
+	It("should reject an unsigned query", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, queryRequest("bob", nil, false))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+})
@@ -0,0 +1,240 @@
+package attributes
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+var nameFormats = map[string]string{
+	"uri":         URINameFormat,
+	"basic":       "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+	"unspecified": "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified",
+}
+
+// Policy is the attribute release policy of an SP. Groups, when set, limits the groups
+// released to the ones listed.
+type Policy struct {
+	Rules  []Rule
+	Groups []string
+}
+
+// Rule releases the values of the user field Source, one of the users file fields name,
+// email, common_name, surname, given_name and groups, or attributes.<name> for a custom
+// attribute. Name and FriendlyName default to the standard attribute for the field, or
+// the name of the custom attribute. NameFormat is uri, basic, unspecified or a
+// name format URN, and defaults to uri for names starting with urn: and basic for
+// others. Transforms are applied to every value in order: lowercase, uppercase,
+// prefix:<text> and suffix:<text>.
+type Rule struct {
+	Source       string
+	Name         string
+	FriendlyName string
+	NameFormat   string
+	Transforms   []string
+}
+
+// Validate checks that the sources, name formats and transforms are known.
+func (p Policy) Validate() error {
+	for i, rule := range p.Rules {
+		if findDefinition(rule.Source) == nil {
+			return errors.Errorf("attributes[%d]: unknown source %q", i, rule.Source)
+		}
+		if rule.NameFormat != "" && nameFormats[rule.NameFormat] == "" && !strings.HasPrefix(rule.NameFormat, "urn:") {
+			return errors.Errorf("attributes[%d]: unknown name format %q", i, rule.NameFormat)
+		}
+		for _, transform := range rule.Transforms {
+			if _, err := transformer(transform); err != nil {
+				return errors.Wrapf(err, "attributes[%d]", i)
+			}
+		}
+	}
+	return nil
+}
+
+// Release returns the attributes of user the policy releases. Attributes without a
+// value are left out.
+func (p Policy) Release(user users.User) []saml.Attribute {
+	attributes := []saml.Attribute{}
+	for _, rule := range p.Rules {
+		definition := findDefinition(rule.Source)
+		if definition == nil {
+			continue
+		}
+
+		values := definition.values(user)
+		if rule.Source == "groups" && p.Groups != nil {
+			groups := []string{}
+			for _, group := range values {
+				if contains(p.Groups, group) {
+					groups = append(groups, group)
+				}
+			}
+			values = groups
+		}
+		transformed := []string{}
+		for _, value := range values {
+			for _, transform := range rule.Transforms {
+				apply, _ := transformer(transform)
+				value = apply(value)
+			}
+			transformed = append(transformed, value)
+		}
+
+		attributeValues := attributeValues(transformed)
+		if len(attributeValues) == 0 {
+			continue
+		}
+		attributes = append(attributes, saml.Attribute{
+			FriendlyName: rule.friendlyName(definition),
+			Name:         rule.name(definition),
+			NameFormat:   rule.nameFormat(definition),
+			Values:       attributeValues,
+		})
+	}
+	return attributes
+}
+
+func (r Rule) name(definition *definition) string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return definition.name
+}
+
+func (r Rule) friendlyName(definition *definition) string {
+	if r.FriendlyName != "" || r.Name != "" {
+		return r.FriendlyName
+	}
+	return definition.friendlyName
+}
+
+func (r Rule) nameFormat(definition *definition) string {
+	if nameFormat, ok := nameFormats[r.NameFormat]; ok {
+		return nameFormat
+	}
+	if r.NameFormat != "" {
+		return r.NameFormat
+	}
+	if strings.HasPrefix(r.name(definition), "urn:") {
+		return URINameFormat
+	}
+	return nameFormats["basic"]
+}
+
+func findDefinition(source string) *definition {
+	for i := range definitions {
+		if definitions[i].source == source {
+			return &definitions[i]
+		}
+	}
+	return customDefinition(source)
+}
+
+func transformer(transform string) (func(string) string, error) {
+	switch {
+	case transform == "lowercase":
+		return strings.ToLower, nil
+	case transform == "uppercase":
+		return strings.ToUpper, nil
+	case strings.HasPrefix(transform, "prefix:"):
+		prefix := strings.TrimPrefix(transform, "prefix:")
+		return func(value string) string { return prefix + value }, nil
+	case strings.HasPrefix(transform, "suffix:"):
+		suffix := strings.TrimPrefix(transform, "suffix:")
+		return func(value string) string { return value + suffix }, nil
+	}
+	return nil, errors.Errorf("unknown transform %q", transform)
+}
+
+// Policies holds the attribute release policies by SP entity ID, so they can be
+// replaced on reload.
+type Policies struct {
+	mu       sync.RWMutex
+	policies map[string]Policy
+}
+
+func NewPolicies(policies map[string]Policy) (*Policies, error) {
+	p := &Policies{}
+	return p, p.Set(policies)
+}
+
+// Set replaces the policies when they are all valid.
+func (p *Policies) Set(policies map[string]Policy) error {
+	for entityID, policy := range policies {
+		if err := policy.Validate(); err != nil {
+			return errors.Wrapf(err, "attribute policy of %s", entityID)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.policies = policies
+	return nil
+}
+
+// Get returns the policy of the SP, if it has one.
+func (p *Policies) Get(entityID string) (Policy, bool) {
+	if p == nil {
+		return Policy{}, false
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	policy, ok := p.policies[entityID]
+	return policy, ok
+}
+
+// AssertionMaker makes assertions with the wrapped saml.AssertionMaker, or
+// saml.DefaultAssertionMaker when it is nil, and replaces their attributes with the
+// ones the policy of the SP releases, including the custom attributes copied onto the
+// session in Store. SPs without a policy keep the attributes of the wrapped AssertionMaker.
+type AssertionMaker struct {
+	saml.AssertionMaker
+	Policies *Policies
+	Store    samlidp.Store
+}
+
+func (m AssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	assertionMaker := m.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+
+	policy, ok := m.Policies.Get(req.ServiceProviderMetadata.EntityID)
+	if !ok {
+		return nil
+	}
+	user, err := m.sessionUser(session)
+	if err != nil {
+		return err
+	}
+	req.Assertion.AttributeStatements = nil
+	if attributes := policy.Release(user); len(attributes) > 0 {
+		req.Assertion.AttributeStatements = []saml.AttributeStatement{{Attributes: attributes}}
+	}
+	return nil
+}
+
+func (m AssertionMaker) sessionUser(session *saml.Session) (users.User, error) {
+	user := users.User{User: samlidp.User{
+		Name:       session.UserName,
+		Groups:     session.Groups,
+		Email:      session.UserEmail,
+		CommonName: session.UserCommonName,
+		Surname:    session.UserSurname,
+		GivenName:  session.UserGivenName,
+	}}
+	if m.Store == nil {
+		return user, nil
+	}
+	var err error
+	user.Attributes, err = users.SessionAttributes(m.Store, session)
+	return user, err
+}
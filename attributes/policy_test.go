@@ -0,0 +1,151 @@
+package attributes_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/attributes"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net/http/httptest"
+
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("Policy", func() {
+	user := users.User{
+		User: samlidp.User{
+			Name:   "bob",
+			Email:  "Bob@Example.com",
+			Groups: []string{"staff", "admin"},
+		},
+		Attributes: map[string][]string{"roles": {"Reader", "Writer"}},
+	}
+
+	It("should name attributes after their source by default", func() {
+		policy := Policy{Rules: []Rule{{Source: "name"}}}
+		Expect(policy.Release(user)).To(Equal([]saml.Attribute{{
+			FriendlyName: "uid",
+			Name:         "urn:oid:0.9.2342.19200300.100.1.1",
+			NameFormat:   URINameFormat,
+			Values:       []saml.AttributeValue{{Type: "xs:string", Value: "bob"}},
+		}}))
+	})
+
+	It("should rename attributes and transform their values", func() {
+		policy := Policy{Rules: []Rule{
+			{Source: "email", Name: "email", Transforms: []string{"lowercase"}},
+			{Source: "name", Name: "urn:example:user", NameFormat: "unspecified", Transforms: []string{"uppercase", "prefix:EMP-", "suffix:@example.com"}},
+		}}
+		Expect(policy.Release(user)).To(Equal([]saml.Attribute{
+			{
+				Name:       "email",
+				NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+				Values:     []saml.AttributeValue{{Type: "xs:string", Value: "bob@example.com"}},
+			},
+			{
+				Name:       "urn:example:user",
+				NameFormat: "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified",
+				Values:     []saml.AttributeValue{{Type: "xs:string", Value: "EMP-BOB@example.com"}},
+			},
+		}))
+	})
+
+	It("should only release the listed groups", func() {
+		policy := Policy{Rules: []Rule{{Source: "groups", FriendlyName: "groups"}}, Groups: []string{"admin", "other"}}
+		attributes := policy.Release(user)
+		Expect(attributes).To(HaveLen(1))
+		Expect(attributes[0].FriendlyName).To(Equal("groups"))
+		Expect(attributes[0].Values).To(Equal([]saml.AttributeValue{{Type: "xs:string", Value: "admin"}}))
+	})
+
+	It("should release custom attributes under their own name", func() {
+		policy := Policy{Rules: []Rule{{Source: "attributes.roles", Transforms: []string{"lowercase"}}}}
+		Expect(policy.Release(user)).To(Equal([]saml.Attribute{{
+			FriendlyName: "roles",
+			Name:         "roles",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+			Values:       []saml.AttributeValue{{Type: "xs:string", Value: "reader"}, {Type: "xs:string", Value: "writer"}},
+		}}))
+	})
+
+	It("should reject unknown sources, name formats and transforms", func() {
+		Expect(Policy{Rules: []Rule{{Source: "phone"}}}.Validate()).To(MatchError(`attributes[0]: unknown source "phone"`))
+		Expect(Policy{Rules: []Rule{{Source: "name", NameFormat: "oid"}}}.Validate()).To(MatchError(`attributes[0]: unknown name format "oid"`))
+		Expect(Policy{Rules: []Rule{{Source: "name", Transforms: []string{"reverse"}}}}.Validate()).To(MatchError(`attributes[0]: unknown transform "reverse"`))
+	})
+})
+
+var _ = Describe("AssertionMaker", func() {
+	var policies *Policies
+	var assertionMaker AssertionMaker
+
+	makeAssertion := func(entityID string) *saml.Assertion {
+		req := &saml.IdpAuthnRequest{
+			HTTPRequest:             httptest.NewRequest("GET", "https://idp.example.com/sso", nil),
+			ServiceProviderMetadata: &saml.EntityDescriptor{EntityID: entityID},
+		}
+		session := &saml.Session{UserName: "bob", UserEmail: "bob@example.com", Groups: []string{"staff"}}
+		Expect(assertionMaker.MakeAssertion(req, session)).To(Succeed())
+		return req.Assertion
+	}
+
+	BeforeEach(func() {
+		var err error
+		policies, err = NewPolicies(map[string]Policy{
+			"https://sp.example.com": {Rules: []Rule{{Source: "email", Name: "email"}}},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		assertionMaker = AssertionMaker{AssertionMaker: stubAssertionMaker{}, Policies: policies}
+	})
+
+	It("should replace the attributes for an SP with a policy", func() {
+		assertion := makeAssertion("https://sp.example.com")
+		Expect(assertion.AttributeStatements).To(HaveLen(1))
+		Expect(assertion.AttributeStatements[0].Attributes).To(HaveLen(1))
+		Expect(assertion.AttributeStatements[0].Attributes[0].Name).To(Equal("email"))
+	})
+
+	It("should release the custom attributes copied onto the session", func() {
+		store := &samlidp.MemoryStore{}
+		Expect(store.Put("/sessions/session-id", users.Session{
+			Session:    saml.Session{ID: "session-id", UserName: "bob"},
+			Attributes: map[string][]string{"department": {"Engineering"}},
+		})).To(Succeed())
+		Expect(policies.Set(map[string]Policy{
+			"https://sp.example.com": {Rules: []Rule{{Source: "attributes.department"}}},
+		})).To(Succeed())
+		assertionMaker.Store = store
+
+		req := &saml.IdpAuthnRequest{
+			HTTPRequest:             httptest.NewRequest("GET", "https://idp.example.com/sso", nil),
+			ServiceProviderMetadata: &saml.EntityDescriptor{EntityID: "https://sp.example.com"},
+		}
+		Expect(assertionMaker.MakeAssertion(req, &saml.Session{ID: "session-id", UserName: "bob"})).To(Succeed())
+		Expect(req.Assertion.AttributeStatements[0].Attributes).To(HaveLen(1))
+		Expect(req.Assertion.AttributeStatements[0].Attributes[0].Name).To(Equal("department"))
+		Expect(req.Assertion.AttributeStatements[0].Attributes[0].Values).To(Equal([]saml.AttributeValue{{Type: "xs:string", Value: "Engineering"}}))
+	})
+
+	It("should keep the attributes for an SP without a policy", func() {
+		assertion := makeAssertion("https://other.example.com")
+		Expect(assertion.AttributeStatements[0].Attributes[0].FriendlyName).To(Equal("stub"))
+	})
+
+	It("should keep the current policies when new ones are invalid", func() {
+		Expect(policies.Set(map[string]Policy{
+			"https://sp.example.com": {Rules: []Rule{{Source: "phone"}}},
+		})).To(MatchError(`attribute policy of https://sp.example.com: attributes[0]: unknown source "phone"`))
+		_, ok := policies.Get("https://sp.example.com")
+		Expect(ok).To(BeTrue())
+	})
+})
+
+type stubAssertionMaker struct{}
+
+func (stubAssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	req.Assertion = &saml.Assertion{AttributeStatements: []saml.AttributeStatement{{
+		Attributes: []saml.Attribute{{FriendlyName: "stub"}},
+	}}}
+	return nil
+}
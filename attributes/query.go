@@ -0,0 +1,88 @@
+package attributes
+
+import (
+	"encoding/xml"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+const timeFormat = "2006-01-02T15:04:05.999Z07:00"
+
+// AttributeQuery is the SAML AttributeQuery, which the vendored saml package lacks.
+// Attributes are the attributes asked for; when there are none all attributes are.
+type AttributeQuery struct {
+	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
+	ID           string    `xml:",attr"`
+	Version      string    `xml:",attr"`
+	IssueInstant time.Time `xml:",attr"`
+	Destination  string    `xml:",attr"`
+	Issuer       *saml.Issuer
+	Signature    *etree.Element `xml:"-"`
+	Subject      *saml.Subject
+	Attributes   []saml.Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+}
+
+// Element returns an etree.Element representing the object in XML form.
+func (q *AttributeQuery) Element() *etree.Element {
+	el := etree.NewElement("samlp:AttributeQuery")
+	el.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+	el.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+	el.CreateAttr("ID", q.ID)
+	el.CreateAttr("Version", q.Version)
+	el.CreateAttr("IssueInstant", q.IssueInstant.UTC().Format(timeFormat))
+	if q.Destination != "" {
+		el.CreateAttr("Destination", q.Destination)
+	}
+	if q.Issuer != nil {
+		el.AddChild(q.Issuer.Element())
+	}
+	if q.Signature != nil {
+		el.AddChild(q.Signature)
+	}
+	if q.Subject != nil {
+		el.AddChild(q.Subject.Element())
+	}
+	for _, attribute := range q.Attributes {
+		el.AddChild(attribute.Element())
+	}
+	return el
+}
+
+// Requested returns the attributes asked for by the query. An attribute asked for with
+// values only keeps the values asked for.
+func (q *AttributeQuery) Requested(attributes []saml.Attribute) []saml.Attribute {
+	if len(q.Attributes) == 0 {
+		return attributes
+	}
+	requested := []saml.Attribute{}
+	for _, attribute := range attributes {
+		for _, requestedAttribute := range q.Attributes {
+			if requestedAttribute.Name != attribute.Name && requestedAttribute.Name != attribute.FriendlyName {
+				continue
+			}
+			if len(requestedAttribute.Values) > 0 {
+				attribute.Values = requestedValues(attribute.Values, requestedAttribute.Values)
+			}
+			if len(attribute.Values) > 0 {
+				requested = append(requested, attribute)
+			}
+			break
+		}
+	}
+	return requested
+}
+
+func requestedValues(values []saml.AttributeValue, requested []saml.AttributeValue) []saml.AttributeValue {
+	kept := []saml.AttributeValue{}
+	for _, value := range values {
+		for _, requestedValue := range requested {
+			if value.Value == requestedValue.Value {
+				kept = append(kept, value)
+				break
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+)
+
+// signedAuthnRequests rejects AuthnRequests to the SSO endpoint that are not signed
+// by the SP, before handing them to the saml package, which cannot check signatures.
+// HTTP-Redirect requests carry the signature in the query, which the login form does
+// not post back, so requests verified that way are remembered until they expire.
+type signedAuthnRequests struct {
+	idp     *saml.IdentityProvider
+	next    http.Handler
+	logr    *log.Logger
+	mu      sync.Mutex
+	checked map[[sha256.Size]byte]time.Time
+}
+
+func newSignedAuthnRequests(idp *saml.IdentityProvider, next http.Handler, logr *log.Logger) *signedAuthnRequests {
+	return &signedAuthnRequests{
+		idp:     idp,
+		next:    next,
+		logr:    logr,
+		checked: map[[sha256.Size]byte]time.Time{},
+	}
+}
+
+func (s *signedAuthnRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.verify(r); err != nil {
+		s.logr.Printf("rejecting AuthnRequest: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	s.next.ServeHTTP(w, r)
+}
+
+func (s *signedAuthnRequests) verify(r *http.Request) error {
+	req, err := saml.NewIdpAuthnRequest(s.idp, r)
+	if err != nil {
+		return err
+	}
+	request := saml.AuthnRequest{}
+	if err := xml.Unmarshal(req.RequestBuffer, &request); err != nil {
+		return err
+	}
+	if request.Destination != s.idp.SSOURL.String() {
+		return fmt.Errorf("expected destination to be %q, not %q", s.idp.SSOURL.String(), request.Destination)
+	}
+	if request.Issuer == nil {
+		return errors.New("request has no issuer")
+	}
+
+	serviceProvider, err := s.idp.ServiceProviderProvider.GetServiceProvider(r, request.Issuer.Value)
+	if err != nil {
+		return fmt.Errorf("cannot find service provider %s: %v", request.Issuer.Value, err)
+	}
+	certs, err := signing.SPSigningCertificates(serviceProvider)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("service provider %s publishes no signing certificate", request.Issuer.Value)
+	}
+
+	requestHash := sha256.Sum256(req.RequestBuffer)
+	if r.Method == "GET" {
+		if err := signing.VerifyRedirectSignature(r.URL.RawQuery, certs); err != nil {
+			return err
+		}
+		s.remember(requestHash, request.IssueInstant.Add(saml.MaxIssueDelay))
+		return nil
+	}
+
+	if request.Signature == nil && s.remembered(requestHash) {
+		return nil
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(req.RequestBuffer); err != nil {
+		return err
+	}
+	return signing.VerifyEnvelopedSignature(doc.Root(), certs)
+}
+
+func (s *signedAuthnRequests) remember(requestHash [sha256.Size]byte, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for checkedHash, checkedExpires := range s.checked {
+		if now.After(checkedExpires) {
+			delete(s.checked, checkedHash)
+		}
+	}
+	s.checked[requestHash] = expires
+}
+
+func (s *signedAuthnRequests) remembered(requestHash [sha256.Size]byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.checked[requestHash]
+	return ok && time.Now().Before(expires)
+}
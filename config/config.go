@@ -4,13 +4,207 @@ import "encoding/json"
 import (
 	"gopkg.in/validator.v2"
 	"fmt"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// Config is the IdP configuration.
 type Config struct {
-	PrivateKey                  string            `json:"private_key" validate:"nonzero"`
-	Certificate                 string            `json:"certificate" validate:"nonzero"`
-	Address                     string            `json:"address" validate:"nonzero"`
+	PrivateKey  string `json:"private_key" validate:"nonzero"`
+	Certificate string `json:"certificate" validate:"nonzero"`
+	// Address is the external base URL advertised in the metadata.
+	Address string `json:"address" validate:"nonzero"`
+	// PrivateKeyPassphraseEnv names the environment variable, and PrivateKeyPassphraseFile
+	// the file, holding the passphrase of an encrypted private_key.
+	PrivateKeyPassphraseEnv     string            `json:"private_key_passphrase_env"`
+	PrivateKeyPassphraseFile    string            `json:"private_key_passphrase_file"`
 	ServiceProviderMetadataURLs map[string]string `json:"sp_metadata_urls"`
+	// SPMetadataRefresh re-fetches sp_metadata_urls in the background, following the
+	// caching hints of the metadata within its intervals.
+	SPMetadataRefresh SPMetadataRefresh `json:"sp_metadata_refresh"`
+	// SPMetadataOptions holds the settings of each sp_metadata_urls entry, by its name.
+	SPMetadataOptions map[string]SPMetadataOptions `json:"sp_metadata_options"`
+	// SPMetadataTLS is how sp_metadata_urls served over https are fetched.
+	SPMetadataTLS SPMetadataTLS `json:"sp_metadata_tls"`
+	// Store selects where users, services and sessions are kept, in memory by default.
+	Store Store `json:"store"`
+	// ShutdownTimeout, 30s when unset, is how long in-flight requests have to finish
+	// after SIGINT or SIGTERM.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+	// Reload controls how the config and users files are reloaded while running.
+	Reload Reload `json:"reload"`
+	// TLS and Signing are the key pairs served over HTTPS and signed with, when they
+	// differ from certificate and private_key.
+	TLS     KeyPair `json:"tls"`
+	Signing KeyPair `json:"signing"`
+	// SigningKeys are the keys the signing key is rolled over with; the active one
+	// stands in for Signing.
+	SigningKeys []SigningKey `json:"signing_keys"`
+	// ListenAddress, an http:// or https:// URL defaulting to Address, is where the
+	// server listens, so the IdP can serve plain HTTP behind a TLS terminating proxy.
+	ListenAddress string `json:"listen_address"`
+	// TrustedProxies are the CIDRs X-Forwarded-Proto and X-Forwarded-Host are trusted from.
+	TrustedProxies []string `json:"trusted_proxies"`
+	// Generate creates the key pair files at startup when they do not exist yet.
+	Generate Generate `json:"generate"`
+	// WantAuthnRequestsSigned makes the IdP only accept AuthnRequests and LogoutRequests
+	// signed with a signing certificate from the SP metadata.
+	WantAuthnRequestsSigned bool `json:"want_authn_requests_signed"`
+	// AttributeRelease lists, by SP entity ID, the attributes the AttributeService
+	// answers an SP's AttributeQuery messages with, custom user attributes as
+	// attributes.<name>; SPs not listed get none.
+	AttributeRelease map[string][]string `json:"attribute_release"`
+	// AttributePolicies holds the attribute release policy of each SP, by entity ID.
+	AttributePolicies map[string]AttributePolicy `json:"attribute_policies"`
+	// NameID selects the NameID format issued to each SP.
+	NameID NameID `json:"nameid"`
+	// BcryptCost, bcrypt.DefaultCost when 0, is the cost plaintext passwords of the
+	// users file and the users API are hashed at.
+	BcryptCost int `json:"bcrypt_cost"`
+}
+
+// NameID overrides, by SP entity ID in Formats, the NameID format the SP asks for
+// with unspecified, emailAddress, persistent, transient or a format URN. Persistent
+// NameIDs are derived from the secret salt in the environment variable SaltEnv or the
+// file SaltFile, which must not change once they have been issued.
+type NameID struct {
+	Formats  map[string]string `json:"formats,omitempty"`
+	SaltEnv  string            `json:"salt_env,omitempty"`
+	SaltFile string            `json:"salt_file,omitempty"`
+}
+
+// AttributePolicy is the attribute release policy of the SP whose entity ID keys it in
+// attribute_policies. Its attributes replace the ones the saml package puts in
+// assertions, and take precedence over attribute_release for attribute queries.
+// Groups, when set, limits the groups released to the ones listed.
+type AttributePolicy struct {
+	Attributes []AttributeRule `json:"attributes"`
+	Groups     []string        `json:"groups"`
+}
+
+// AttributeRule releases the users file field Source, or attributes.<name> for a
+// custom user attribute, as the attribute Name, in NameFormat (uri, basic, unspecified
+// or a URN), after applying Transforms (lowercase, uppercase, prefix:<text>,
+// suffix:<text>) to each value.
+type AttributeRule struct {
+	Source       string   `json:"source"`
+	Name         string   `json:"name"`
+	FriendlyName string   `json:"friendly_name"`
+	NameFormat   string   `json:"name_format"`
+	Transforms   []string `json:"transforms"`
+}
+
+// Generate creates a private key and self-signed certificate at the paths of the tls
+// and signing key pairs when the files do not exist yet. KeyType is "rsa" (the
+// default) or "ec"; CommonName and SANs default to the host of address.
+type Generate struct {
+	Enabled    bool     `json:"enabled"`
+	KeyType    string   `json:"key_type,omitempty"`
+	CommonName string   `json:"common_name,omitempty"`
+	SANs       []string `json:"sans,omitempty"`
+	Validity   Duration `json:"validity,omitempty"`
+}
+
+// SigningKey is one of the signing_keys used to roll the signing key over. Every key
+// is published in the metadata and assertions are signed with the one whose State is
+// "active"; the "next" key is promoted with SIGUSR1, retiring the active one.
+type SigningKey struct {
+	KeyPair
+	State string `json:"state"`
+}
+
+func validateSigningKeys(signingKeys []SigningKey) (KeyPair, error) {
+	var active KeyPair
+	counts := map[string]int{}
+	for i, signingKey := range signingKeys {
+		if err := signingKey.validate(fmt.Sprintf("signing_keys[%d]", i)); err != nil {
+			return KeyPair{}, err
+		}
+		switch signingKey.State {
+		case "active":
+			active = signingKey.KeyPair
+		case "next", "retired":
+		default:
+			return KeyPair{}, fmt.Errorf("invalid config signing_keys[%d]: state must be next, active or retired", i)
+		}
+		counts[signingKey.State]++
+	}
+	if counts["active"] != 1 {
+		return KeyPair{}, fmt.Errorf("invalid config signing_keys: exactly one key must be active")
+	}
+	if counts["next"] > 1 {
+		return KeyPair{}, fmt.Errorf("invalid config signing_keys: at most one key can be next")
+	}
+	return active, nil
+}
+
+// KeyPair is a certificate and its private key, which may be passphrase protected.
+// TLS is the pair served over HTTPS and Signing the pair assertions are signed with;
+// either one left out falls back to the top level certificate and private_key.
+type KeyPair struct {
+	Certificate              string `json:"certificate,omitempty"`
+	PrivateKey               string `json:"private_key,omitempty"`
+	PrivateKeyPassphraseEnv  string `json:"private_key_passphrase_env,omitempty"`
+	PrivateKeyPassphraseFile string `json:"private_key_passphrase_file,omitempty"`
+}
+
+func (k KeyPair) isZero() bool {
+	return k == KeyPair{}
+}
+
+func (k KeyPair) validate(section string) error {
+	if k.Certificate == "" || k.PrivateKey == "" {
+		return fmt.Errorf("invalid config %s: certificate and private_key must both be set", section)
+	}
+	return nil
+}
+
+// Reload controls reloading of the config and users files while running. SIGHUP
+// always triggers a reload; with Watch set the files are also polled every Interval.
+type Reload struct {
+	Watch    bool     `json:"watch,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+// Store selects where users, services, shortcuts and sessions are kept. Type is
+// "memory" (the default), "file", which keeps them as JSON files under Path,
+// "sqlite", which keeps them in the database file at Path, or "postgres", which
+// connects using DataSource.
+type Store struct {
+	Type       string `json:"type,omitempty"`
+	Path       string `json:"path,omitempty"`
+	DataSource string `json:"data_source,omitempty"`
+}
+
+// SPMetadataTLS controls how sp_metadata_urls served over https are trusted.
+// Without a ca_bundle the system roots are used.
+type SPMetadataTLS struct {
+	CABundle           string `json:"ca_bundle,omitempty"`
+	ClientCertificate  string `json:"client_certificate,omitempty"`
+	ClientPrivateKey   string `json:"client_private_key,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+}
+
+// SPMetadataOptions holds per-SP settings, keyed by the same name as sp_metadata_urls.
+type SPMetadataOptions struct {
+	// SigningCertificate is the path to a PEM certificate the SP metadata must be signed with.
+	SigningCertificate string `json:"signing_certificate,omitempty"`
+	// CABundle replaces sp_metadata_tls.ca_bundle when fetching this SP's metadata.
+	CABundle string `json:"ca_bundle,omitempty"`
+	// Aggregate imports every SP entity of an EntitiesDescriptor, keyed by entityID,
+	// optionally narrowed down by the entity ID and entity category filters.
+	Aggregate        bool     `json:"aggregate,omitempty"`
+	IncludeEntityIDs []string `json:"include_entity_ids,omitempty"`
+	ExcludeEntityIDs []string `json:"exclude_entity_ids,omitempty"`
+	EntityCategories []string `json:"entity_categories,omitempty"`
+}
+
+// SPMetadataRefresh controls the background re-fetching of sp_metadata_urls.
+// Intervals left unset fall back to the refresher's defaults.
+type SPMetadataRefresh struct {
+	Enabled     bool     `json:"enabled"`
+	Interval    Duration `json:"interval,omitempty"`
+	MinInterval Duration `json:"min_interval,omitempty"`
+	MaxInterval Duration `json:"max_interval,omitempty"`
 }
 
 func NewConfig(configContent []byte) (*Config, error) {
@@ -18,11 +212,52 @@ func NewConfig(configContent []byte) (*Config, error) {
 	config := &Config{}
 	err := json.Unmarshal(configContent, config)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid config json %s", err)
+	}
+	if len(config.SigningKeys) > 0 {
+		active, err := validateSigningKeys(config.SigningKeys)
+		if err != nil {
+			return nil, err
+		}
+		if config.Signing.isZero() {
+			config.Signing = active
+		} else if config.Signing != active {
+			return nil, fmt.Errorf("invalid config: signing and the active signing_keys entry differ")
+		}
+	}
+	defaultKeyPair := KeyPair{
+		Certificate:              config.Certificate,
+		PrivateKey:               config.PrivateKey,
+		PrivateKeyPassphraseEnv:  config.PrivateKeyPassphraseEnv,
+		PrivateKeyPassphraseFile: config.PrivateKeyPassphraseFile,
+	}
+	if config.Certificate == "" && config.PrivateKey == "" && !config.Signing.isZero() {
+		config.Certificate = config.Signing.Certificate
+		config.PrivateKey = config.Signing.PrivateKey
+		defaultKeyPair = config.Signing
 	}
 	if err = validator.Validate(config); err != nil {
 		return nil, fmt.Errorf("invalid config %s", err)
 	}
 
+	if config.BcryptCost != 0 && (config.BcryptCost < bcrypt.MinCost || config.BcryptCost > bcrypt.MaxCost) {
+		return nil, fmt.Errorf("invalid config bcrypt_cost: must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	}
+
+	if config.ListenAddress == "" {
+		config.ListenAddress = config.Address
+	}
+
+	if config.TLS.isZero() {
+		config.TLS = defaultKeyPair
+	} else if err := config.TLS.validate("tls"); err != nil {
+		return nil, err
+	}
+	if config.Signing.isZero() {
+		config.Signing = defaultKeyPair
+	} else if err := config.Signing.validate("signing"); err != nil {
+		return nil, err
+	}
+
 	return config, err
 }
@@ -7,6 +7,7 @@ import (
 	. "github.com/onsi/gomega"
 	"github.com/onsi/ginkgo/extensions/table"
 	"encoding/json"
+	"time"
 )
 
 var _ = Describe("Config", func() {
@@ -30,10 +31,424 @@ var _ = Describe("Config", func() {
 		Expect(config.Certificate).To(Equal("def"))
 		Expect(config.Certificate).To(Equal("def"))
 		Expect(config.Address).To(Equal("http://localhost"))
+		Expect(config.ListenAddress).To(Equal("http://localhost"))
 		Expect(config.ServiceProviderMetadataURLs).To(HaveKeyWithValue("sp_name", "http://someurl"))
 		Expect(config.ServiceProviderMetadataURLs).To(HaveKeyWithValue("sp_name2", "http://someurl2"))
 	})
 
+	Context("when sp metadata refresh is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"sp_metadata_refresh": {
+						"enabled": true,
+						"interval": "30m",
+						"min_interval": "1m",
+						"max_interval": "12h"
+					}
+				}`))
+		})
+
+		It("should parse the refresh intervals", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.SPMetadataRefresh.Enabled).To(BeTrue())
+			Expect(time.Duration(config.SPMetadataRefresh.Interval)).To(Equal(30 * time.Minute))
+			Expect(time.Duration(config.SPMetadataRefresh.MinInterval)).To(Equal(time.Minute))
+			Expect(time.Duration(config.SPMetadataRefresh.MaxInterval)).To(Equal(12 * time.Hour))
+		})
+	})
+
+	Context("when per sp metadata options are configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"sp_metadata_options": {
+						"sp_name": {
+							"signing_certificate": "/path/to/sp_name-signing.pem"
+						},
+						"federation": {
+							"aggregate": true,
+							"include_entity_ids": ["https://sp1.example.com"],
+							"exclude_entity_ids": ["https://sp2.example.com"],
+							"entity_categories": ["http://refeds.org/category/research-and-scholarship"]
+						}
+					}
+				}`))
+		})
+
+		It("should parse the pinned signing certificate", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.SPMetadataOptions).To(HaveKey("sp_name"))
+			Expect(config.SPMetadataOptions["sp_name"].SigningCertificate).To(Equal("/path/to/sp_name-signing.pem"))
+		})
+
+		It("should parse the aggregate filters", func() {
+			Expect(err).NotTo(HaveOccurred())
+			federation := config.SPMetadataOptions["federation"]
+			Expect(federation.Aggregate).To(BeTrue())
+			Expect(federation.IncludeEntityIDs).To(Equal([]string{"https://sp1.example.com"}))
+			Expect(federation.ExcludeEntityIDs).To(Equal([]string{"https://sp2.example.com"}))
+			Expect(federation.EntityCategories).To(Equal([]string{"http://refeds.org/category/research-and-scholarship"}))
+		})
+	})
+
+	Context("when sp metadata tls is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"sp_metadata_tls": {
+						"ca_bundle": "/path/to/ca.pem",
+						"client_certificate": "/path/to/client.pem",
+						"client_private_key": "/path/to/client.key",
+						"insecure_skip_verify": true
+					},
+					"sp_metadata_options": {
+						"sp_name": {
+							"ca_bundle": "/path/to/sp_name-ca.pem"
+						}
+					}
+				}`))
+		})
+
+		It("should parse the tls trust settings", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.SPMetadataTLS).To(Equal(SPMetadataTLS{
+				CABundle:           "/path/to/ca.pem",
+				ClientCertificate:  "/path/to/client.pem",
+				ClientPrivateKey:   "/path/to/client.key",
+				InsecureSkipVerify: true,
+			}))
+			Expect(config.SPMetadataOptions["sp_name"].CABundle).To(Equal("/path/to/sp_name-ca.pem"))
+		})
+	})
+
+	Context("when a store is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"store": {
+						"type": "file",
+						"path": "/var/lib/saml-idp"
+					}
+				}`))
+		})
+
+		It("should parse the store settings", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Store).To(Equal(Store{Type: "file", Path: "/var/lib/saml-idp"}))
+		})
+	})
+
+	Context("when a postgres store is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"store": {
+						"type": "postgres",
+						"data_source": "postgres://idp@db.example.com/idp?sslmode=verify-full"
+					}
+				}`))
+		})
+
+		It("should parse the data source", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Store).To(Equal(Store{Type: "postgres", DataSource: "postgres://idp@db.example.com/idp?sslmode=verify-full"}))
+		})
+	})
+
+	Context("when a shutdown timeout is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"shutdown_timeout": "45s"
+				}`))
+		})
+
+		It("should parse the timeout", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.ShutdownTimeout).To(Equal(Duration(45 * time.Second)))
+		})
+	})
+
+	Context("when reloading is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"reload": {
+						"watch": true,
+						"interval": "10s"
+					}
+				}`))
+		})
+
+		It("should parse the watch settings", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Reload).To(Equal(Reload{Watch: true, Interval: Duration(10 * time.Second)}))
+		})
+	})
+
+	Context("when separate tls and signing key pairs are configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"tls": {
+						"certificate": "/path/to/tls.crt",
+						"private_key": "/path/to/tls.key"
+					},
+					"signing": {
+						"certificate": "/path/to/signing.crt",
+						"private_key": "/path/to/signing.key",
+						"private_key_passphrase_env": "SIGNING_KEY_PASSPHRASE"
+					}
+				}`))
+		})
+
+		It("should use each pair for its purpose", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.TLS).To(Equal(KeyPair{Certificate: "/path/to/tls.crt", PrivateKey: "/path/to/tls.key"}))
+			Expect(config.Signing).To(Equal(KeyPair{
+				Certificate:             "/path/to/signing.crt",
+				PrivateKey:              "/path/to/signing.key",
+				PrivateKeyPassphraseEnv: "SIGNING_KEY_PASSPHRASE",
+			}))
+		})
+	})
+
+	Context("when only the top level key pair is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"private_key_passphrase_file": "/path/to/passphrase",
+					"tls": {
+						"certificate": "/path/to/tls.crt",
+						"private_key": "/path/to/tls.key"
+					}
+				}`))
+		})
+
+		It("should fall back to it for the sections left out", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.TLS).To(Equal(KeyPair{Certificate: "/path/to/tls.crt", PrivateKey: "/path/to/tls.key"}))
+			Expect(config.Signing).To(Equal(KeyPair{Certificate: "def", PrivateKey: "abc", PrivateKeyPassphraseFile: "/path/to/passphrase"}))
+		})
+	})
+
+	Context("when a key pair section is incomplete", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"private_key": "abc",
+					"certificate": "def",
+					"tls": {
+						"certificate": "/path/to/tls.crt"
+					}
+				}`))
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError("invalid config tls: certificate and private_key must both be set"))
+		})
+	})
+
+	Context("when signing keys are configured for a rollover", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"signing_keys": [
+						{"certificate": "/path/to/old.crt", "private_key": "/path/to/old.key", "state": "retired"},
+						{"certificate": "/path/to/current.crt", "private_key": "/path/to/current.key", "state": "active"},
+						{"certificate": "/path/to/new.crt", "private_key": "/path/to/new.key", "state": "next"}
+					]
+				}`))
+		})
+
+		It("should sign with the active key", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.SigningKeys).To(HaveLen(3))
+			Expect(config.SigningKeys[2].State).To(Equal("next"))
+			Expect(config.Signing).To(Equal(KeyPair{Certificate: "/path/to/current.crt", PrivateKey: "/path/to/current.key"}))
+			Expect(config.TLS).To(Equal(config.Signing))
+		})
+	})
+
+	Context("when no signing key is active", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"signing_keys": [
+						{"certificate": "/path/to/new.crt", "private_key": "/path/to/new.key", "state": "next"}
+					]
+				}`))
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError("invalid config signing_keys: exactly one key must be active"))
+		})
+	})
+
+	Context("when a signing key has an unknown state", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "http://localhost",
+					"signing_keys": [
+						{"certificate": "/path/to/current.crt", "private_key": "/path/to/current.key", "state": "primary"}
+					]
+				}`))
+		})
+
+		It("should return an error", func() {
+			Expect(err).To(MatchError("invalid config signing_keys[0]: state must be next, active or retired"))
+		})
+	})
+
+	Context("when listening behind a reverse proxy", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "https://idp.example.com",
+					"private_key": "abc",
+					"certificate": "def",
+					"listen_address": "http://0.0.0.0:8080",
+					"trusted_proxies": ["10.0.0.0/8"]
+				}`))
+		})
+
+		It("should parse the listen address and trusted proxies", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Address).To(Equal("https://idp.example.com"))
+			Expect(config.ListenAddress).To(Equal("http://0.0.0.0:8080"))
+			Expect(config.TrustedProxies).To(Equal([]string{"10.0.0.0/8"}))
+		})
+	})
+
+	Context("when key pair generation is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "https://localhost:9090",
+					"private_key": "/path/to/idp.key",
+					"certificate": "/path/to/idp.crt",
+					"generate": {
+						"enabled": true,
+						"key_type": "ec",
+						"common_name": "idp.example.com",
+						"sans": ["idp.example.com", "127.0.0.1"],
+						"validity": "720h"
+					}
+				}`))
+		})
+
+		It("should parse the generate settings", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.Generate).To(Equal(Generate{
+				Enabled:    true,
+				KeyType:    "ec",
+				CommonName: "idp.example.com",
+				SANs:       []string{"idp.example.com", "127.0.0.1"},
+				Validity:   Duration(720 * time.Hour),
+			}))
+		})
+	})
+
+	Context("when attribute release is configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "https://localhost:9090",
+					"private_key": "abc",
+					"certificate": "def",
+					"attribute_release": {
+						"https://sp.example.com/metadata": ["mail", "eduPersonAffiliation"]
+					}
+				}`))
+		})
+
+		It("should parse the attributes released to each SP", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.AttributeRelease).To(Equal(map[string][]string{
+				"https://sp.example.com/metadata": {"mail", "eduPersonAffiliation"},
+			}))
+		})
+	})
+
+	Context("when attribute policies are configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "https://localhost:9090",
+					"private_key": "abc",
+					"certificate": "def",
+					"attribute_policies": {
+						"https://sp.example.com/metadata": {
+							"attributes": [
+								{"source": "email", "name": "email", "name_format": "basic", "transforms": ["lowercase"]}
+							],
+							"groups": ["staff"]
+						}
+					}
+				}`))
+		})
+
+		It("should parse the policy of each SP", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.AttributePolicies).To(Equal(map[string]AttributePolicy{
+				"https://sp.example.com/metadata": {
+					Attributes: []AttributeRule{
+						{Source: "email", Name: "email", NameFormat: "basic", Transforms: []string{"lowercase"}},
+					},
+					Groups: []string{"staff"},
+				},
+			}))
+		})
+	})
+
+	Context("when NameID formats are configured", func() {
+		BeforeEach(func() {
+			config, err = NewConfig([]byte(`{
+					"address": "https://localhost:9090",
+					"private_key": "abc",
+					"certificate": "def",
+					"nameid": {
+						"formats": {"https://sp.example.com/metadata": "persistent"},
+						"salt_env": "NAMEID_SALT"
+					}
+				}`))
+		})
+
+		It("should parse the format of each SP and where the salt is", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.NameID).To(Equal(NameID{
+				Formats: map[string]string{"https://sp.example.com/metadata": "persistent"},
+				SaltEnv: "NAMEID_SALT",
+			}))
+		})
+	})
+
+	Context("when a bcrypt cost is configured", func() {
+		It("should parse it", func() {
+			config, err = NewConfig([]byte(`{"address": "https://localhost:9090", "private_key": "abc", "certificate": "def", "bcrypt_cost": 12}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.BcryptCost).To(Equal(12))
+		})
+
+		It("should reject a cost bcrypt does not support", func() {
+			_, err = NewConfig([]byte(`{"address": "https://localhost:9090", "private_key": "abc", "certificate": "def", "bcrypt_cost": 3}`))
+			Expect(err).To(MatchError("invalid config bcrypt_cost: must be between 4 and 31"))
+		})
+	})
+
 	Context("when given an invalid json config file", func() {
 		var requiredFields map[string]string
 
@@ -63,6 +478,11 @@ var _ = Describe("Config", func() {
 			table.Entry("invalid cert", "certificate", "", "invalid config Certificate: zero value"),
 		)
 
+		It("should return an error for malformed json", func() {
+			_, err := NewConfig([]byte(`{"address": `))
+			Expect(err).To(MatchError(ContainSubstring("invalid config json")))
+		})
+
 	})
 
 })
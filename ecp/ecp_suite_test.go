@@ -0,0 +1,13 @@
+package ecp_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestECP(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ECP Suite")
+}
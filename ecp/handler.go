@@ -0,0 +1,187 @@
+package ecp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/DennisDenuto/saml-idp/soap"
+	"github.com/DennisDenuto/saml-idp/users"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+const (
+	PAOSBinding  = "urn:oasis:names:tc:SAML:2.0:bindings:PAOS"
+	ecpNamespace = "urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"
+)
+
+// SessionMaxAge is how long the sessions created for ECP clients last, the same as
+// the browser sessions of the samlidp package.
+const SessionMaxAge = time.Hour
+
+// Handler is the SingleSignOnService of the ECP profile, for clients without a browser.
+// The client posts the AuthnRequest it got from the SP in a SOAP envelope, authenticating
+// the user with HTTP Basic, and gets back the Response in a SOAP envelope to relay to
+// the assertion consumer service of the SP.
+type Handler struct {
+	IDP           *saml.IdentityProvider
+	Store         samlidp.Store
+	RequireSigned bool
+	Logger        logger.Interface
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := h.authenticate(r)
+	if err != nil {
+		h.Logger.Printf("ECP authentication failed: %s", err)
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+h.IDP.MetadataURL.Host+`"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	req, err := h.readRequest(r)
+	if err != nil {
+		h.Logger.Printf("ERROR: rejecting ECP AuthnRequest: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	buffer, err := h.respond(req, user)
+	if err != nil {
+		h.Logger.Printf("ERROR: ECP response failed: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write(buffer)
+}
+
+// authenticate checks the HTTP Basic credentials against the users in the store.
+func (h *Handler) authenticate(r *http.Request) (*users.User, error) {
+	name, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errors.New("no HTTP Basic credentials")
+	}
+	user := users.User{}
+	if err := h.Store.Get(fmt.Sprintf("/users/%s", name), &user); err != nil {
+		return nil, errors.Wrapf(err, "cannot find user %s", name)
+	}
+	if err := users.VerifyPassword(user.HashedPassword, password); err != nil {
+		return nil, errors.Errorf("wrong password for user %s", name)
+	}
+	return &user, nil
+}
+
+// readRequest validates the AuthnRequest in the SOAP body and picks the PAOS assertion
+// consumer service of the SP.
+func (h *Handler) readRequest(r *http.Request) (*saml.IdpAuthnRequest, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	el, err := soap.ReadBody(body)
+	if err != nil {
+		return nil, err
+	}
+	doc := etree.NewDocument()
+	doc.SetRoot(el.Copy())
+	requestBuffer, err := doc.WriteToBytes()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &saml.IdpAuthnRequest{
+		IDP:           h.IDP,
+		HTTPRequest:   r,
+		RequestBuffer: requestBuffer,
+		Now:           saml.TimeNow(),
+	}
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if err := h.verifySignature(doc.Root(), req.ServiceProviderMetadata); err != nil {
+		return nil, err
+	}
+	if endpoint := paosEndpoint(req); endpoint != nil {
+		req.ACSEndpoint = endpoint
+	}
+	if req.ACSEndpoint.Binding != PAOSBinding {
+		return nil, errors.Errorf("service provider %s has no PAOS assertion consumer service at %s", req.ServiceProviderMetadata.EntityID, req.ACSEndpoint.Location)
+	}
+	return req, nil
+}
+
+// verifySignature checks the signature of the AuthnRequest, which must be signed when
+// RequireSigned is set.
+func (h *Handler) verifySignature(el *etree.Element, serviceProvider *saml.EntityDescriptor) error {
+	if el.SelectElement("Signature") == nil {
+		if h.RequireSigned {
+			return errors.New("request is not signed")
+		}
+		return nil
+	}
+	certs, err := signing.SPSigningCertificates(serviceProvider)
+	if err != nil {
+		return err
+	}
+	return signing.VerifyEnvelopedSignature(el, certs)
+}
+
+// paosEndpoint returns the PAOS assertion consumer service of the SP at the URL the
+// request asks for, or nil. The saml package picks the endpoint by URL or index alone,
+// so it can pick another endpoint at the same URL.
+func paosEndpoint(req *saml.IdpAuthnRequest) *saml.IndexedEndpoint {
+	if req.Request.AssertionConsumerServiceIndex != "" {
+		return nil
+	}
+	for _, endpoint := range req.SPSSODescriptor.AssertionConsumerServices {
+		if endpoint.Binding != PAOSBinding {
+			continue
+		}
+		if req.Request.AssertionConsumerServiceURL == "" || endpoint.Location == req.Request.AssertionConsumerServiceURL {
+			return &endpoint
+		}
+	}
+	return nil
+}
+
+// respond starts a session for the user, so the SP can take part in single logout, and
+// returns the SOAP envelope carrying the Response.
+func (h *Handler) respond(req *saml.IdpAuthnRequest, user *users.User) ([]byte, error) {
+	stored := users.NewSession(*user, SessionMaxAge)
+	if err := h.Store.Put(fmt.Sprintf("/sessions/%s", stored.ID), stored); err != nil {
+		return nil, err
+	}
+	session := &stored.Session
+
+	assertionMaker := h.IDP.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		return nil, err
+	}
+	if req.ResponseEl == nil {
+		if err := req.MakeResponse(); err != nil {
+			return nil, err
+		}
+	}
+
+	ecpResponse := etree.NewElement("ecp:Response")
+	ecpResponse.CreateAttr("xmlns:ecp", ecpNamespace)
+	ecpResponse.CreateAttr("soap:mustUnderstand", "1")
+	ecpResponse.CreateAttr("soap:actor", soap.ActorNext)
+	ecpResponse.CreateAttr("AssertionConsumerServiceURL", req.ACSEndpoint.Location)
+	return soap.WriteEnvelope(req.ResponseEl, ecpResponse)
+}
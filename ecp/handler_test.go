@@ -0,0 +1,238 @@
+package ecp_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/ecp"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type serviceProviders map[string]*saml.EntityDescriptor
+
+func (s serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProvider, ok := s[serviceProviderID]; ok {
+		return serviceProvider, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func readFixture(name string) []byte {
+	contents, err := ioutil.ReadFile("../signing/fixtures/" + name)
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
+
+func readCertificate(name string) *x509.Certificate {
+	block, _ := pem.Decode(readFixture(name))
+	Expect(block).NotTo(BeNil())
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+// declareNamespacesOnEnvelope moves the prefixed namespace declarations in the body of a
+// SOAP envelope up to the Envelope, where many SOAP clients put them.
+func declareNamespacesOnEnvelope(buffer string) string {
+	doc := etree.NewDocument()
+	Expect(doc.ReadFromString(buffer)).To(Succeed())
+	envelope := doc.Root()
+	for _, el := range envelope.FindElements("./Body//*") {
+		attrs := []etree.Attr{}
+		for _, attr := range el.Attr {
+			if attr.Space == "xmlns" {
+				envelope.CreateAttr("xmlns:"+attr.Key, attr.Value)
+				continue
+			}
+			attrs = append(attrs, attr)
+		}
+		el.Attr = attrs
+	}
+	buffer, err := doc.WriteToString()
+	Expect(err).NotTo(HaveOccurred())
+	return buffer
+}
+
+var _ = Describe("Handler", func() {
+	var store *samlidp.MemoryStore
+	var handler *Handler
+	var spSigner signing.Signer
+	var serviceProvider *saml.EntityDescriptor
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.Put("/users/bob", samlidp.User{Name: "bob", HashedPassword: hashedPassword, Email: "bob@example.com"})).To(Succeed())
+
+		idpKey, err := signing.ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		idpCert := readCertificate("ec.crt")
+		keyRing, err := signing.NewKeyRing([]signing.Key{{State: signing.KeyStateActive, Signer: idpKey, Certificate: idpCert}})
+		Expect(err).NotTo(HaveOccurred())
+
+		spKey, err := signing.ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		spSigner = signing.Signer{Key: spKey, Certificate: readCertificate("rsa.crt")}
+
+		serviceProvider = &saml.EntityDescriptor{
+			EntityID: "https://sp.example.com",
+			SPSSODescriptors: []saml.SPSSODescriptor{{
+				SSODescriptor: saml.SSODescriptor{
+					RoleDescriptor: saml.RoleDescriptor{KeyDescriptors: []saml.KeyDescriptor{
+						{Use: "signing", KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(spSigner.Certificate.Raw)}},
+					}},
+				},
+				AssertionConsumerServices: []saml.IndexedEndpoint{
+					{Binding: saml.HTTPPostBinding, Location: "https://sp.example.com/acs", Index: 1},
+					{Binding: PAOSBinding, Location: "https://sp.example.com/acs", Index: 2},
+				},
+			}},
+		}
+
+		metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+		ssoURL, _ := url.Parse("https://idp.example.com/sso")
+		handler = &Handler{
+			IDP: &saml.IdentityProvider{
+				Key:                     idpKey,
+				Certificate:             idpCert,
+				Logger:                  logger.DefaultLogger,
+				MetadataURL:             *metadataURL,
+				SSOURL:                  *ssoURL,
+				AssertionMaker:          signing.AssertionMaker{Keys: keyRing},
+				ServiceProviderProvider: serviceProviders{"https://sp.example.com": serviceProvider},
+			},
+			Store:  store,
+			Logger: logger.DefaultLogger,
+		}
+	})
+
+	ecpRequest := func(signed bool) *http.Request {
+		authnRequest := &saml.AuthnRequest{
+			ID:                          "id-authn-request",
+			Version:                     "2.0",
+			IssueInstant:                time.Now(),
+			AssertionConsumerServiceURL: "https://sp.example.com/acs",
+			ProtocolBinding:             PAOSBinding,
+			Issuer:                      &saml.Issuer{Value: "https://sp.example.com"},
+		}
+		el := authnRequest.Element()
+		if signed {
+			signature, err := spSigner.Sign(el)
+			Expect(err).NotTo(HaveOccurred())
+			authnRequest.Signature = signature
+			el = authnRequest.Element()
+		}
+
+		doc := etree.NewDocument()
+		envelope := doc.CreateElement("S:Envelope")
+		envelope.CreateAttr("xmlns:S", "http://schemas.xmlsoap.org/soap/envelope/")
+		envelope.CreateElement("S:Body").AddChild(el)
+		buffer, err := doc.WriteToString()
+		Expect(err).NotTo(HaveOccurred())
+
+		request := httptest.NewRequest("POST", "https://idp.example.com/ecp", strings.NewReader(buffer))
+		request.Header.Set("Content-Type", "text/xml")
+		request.SetBasicAuth("bob", "secret")
+		return request
+	}
+
+	It("should return the response in a SOAP envelope", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, ecpRequest(false))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+
+		doc := etree.NewDocument()
+		Expect(doc.ReadFromBytes(recorder.Body.Bytes())).To(Succeed())
+		ecpResponse := doc.FindElement("./Envelope/Header/Response")
+		Expect(ecpResponse).NotTo(BeNil())
+		Expect(ecpResponse.SelectAttrValue("AssertionConsumerServiceURL", "")).To(Equal("https://sp.example.com/acs"))
+		Expect(ecpResponse.SelectAttrValue("soap:mustUnderstand", "")).To(Equal("1"))
+
+		response := doc.FindElement("./Envelope/Body/Response")
+		Expect(response).NotTo(BeNil())
+		Expect(response.SelectAttrValue("InResponseTo", "")).To(Equal("id-authn-request"))
+		Expect(response.SelectAttrValue("Destination", "")).To(Equal("https://sp.example.com/acs"))
+		Expect(response.FindElement(".//NameID").Text()).To(Equal("bob"))
+
+		sessions, err := store.List("/sessions/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sessions).To(HaveLen(1))
+	})
+
+	It("should ask for credentials when there are none", func() {
+		request := ecpRequest(false)
+		request.Header.Del("Authorization")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+		Expect(recorder.Header().Get("WWW-Authenticate")).To(Equal(`Basic realm="idp.example.com"`))
+	})
+
+	It("should reject a wrong password", func() {
+		request := ecpRequest(false)
+		request.SetBasicAuth("bob", "wrong")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("should reject an SP without a PAOS assertion consumer service", func() {
+		serviceProvider.SPSSODescriptors[0].AssertionConsumerServices = serviceProvider.SPSSODescriptors[0].AssertionConsumerServices[:1]
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, ecpRequest(false))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	Context("when requests must be signed", func() {
+		BeforeEach(func() {
+			handler.RequireSigned = true
+		})
+
+		It("should accept a signed request", func() {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, ecpRequest(true))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should accept a signed request whose namespaces are declared on the envelope", func() {
+			request := ecpRequest(true)
+			body, err := ioutil.ReadAll(request.Body)
+			Expect(err).NotTo(HaveOccurred())
+			envelope := declareNamespacesOnEnvelope(string(body))
+			Expect(envelope).To(ContainSubstring(`xmlns:samlp=`))
+			request = httptest.NewRequest("POST", "https://idp.example.com/ecp", strings.NewReader(envelope))
+			request.Header.Set("Content-Type", "text/xml")
+			request.SetBasicAuth("bob", "secret")
+
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should reject an unsigned request", func() {
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, ecpRequest(false))
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/config"
+	"github.com/DennisDenuto/saml-idp/signing"
+)
+
+// generateMissingKeyPairs writes a generated private key and self-signed certificate
+// to the signing and tls key pair paths whose files do not exist yet.
+func generateMissingKeyPairs(idpConfig *config.Config, logr *log.Logger) error {
+	baseURL, err := url.Parse(idpConfig.Address)
+	if err != nil {
+		return err
+	}
+	options := signing.GenerateOptions{
+		KeyType:    idpConfig.Generate.KeyType,
+		CommonName: idpConfig.Generate.CommonName,
+		SANs:       idpConfig.Generate.SANs,
+		Validity:   time.Duration(idpConfig.Generate.Validity),
+	}
+	if options.CommonName == "" {
+		options.CommonName = baseURL.Hostname()
+	}
+	if len(options.SANs) == 0 {
+		options.SANs = []string{baseURL.Hostname()}
+	}
+
+	for _, keyPair := range []config.KeyPair{idpConfig.Signing, idpConfig.TLS} {
+		generated, err := writeGeneratedKeyPair(keyPair, options)
+		if err != nil {
+			return err
+		}
+		if generated {
+			logr.Printf("Generated a self-signed certificate %s and private key %s", keyPair.Certificate, keyPair.PrivateKey)
+		}
+	}
+	return nil
+}
+
+// writeGeneratedKeyPair generates the key pair unless both of its files exist. It
+// refuses to replace just one of them, or to write a key that should be encrypted.
+func writeGeneratedKeyPair(keyPair config.KeyPair, options signing.GenerateOptions) (bool, error) {
+	certExists, err := fileExists(keyPair.Certificate)
+	if err != nil {
+		return false, err
+	}
+	keyExists, err := fileExists(keyPair.PrivateKey)
+	if err != nil {
+		return false, err
+	}
+	if certExists && keyExists {
+		return false, nil
+	}
+	if certExists || keyExists {
+		return false, fmt.Errorf("cannot generate %s and %s, only one of them exists", keyPair.Certificate, keyPair.PrivateKey)
+	}
+	if keyPair.PrivateKeyPassphraseEnv != "" || keyPair.PrivateKeyPassphraseFile != "" {
+		return false, fmt.Errorf("cannot generate %s, passphrase protected private keys are not generated", keyPair.PrivateKey)
+	}
+
+	certPEM, keyPEM, err := signing.GenerateKeyPair(options)
+	if err != nil {
+		return false, err
+	}
+	for _, path := range []string{keyPair.Certificate, keyPair.PrivateKey} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return false, err
+		}
+	}
+	if err := ioutil.WriteFile(keyPair.PrivateKey, keyPEM, 0600); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(keyPair.Certificate, certPEM, 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func fileExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// runGenerate is the generate subcommand, which writes a key pair without a config
+// file. It returns the exit status for the process.
+func runGenerate(args []string, logr *log.Logger) int {
+	flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+	certPath := flags.String("cert", "", "The Path to write the certificate to")
+	keyPath := flags.String("key", "", "The Path to write the private key to")
+	keyType := flags.String("key-type", signing.KeyTypeRSA, "The type of key to generate, rsa or ec")
+	commonName := flags.String("cn", "localhost", "The common name of the certificate")
+	sans := flags.String("sans", "localhost", "Comma separated DNS names and IP addresses of the certificate")
+	validity := flags.Duration("validity", signing.DefaultValidity, "How long the certificate is valid for")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *certPath == "" || *keyPath == "" {
+		logr.Print("generate requires -cert and -key")
+		return 2
+	}
+
+	options := signing.GenerateOptions{
+		KeyType:    *keyType,
+		CommonName: *commonName,
+		Validity:   *validity,
+	}
+	for _, san := range strings.Split(*sans, ",") {
+		if san = strings.TrimSpace(san); san != "" {
+			options.SANs = append(options.SANs, san)
+		}
+	}
+
+	keyPair := config.KeyPair{Certificate: *certPath, PrivateKey: *keyPath}
+	generated, err := writeGeneratedKeyPair(keyPair, options)
+	if err != nil {
+		logr.Print("Cannot generate key pair:", err)
+		return 1
+	}
+	if !generated {
+		logr.Printf("%s and %s already exist", *certPath, *keyPath)
+		return 0
+	}
+	logr.Printf("Generated a self-signed certificate %s and private key %s", *certPath, *keyPath)
+	return 0
+}
@@ -0,0 +1,188 @@
+package logout
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/pkg/errors"
+)
+
+// message is a SAMLRequest or SAMLResponse received with the HTTP-Redirect or
+// HTTP-POST binding.
+type message struct {
+	name       string
+	binding    string
+	buffer     []byte
+	relayState string
+}
+
+// readMessage returns the message in r, or nil when there is none.
+func readMessage(r *http.Request) (*message, error) {
+	switch r.Method {
+	case "GET":
+		query := r.URL.Query()
+		for _, name := range []string{"SAMLRequest", "SAMLResponse"} {
+			if query.Get(name) == "" {
+				continue
+			}
+			compressed, err := base64.StdEncoding.DecodeString(query.Get(name))
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot decode message")
+			}
+			buffer, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot decompress message")
+			}
+			return &message{name: name, binding: saml.HTTPRedirectBinding, buffer: buffer, relayState: query.Get("RelayState")}, nil
+		}
+		return nil, nil
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		for _, name := range []string{"SAMLRequest", "SAMLResponse"} {
+			if r.PostForm.Get(name) == "" {
+				continue
+			}
+			buffer, err := base64.StdEncoding.DecodeString(r.PostForm.Get(name))
+			if err != nil {
+				return nil, errors.Wrap(err, "cannot decode message")
+			}
+			return &message{name: name, binding: saml.HTTPPostBinding, buffer: buffer, relayState: r.PostForm.Get("RelayState")}, nil
+		}
+		return nil, nil
+	}
+	return nil, errors.New("method not allowed")
+}
+
+// verifySignature checks the signature of a message from the SP, which must be
+// signed when required is set.
+func verifySignature(r *http.Request, msg *message, serviceProvider *saml.EntityDescriptor, required bool) error {
+	certs, err := signing.SPSigningCertificates(serviceProvider)
+	if err != nil {
+		return err
+	}
+
+	if msg.binding == saml.HTTPRedirectBinding {
+		if r.URL.Query().Get("Signature") != "" {
+			return signing.VerifyRedirectSignature(r.URL.RawQuery, certs)
+		}
+	} else {
+		doc := etree.NewDocument()
+		if err := doc.ReadFromBytes(msg.buffer); err != nil {
+			return err
+		}
+		if doc.Root() != nil && doc.Root().SelectElement("Signature") != nil {
+			return signing.VerifyEnvelopedSignature(doc.Root(), certs)
+		}
+	}
+	if required {
+		return errors.New("message is not signed")
+	}
+	return nil
+}
+
+var postFormTemplate = template.Must(template.New("saml-post-form").Parse(`<html>` +
+	`<form method="post" action="{{.URL}}" id="SAMLForm">` +
+	`<input type="hidden" name="{{.Name}}" value="{{.Message}}" />` +
+	`<input type="hidden" name="RelayState" value="{{.RelayState}}" />` +
+	`<input id="SAMLSubmitButton" type="submit" value="Continue" />` +
+	`</form>` +
+	`<script>document.getElementById('SAMLSubmitButton').style.visibility='hidden';</script>` +
+	`<script>document.getElementById('SAMLForm').submit();</script>` +
+	`</html>`))
+
+var confirmLogoutTemplate = template.Must(template.New("confirm-logout").Parse(`<html>` +
+	`<form method="post" action="{{.URL}}">` +
+	`<p>Do you want to log out?</p>` +
+	`<input type="hidden" name="token" value="{{.Token}}" />` +
+	`<input type="submit" value="Log out" />` +
+	`</form>` +
+	`</html>`))
+
+// send sends a message signed by signer to the endpoint with its binding. element
+// returns the message with the given signature, or without one when it is nil.
+func send(w http.ResponseWriter, r *http.Request, signer signing.Signer, binding string, location string, name string, element func(signature *etree.Element) *etree.Element, relayState string) error {
+	el := element(nil)
+
+	switch binding {
+	case saml.HTTPPostBinding:
+		signature, err := signer.Sign(el)
+		if err != nil {
+			return err
+		}
+		buffer, err := writeElement(element(signature))
+		if err != nil {
+			return err
+		}
+		return postFormTemplate.Execute(w, struct {
+			URL        string
+			Name       string
+			Message    string
+			RelayState string
+		}{
+			URL:        location,
+			Name:       name,
+			Message:    base64.StdEncoding.EncodeToString(buffer),
+			RelayState: relayState,
+		})
+
+	case saml.HTTPRedirectBinding:
+		buffer, err := writeElement(el)
+		if err != nil {
+			return err
+		}
+		compressed := &bytes.Buffer{}
+		writer, err := flate.NewWriter(compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		writer.Write(buffer)
+		writer.Close()
+
+		query := name + "=" + url.QueryEscape(base64.StdEncoding.EncodeToString(compressed.Bytes()))
+		if relayState != "" {
+			query += "&RelayState=" + url.QueryEscape(relayState)
+		}
+		query, err = signer.SignQuery(query)
+		if err != nil {
+			return err
+		}
+		separator := "?"
+		if strings.Contains(location, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, location+separator+query, http.StatusFound)
+		return nil
+	}
+	return errors.Errorf("unsupported binding %s", binding)
+}
+
+func writeElement(el *etree.Element) ([]byte, error) {
+	doc := etree.NewDocument()
+	doc.SetRoot(el)
+	return doc.WriteToBytes()
+}
+
+func newID() string {
+	return fmt.Sprintf("id-%x", randomBytes(20))
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
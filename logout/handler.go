@@ -0,0 +1,352 @@
+package logout
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+// MaxLogoutDuration is how long the SPs of a session have to log out before the
+// logout is abandoned.
+const MaxLogoutDuration = 10 * time.Minute
+
+// Handler serves the single logout endpoint. A LogoutRequest from an SP, or a user
+// confirming the logout form shown when they visit the endpoint, ends the IdP session
+// and then sends the browser to every other participant of the session in turn with a
+// LogoutRequest. Once they have all
+// answered, the SP that asked for the logout is sent a LogoutResponse. Messages are
+// signed with the active key; those from SPs must be signed when RequireSigned is set.
+type Handler struct {
+	IDP           *saml.IdentityProvider
+	Store         samlidp.Store
+	Keys          *signing.KeyRing
+	SLOURL        url.URL
+	RequireSigned bool
+	Logger        logger.Interface
+}
+
+// logoutState tracks a logout across the SPs it is sent to, under /logout_states/<id>.
+type logoutState struct {
+	Remaining  []Participant
+	Pending    string
+	PendingID  string
+	Partial    bool
+	Requester  string
+	RequestID  string
+	RelayState string
+	Expires    time.Time
+}
+
+func logoutStateKey(id string) string {
+	return fmt.Sprintf("/logout_states/%s", id)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	msg, err := readMessage(r)
+	if err != nil {
+		h.Logger.Printf("ERROR: cannot read logout message: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case msg == nil && r.Method != "POST":
+		err = h.confirmLogout(w, r)
+	case msg == nil:
+		err = h.userLogout(w, r)
+	case msg.name == "SAMLRequest":
+		err = h.handleRequest(w, r, msg)
+	default:
+		err = h.handleResponse(w, r, msg)
+	}
+	if err != nil {
+		h.Logger.Printf("ERROR: logout failed: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+	}
+}
+
+func (h *Handler) handleRequest(w http.ResponseWriter, r *http.Request, msg *message) error {
+	request := LogoutRequest{}
+	if err := xml.Unmarshal(msg.buffer, &request); err != nil {
+		return err
+	}
+	if request.Issuer == nil {
+		return errors.New("LogoutRequest has no issuer")
+	}
+	if request.Destination != "" && request.Destination != h.SLOURL.String() {
+		return errors.Errorf("expected destination to be %q, not %q", h.SLOURL.String(), request.Destination)
+	}
+	serviceProvider, err := h.IDP.ServiceProviderProvider.GetServiceProvider(r, request.Issuer.Value)
+	if err != nil {
+		return errors.Errorf("cannot find service provider %s: %v", request.Issuer.Value, err)
+	}
+	if err := verifySignature(r, msg, serviceProvider, h.RequireSigned); err != nil {
+		return err
+	}
+
+	sessionIndex := ""
+	if len(request.SessionIndex) > 0 {
+		sessionIndex = request.SessionIndex[0]
+	}
+	return h.logout(w, r, &logoutState{
+		Requester:  serviceProvider.EntityID,
+		RequestID:  request.ID,
+		RelayState: msg.relayState,
+	}, sessionIndex)
+}
+
+func (h *Handler) handleResponse(w http.ResponseWriter, r *http.Request, msg *message) error {
+	response := LogoutResponse{}
+	if err := xml.Unmarshal(msg.buffer, &response); err != nil {
+		return err
+	}
+
+	state := logoutState{}
+	if err := h.Store.Get(logoutStateKey(msg.relayState), &state); err != nil {
+		return errors.Errorf("unknown logout %q: %v", msg.relayState, err)
+	}
+	if time.Now().After(state.Expires) {
+		h.delete(logoutStateKey(msg.relayState))
+		return errors.New("logout expired")
+	}
+	if response.InResponseTo != state.PendingID {
+		return errors.Errorf("expected a response to %s, not %s", state.PendingID, response.InResponseTo)
+	}
+	if response.Issuer == nil || response.Issuer.Value != state.Pending {
+		return errors.Errorf("expected a response from %s", state.Pending)
+	}
+	serviceProvider, err := h.IDP.ServiceProviderProvider.GetServiceProvider(r, state.Pending)
+	if err != nil {
+		return errors.Errorf("cannot find service provider %s: %v", state.Pending, err)
+	}
+	if err := verifySignature(r, msg, serviceProvider, h.RequireSigned); err != nil {
+		return err
+	}
+
+	if response.Status.StatusCode.Value != saml.StatusSuccess {
+		h.Logger.Printf("WARNING: %s did not log out: %s", state.Pending, response.Status.StatusCode.Value)
+		state.Partial = true
+	}
+	return h.next(w, r, msg.relayState, &state)
+}
+
+// confirmLogout shows the user a form that posts back to the endpoint to log out, so
+// that a page cannot log its visitors out by linking to the endpoint.
+func (h *Handler) confirmLogout(w http.ResponseWriter, r *http.Request) error {
+	session := h.browserSession(r)
+	if session == nil {
+		return h.writeLoggedOut(w, false)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return confirmLogoutTemplate.Execute(w, struct {
+		URL   string
+		Token string
+	}{
+		URL:   h.SLOURL.String(),
+		Token: logoutToken(session.ID),
+	})
+}
+
+// userLogout ends the session of the browser once the logout form has been posted
+// with the token of the session.
+func (h *Handler) userLogout(w http.ResponseWriter, r *http.Request) error {
+	session := h.browserSession(r)
+	if session == nil {
+		return h.writeLoggedOut(w, false)
+	}
+	if !hmac.Equal([]byte(r.PostForm.Get("token")), []byte(logoutToken(session.ID))) {
+		return errors.New("logout form has a missing or wrong token")
+	}
+	return h.logout(w, r, &logoutState{}, "")
+}
+
+// browserSession returns the session of the browser, or nil when it has none.
+func (h *Handler) browserSession(r *http.Request) *saml.Session {
+	sessionCookie, err := r.Cookie("session")
+	if err != nil {
+		return nil
+	}
+	session := saml.Session{}
+	if err := h.Store.Get(fmt.Sprintf("/sessions/%s", sessionCookie.Value), &session); err != nil {
+		return nil
+	}
+	return &session
+}
+
+// logoutToken returns the token the logout form of a session must be posted with. It
+// is derived from the session ID, which other sites cannot read.
+func logoutToken(sessionID string) string {
+	mac := hmac.New(sha256.New, []byte(sessionID))
+	mac.Write([]byte("logout"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// logout ends the session of the browser, or the one with sessionIndex when the
+// request does not come with a session cookie, and starts logging out its participants.
+func (h *Handler) logout(w http.ResponseWriter, r *http.Request, state *logoutState, sessionIndex string) error {
+	sessionID := ""
+	if sessionCookie, err := r.Cookie("session"); err == nil {
+		session := saml.Session{}
+		if err := h.Store.Get(fmt.Sprintf("/sessions/%s", sessionCookie.Value), &session); err == nil {
+			sessionID = session.ID
+			sessionIndex = session.Index
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "", MaxAge: -1, HttpOnly: true, Path: "/"})
+	}
+
+	if sessionIndex != "" {
+		sessionParticipants := SessionParticipants{}
+		err := h.Store.Get(sessionParticipantsKey(sessionIndex), &sessionParticipants)
+		if err != nil && err != samlidp.ErrNotFound {
+			return err
+		}
+		if sessionID == "" {
+			sessionID = sessionParticipants.SessionID
+		}
+		for _, participant := range sessionParticipants.Participants {
+			if participant.EntityID != state.Requester {
+				state.Remaining = append(state.Remaining, participant)
+			}
+		}
+		h.delete(sessionParticipantsKey(sessionIndex))
+	}
+	if sessionID != "" {
+		h.delete(fmt.Sprintf("/sessions/%s", sessionID))
+	}
+
+	state.Expires = time.Now().Add(MaxLogoutDuration)
+	return h.next(w, r, hex.EncodeToString(randomBytes(16)), state)
+}
+
+// next sends a LogoutRequest to the next participant, or finishes the logout when
+// there are none left.
+func (h *Handler) next(w http.ResponseWriter, r *http.Request, stateID string, state *logoutState) error {
+	for len(state.Remaining) > 0 {
+		participant := state.Remaining[0]
+		state.Remaining = state.Remaining[1:]
+
+		endpoint, err := h.sloEndpoint(r, participant.EntityID)
+		if err != nil {
+			h.Logger.Printf("WARNING: cannot log out of %s: %s", participant.EntityID, err)
+			state.Partial = true
+			continue
+		}
+
+		nameID := participant.NameID
+		request := &LogoutRequest{
+			ID:           newID(),
+			Version:      "2.0",
+			IssueInstant: saml.TimeNow(),
+			Destination:  endpoint.Location,
+			Issuer:       h.issuer(),
+			NameID:       &nameID,
+			SessionIndex: []string{participant.SessionIndex},
+		}
+		state.Pending = participant.EntityID
+		state.PendingID = request.ID
+		if err := h.Store.Put(logoutStateKey(stateID), state); err != nil {
+			return err
+		}
+		return send(w, r, h.signer(), endpoint.Binding, endpoint.Location, "SAMLRequest", func(signature *etree.Element) *etree.Element {
+			request.Signature = signature
+			return request.Element()
+		}, stateID)
+	}
+
+	h.delete(logoutStateKey(stateID))
+	if state.Requester == "" {
+		return h.writeLoggedOut(w, state.Partial)
+	}
+
+	endpoint, err := h.sloEndpoint(r, state.Requester)
+	if err != nil {
+		h.Logger.Printf("WARNING: cannot send LogoutResponse to %s: %s", state.Requester, err)
+		return h.writeLoggedOut(w, state.Partial)
+	}
+	location := endpoint.Location
+	if endpoint.ResponseLocation != "" {
+		location = endpoint.ResponseLocation
+	}
+	response := &LogoutResponse{
+		ID:           newID(),
+		InResponseTo: state.RequestID,
+		Version:      "2.0",
+		IssueInstant: saml.TimeNow(),
+		Destination:  location,
+		Issuer:       h.issuer(),
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	if state.Partial {
+		response.Status.StatusCode.StatusCode = &saml.StatusCode{Value: saml.StatusPartialLogout}
+	}
+	return send(w, r, h.signer(), endpoint.Binding, location, "SAMLResponse", func(signature *etree.Element) *etree.Element {
+		response.Signature = signature
+		return response.Element()
+	}, state.RelayState)
+}
+
+// sloEndpoint returns the SingleLogoutService of the SP, preferring HTTP-POST.
+func (h *Handler) sloEndpoint(r *http.Request, entityID string) (*saml.Endpoint, error) {
+	serviceProvider, err := h.IDP.ServiceProviderProvider.GetServiceProvider(r, entityID)
+	if err != nil {
+		return nil, err
+	}
+	var found *saml.Endpoint
+	for _, spSSODescriptor := range serviceProvider.SPSSODescriptors {
+		for _, endpoint := range spSSODescriptor.SingleLogoutServices {
+			endpoint := endpoint
+			if endpoint.Binding == saml.HTTPPostBinding {
+				return &endpoint, nil
+			}
+			if endpoint.Binding == saml.HTTPRedirectBinding && found == nil {
+				found = &endpoint
+			}
+		}
+	}
+	if found == nil {
+		return nil, errors.New("no SingleLogoutService with a supported binding")
+	}
+	return found, nil
+}
+
+// delete deletes key from the store. A logout goes on when it cannot; leftover logout
+// states expire and are no longer accepted.
+func (h *Handler) delete(key string) {
+	if err := h.Store.Delete(key); err != nil {
+		h.Logger.Printf("WARNING: cannot delete %s: %s", key, err)
+	}
+}
+
+func (h *Handler) issuer() *saml.Issuer {
+	return &saml.Issuer{
+		Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+		Value:  h.IDP.MetadataURL.String(),
+	}
+}
+
+func (h *Handler) signer() signing.Signer {
+	activeKey := h.Keys.Active()
+	return signing.Signer{Key: activeKey.Signer, Certificate: activeKey.Certificate}
+}
+
+func (h *Handler) writeLoggedOut(w http.ResponseWriter, partial bool) error {
+	w.Header().Set("Content-Type", "text/html")
+	if partial {
+		_, err := w.Write([]byte(`<html><p>You have been logged out, but not every service could be logged out. Close your browser to end the remaining sessions.</p></html>`))
+		return err
+	}
+	_, err := w.Write([]byte(`<html><p>You have been logged out.</p></html>`))
+	return err
+}
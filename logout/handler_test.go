@@ -0,0 +1,337 @@
+package logout_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/logout"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"html"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+)
+
+type serviceProviders map[string]*saml.EntityDescriptor
+
+func (s serviceProviders) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	if serviceProvider, ok := s[serviceProviderID]; ok {
+		return serviceProvider, nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func readFixture(name string) []byte {
+	contents, err := ioutil.ReadFile("../signing/fixtures/" + name)
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
+
+func readCertificate(name string) *x509.Certificate {
+	block, _ := pem.Decode(readFixture(name))
+	Expect(block).NotTo(BeNil())
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
+
+func serviceProvider(entityID string, binding string, cert *x509.Certificate) *saml.EntityDescriptor {
+	return &saml.EntityDescriptor{
+		EntityID: entityID,
+		SPSSODescriptors: []saml.SPSSODescriptor{{
+			SSODescriptor: saml.SSODescriptor{
+				RoleDescriptor: saml.RoleDescriptor{KeyDescriptors: []saml.KeyDescriptor{
+					{Use: "signing", KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(cert.Raw)}},
+				}},
+				SingleLogoutServices: []saml.Endpoint{{Binding: binding, Location: entityID + "/slo"}},
+			},
+		}},
+	}
+}
+
+// failingDeleteStore is a store that cannot delete anything.
+type failingDeleteStore struct {
+	*samlidp.MemoryStore
+}
+
+func (failingDeleteStore) Delete(key string) error {
+	return errors.New("store is read-only")
+}
+
+var formValue = regexp.MustCompile(`name="(SAMLRequest|SAMLResponse|RelayState)" value="([^"]*)"`)
+
+func postedForm(recorder *httptest.ResponseRecorder) url.Values {
+	values := url.Values{}
+	for _, match := range formValue.FindAllStringSubmatch(recorder.Body.String(), -1) {
+		values.Set(match[1], html.UnescapeString(match[2]))
+	}
+	return values
+}
+
+func inflate(encoded string) []byte {
+	compressed, err := base64.StdEncoding.DecodeString(encoded)
+	Expect(err).NotTo(HaveOccurred())
+	buffer, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	Expect(err).NotTo(HaveOccurred())
+	return buffer
+}
+
+var _ = Describe("Handler", func() {
+	var handler *Handler
+	var store *samlidp.MemoryStore
+	var spSigner signing.Signer
+	var idpCert *x509.Certificate
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+
+		idpKey, err := signing.ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		idpCert = readCertificate("ec.crt")
+		keyRing, err := signing.NewKeyRing([]signing.Key{{State: signing.KeyStateActive, Signer: idpKey, Certificate: idpCert}})
+		Expect(err).NotTo(HaveOccurred())
+
+		spKey, err := signing.ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		spSigner = signing.Signer{Key: spKey, Certificate: readCertificate("rsa.crt")}
+
+		metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+		sloURL, _ := url.Parse("https://idp.example.com/slo")
+		handler = &Handler{
+			IDP: &saml.IdentityProvider{
+				MetadataURL: *metadataURL,
+				ServiceProviderProvider: serviceProviders{
+					"https://sp1.example.com": serviceProvider("https://sp1.example.com", saml.HTTPRedirectBinding, spSigner.Certificate),
+					"https://sp2.example.com": serviceProvider("https://sp2.example.com", saml.HTTPPostBinding, spSigner.Certificate),
+				},
+			},
+			Store:  store,
+			Keys:   keyRing,
+			SLOURL: *sloURL,
+			Logger: logger.DefaultLogger,
+		}
+
+		Expect(store.Put("/sessions/session-id", &saml.Session{ID: "session-id", Index: "session-index"})).To(Succeed())
+		Expect(store.Put("/session_participants/session-index", &SessionParticipants{
+			SessionID: "session-id",
+			Participants: []Participant{
+				{EntityID: "https://sp1.example.com", NameID: saml.NameID{Value: "bob"}, SessionIndex: "session-index"},
+				{EntityID: "https://sp2.example.com", NameID: saml.NameID{Value: "bob"}, SessionIndex: "session-index"},
+			},
+		})).To(Succeed())
+	})
+
+	redirectRequest := func(signed bool) *http.Request {
+		logoutRequest := &LogoutRequest{
+			ID:           "id-sp1-request",
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Destination:  "https://idp.example.com/slo",
+			Issuer:       &saml.Issuer{Value: "https://sp1.example.com"},
+			NameID:       &saml.NameID{Value: "bob"},
+			SessionIndex: []string{"session-index"},
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(logoutRequest.Element())
+		buffer, err := doc.WriteToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		compressed := &bytes.Buffer{}
+		writer, _ := flate.NewWriter(compressed, flate.DefaultCompression)
+		writer.Write(buffer)
+		writer.Close()
+
+		query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(compressed.Bytes())) + "&RelayState=sp1-state"
+		if signed {
+			query, err = spSigner.SignQuery(query)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		request := httptest.NewRequest("GET", "https://idp.example.com/slo?"+query, nil)
+		request.AddCookie(&http.Cookie{Name: "session", Value: "session-id"})
+		return request
+	}
+
+	It("should log out of every participant and answer the SP that asked", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, redirectRequest(true))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Set-Cookie")).To(ContainSubstring("session=;"))
+		Expect(store.Get("/sessions/session-id", &saml.Session{})).To(Equal(samlidp.ErrNotFound))
+		Expect(store.Get("/session_participants/session-index", &SessionParticipants{})).To(Equal(samlidp.ErrNotFound))
+
+		Expect(recorder.Body.String()).To(ContainSubstring(`action="https://sp2.example.com/slo"`))
+		form := postedForm(recorder)
+		requestBuffer, err := base64.StdEncoding.DecodeString(form.Get("SAMLRequest"))
+		Expect(err).NotTo(HaveOccurred())
+		doc := etree.NewDocument()
+		Expect(doc.ReadFromBytes(requestBuffer)).To(Succeed())
+		Expect(doc.Root().FindElement("./Signature")).NotTo(BeNil())
+		logoutRequest := LogoutRequest{}
+		Expect(xml.Unmarshal(requestBuffer, &logoutRequest)).To(Succeed())
+		Expect(logoutRequest.Destination).To(Equal("https://sp2.example.com/slo"))
+		Expect(logoutRequest.NameID.Value).To(Equal("bob"))
+		Expect(logoutRequest.SessionIndex).To(Equal([]string{"session-index"}))
+
+		logoutResponse := &LogoutResponse{
+			ID:           "id-sp2-response",
+			InResponseTo: logoutRequest.ID,
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       &saml.Issuer{Value: "https://sp2.example.com"},
+			Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+		}
+		doc = etree.NewDocument()
+		doc.SetRoot(logoutResponse.Element())
+		responseBuffer, err := doc.WriteToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		request := httptest.NewRequest("POST", "https://idp.example.com/slo", strings.NewReader(url.Values{
+			"SAMLResponse": {base64.StdEncoding.EncodeToString(responseBuffer)},
+			"RelayState":   {form.Get("RelayState")},
+		}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusFound))
+		location, err := url.Parse(recorder.Header().Get("Location"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(location.Host + location.Path).To(Equal("sp1.example.com/slo"))
+		Expect(signing.VerifyRedirectSignature(location.RawQuery, []*x509.Certificate{idpCert})).To(Succeed())
+		Expect(location.Query().Get("RelayState")).To(Equal("sp1-state"))
+
+		finalResponse := LogoutResponse{}
+		Expect(xml.Unmarshal(inflate(location.Query().Get("SAMLResponse")), &finalResponse)).To(Succeed())
+		Expect(finalResponse.InResponseTo).To(Equal("id-sp1-request"))
+		Expect(finalResponse.Status.StatusCode.Value).To(Equal(saml.StatusSuccess))
+		Expect(finalResponse.Status.StatusCode.StatusCode).To(BeNil())
+	})
+
+	It("should reject a response to another request", func() {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, redirectRequest(true))
+		form := postedForm(recorder)
+
+		logoutResponse := &LogoutResponse{
+			ID:           "id-sp2-response",
+			InResponseTo: "id-other",
+			Version:      "2.0",
+			Issuer:       &saml.Issuer{Value: "https://sp2.example.com"},
+			Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+		}
+		doc := etree.NewDocument()
+		doc.SetRoot(logoutResponse.Element())
+		responseBuffer, err := doc.WriteToBytes()
+		Expect(err).NotTo(HaveOccurred())
+		request := httptest.NewRequest("POST", "https://idp.example.com/slo", strings.NewReader(url.Values{
+			"SAMLResponse": {base64.StdEncoding.EncodeToString(responseBuffer)},
+			"RelayState":   {form.Get("RelayState")},
+		}.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("should reject an unsigned request when signatures are required", func() {
+		handler.RequireSigned = true
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, redirectRequest(false))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(store.Get("/sessions/session-id", &saml.Session{})).To(Succeed())
+	})
+
+	It("should reject a request from an unknown SP", func() {
+		handler.IDP.ServiceProviderProvider = serviceProviders{}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, redirectRequest(true))
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+	})
+
+	Context("when a user visits the endpoint", func() {
+		BeforeEach(func() {
+			Expect(store.Delete("/session_participants/session-index")).To(Succeed())
+		})
+
+		logoutForm := func() url.Values {
+			request := httptest.NewRequest("GET", "https://idp.example.com/slo", nil)
+			request.AddCookie(&http.Cookie{Name: "session", Value: "session-id"})
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring(`<form method="post" action="https://idp.example.com/slo">`))
+			token := regexp.MustCompile(`name="token" value="([^"]*)"`).FindStringSubmatch(recorder.Body.String())
+			Expect(token).To(HaveLen(2))
+			return url.Values{"token": {token[1]}}
+		}
+
+		postLogout := func(form url.Values) *httptest.ResponseRecorder {
+			request := httptest.NewRequest("POST", "https://idp.example.com/slo", strings.NewReader(form.Encode()))
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			request.AddCookie(&http.Cookie{Name: "session", Value: "session-id"})
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			return recorder
+		}
+
+		It("should ask the user to confirm before logging them out", func() {
+			logoutForm()
+			Expect(store.Get("/sessions/session-id", &saml.Session{})).To(Succeed())
+		})
+
+		It("should log the user out at the IdP when they confirm", func() {
+			recorder := postLogout(logoutForm())
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring("You have been logged out."))
+			Expect(store.Get("/sessions/session-id", &saml.Session{})).To(Equal(samlidp.ErrNotFound))
+		})
+
+		It("should not log the user out when the form has no token", func() {
+			recorder := postLogout(url.Values{})
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(store.Get("/sessions/session-id", &saml.Session{})).To(Succeed())
+		})
+
+		It("should not log the user out when the form has the token of another session", func() {
+			Expect(store.Put("/sessions/other-session-id", &saml.Session{ID: "other-session-id"})).To(Succeed())
+			request := httptest.NewRequest("GET", "https://idp.example.com/slo", nil)
+			request.AddCookie(&http.Cookie{Name: "session", Value: "other-session-id"})
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			token := regexp.MustCompile(`name="token" value="([^"]*)"`).FindStringSubmatch(recorder.Body.String())
+			Expect(token).To(HaveLen(2))
+
+			recorder = postLogout(url.Values{"token": {token[1]}})
+			Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+			Expect(store.Get("/sessions/session-id", &saml.Session{})).To(Succeed())
+		})
+
+		It("should log when a logout cannot be cleaned up", func() {
+			logOutput := &bytes.Buffer{}
+			handler.Logger = log.New(logOutput, "", 0)
+			handler.Store = failingDeleteStore{store}
+
+			recorder := postLogout(logoutForm())
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(logOutput.String()).To(ContainSubstring("WARNING: cannot delete /sessions/session-id: store is read-only"))
+			Expect(logOutput.String()).To(MatchRegexp(`WARNING: cannot delete /logout_states/\w+: store is read-only`))
+		})
+	})
+})
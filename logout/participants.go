@@ -0,0 +1,71 @@
+package logout
+
+import (
+	"fmt"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+// Participant is an SP that was sent an assertion in a session, and so has to be told
+// when the session ends.
+type Participant struct {
+	EntityID     string
+	NameID       saml.NameID
+	SessionIndex string
+}
+
+// SessionParticipants is stored under /session_participants/<session index>.
+type SessionParticipants struct {
+	SessionID    string
+	Participants []Participant
+}
+
+func sessionParticipantsKey(sessionIndex string) string {
+	return fmt.Sprintf("/session_participants/%s", sessionIndex)
+}
+
+// ParticipantTracker makes assertions with the wrapped saml.AssertionMaker, or
+// saml.DefaultAssertionMaker when it is nil, and records the SP as a participant of
+// the session.
+type ParticipantTracker struct {
+	saml.AssertionMaker
+	Store samlidp.Store
+}
+
+func (t ParticipantTracker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	assertionMaker := t.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+
+	participant := Participant{
+		EntityID:     req.ServiceProviderMetadata.EntityID,
+		SessionIndex: session.Index,
+	}
+	if req.Assertion != nil && req.Assertion.Subject != nil && req.Assertion.Subject.NameID != nil {
+		participant.NameID = *req.Assertion.Subject.NameID
+	}
+
+	sessionParticipants := SessionParticipants{}
+	err := t.Store.Get(sessionParticipantsKey(session.Index), &sessionParticipants)
+	if err != nil && err != samlidp.ErrNotFound {
+		return err
+	}
+	sessionParticipants.SessionID = session.ID
+
+	replaced := false
+	for i, existing := range sessionParticipants.Participants {
+		if existing.EntityID == participant.EntityID {
+			sessionParticipants.Participants[i] = participant
+			replaced = true
+		}
+	}
+	if !replaced {
+		sessionParticipants.Participants = append(sessionParticipants.Participants, participant)
+	}
+	return t.Store.Put(sessionParticipantsKey(session.Index), &sessionParticipants)
+}
@@ -0,0 +1,65 @@
+package logout_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/logout"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+type stubAssertionMaker struct{}
+
+func (stubAssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	req.Assertion = &saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: session.NameID}}}
+	return nil
+}
+
+var _ = Describe("ParticipantTracker", func() {
+	var store *samlidp.MemoryStore
+	var tracker ParticipantTracker
+	var session *saml.Session
+
+	makeAssertion := func(entityID string) {
+		idpURL, err := url.Parse("https://idp.example.com/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		httpRequest, err := http.NewRequest("GET", "https://idp.example.com/sso", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		req := &saml.IdpAuthnRequest{
+			IDP:                     &saml.IdentityProvider{MetadataURL: *idpURL, SSOURL: *idpURL},
+			HTTPRequest:             httpRequest,
+			ServiceProviderMetadata: &saml.EntityDescriptor{EntityID: entityID},
+			SPSSODescriptor:         &saml.SPSSODescriptor{},
+			ACSEndpoint:             &saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: entityID + "/acs"},
+			Now:                     time.Now(),
+		}
+		Expect(tracker.MakeAssertion(req, session)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		tracker = ParticipantTracker{AssertionMaker: stubAssertionMaker{}, Store: store}
+		session = &saml.Session{ID: "session-id", Index: "session-index", NameID: "bob"}
+	})
+
+	It("should record every SP sent an assertion in the session once", func() {
+		makeAssertion("https://sp1.example.com")
+		makeAssertion("https://sp2.example.com")
+		makeAssertion("https://sp1.example.com")
+
+		sessionParticipants := SessionParticipants{}
+		Expect(store.Get("/session_participants/session-index", &sessionParticipants)).To(Succeed())
+		Expect(sessionParticipants.SessionID).To(Equal("session-id"))
+		Expect(sessionParticipants.Participants).To(HaveLen(2))
+		Expect(sessionParticipants.Participants[0].EntityID).To(Equal("https://sp1.example.com"))
+		Expect(sessionParticipants.Participants[0].NameID.Value).To(Equal("bob"))
+		Expect(sessionParticipants.Participants[0].SessionIndex).To(Equal("session-index"))
+		Expect(sessionParticipants.Participants[1].EntityID).To(Equal("https://sp2.example.com"))
+	})
+})
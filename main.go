@@ -10,24 +10,50 @@ import (
 	"github.com/crewjam/saml/logger"
 	"github.com/crewjam/saml/samlidp"
 	"github.com/zenazn/goji"
-	"golang.org/x/crypto/bcrypt"
 	"os"
 	"os/signal"
 	"net"
 	"github.com/DennisDenuto/saml-idp/config"
 	"io/ioutil"
 	"errors"
-	"encoding/json"
 	"github.com/DennisDenuto/saml-idp/service_providers"
 	"time"
 	"crypto/tls"
 	"log"
+	"fmt"
+	idpstore "github.com/DennisDenuto/saml-idp/store"
+	_ "github.com/mattn/go-sqlite3"
+	_ "github.com/lib/pq"
+	"net/http"
+	"syscall"
+	"sync"
+	"context"
+	"io"
+	"bytes"
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/DennisDenuto/saml-idp/proxy"
+	"github.com/DennisDenuto/saml-idp/logout"
+	"github.com/DennisDenuto/saml-idp/artifact"
+	"github.com/DennisDenuto/saml-idp/ecp"
+	"github.com/DennisDenuto/saml-idp/attributes"
+	"github.com/DennisDenuto/saml-idp/nameid"
+	idpusers "github.com/DennisDenuto/saml-idp/users"
 )
 
+const defaultShutdownTimeout = 30 * time.Second
+
+// transientIDSweepInterval is how often the transient NameIDs of expired sessions are
+// deleted.
+const transientIDSweepInterval = 10 * time.Minute
+
 func main() {
 	logr := logger.DefaultLogger
+	if len(os.Args) > 1 && os.Args[1] == "generate" {
+		os.Exit(runGenerate(os.Args[2:], logr))
+	}
 	configFile := flag.String("c", "", "The Path to the idp config file")
 	usersFilePath := flag.String("users", "", "The Path to the users file")
+	usersFormat := flag.String("users-format", "", "The format of the users file: json, yaml, csv or ldif (default from its extension)")
 	flag.Parse()
 
 	configFileContents, err := ioutil.ReadFile(*configFile)
@@ -39,17 +65,34 @@ func main() {
 		panic(err)
 	}
 
-	cert, err := validateCert(idpConfig.Certificate)
+	if idpConfig.Generate.Enabled {
+		if err := generateMissingKeyPairs(idpConfig, logr); err != nil {
+			logr.Fatal("Cannot generate key pair:", err)
+		}
+	}
+
+	cert, err := validateCert(idpConfig.Signing.Certificate)
 	if err != nil {
 		logr.Fatal("Cannot validate certificate:", err)
 	}
 
-	key, err := validateKey(idpConfig.PrivateKey)
+	keyPassphrase, err := readKeyPassphrase(idpConfig.Signing)
+	if err != nil {
+		logr.Fatal("Cannot read private key passphrase:", err)
+	}
+
+	key, err := validateKey(idpConfig.Signing.PrivateKey, keyPassphrase)
 	if err != nil {
 		logr.Fatal("Cannot validate private key:", err)
 	}
+	if err := signing.CheckKeyMatchesCertificate(key, cert); err != nil {
+		logr.Fatal("Cannot validate private key:", err)
+	}
 
-	store := &samlidp.MemoryStore{}
+	store, err := createStore(idpConfig.Store)
+	if err != nil {
+		logr.Fatal("Cannot create store:", err)
+	}
 
 	baseURL, err := url.Parse(idpConfig.Address)
 	if err != nil {
@@ -66,83 +109,454 @@ func main() {
 		logr.Fatalf("%s", err)
 	}
 
+	signingKeys, err := loadSigningKeys(idpConfig)
+	if err != nil {
+		logr.Fatal("Cannot load signing keys:", err)
+	}
+	keyRing, err := signing.NewKeyRing(signingKeys)
+	if err != nil {
+		logr.Fatal("Cannot load signing keys:", err)
+	}
+	attributePolicies, err := attributes.NewPolicies(newAttributePolicies(idpConfig))
+	if err != nil {
+		logr.Fatal("Cannot load attribute policies:", err)
+	}
+	nameIDMaker, err := newNameIDMaker(idpConfig, store)
+	if err != nil {
+		logr.Fatal("Cannot load NameID settings:", err)
+	}
+	background := newBackgroundTasks()
+	background.Go(func(stop <-chan struct{}) {
+		sweepTransientIDs(store, transientIDSweepInterval, stop, logr)
+	})
+	nameIDMaker.AssertionMaker = attributes.AssertionMaker{Policies: attributePolicies, Store: store}
+	idpServer.IDP.AssertionMaker = logout.ParticipantTracker{
+		AssertionMaker: signing.AssertionMaker{
+			AssertionMaker: nameIDMaker,
+			Keys:           keyRing,
+		},
+		Store: store,
+	}
+
+	idpServer.IDP.SessionProvider = idpusers.SessionProvider{SessionProvider: idpServer, Store: store}
+
+	serviceIndex := service_providers.NewServiceIndex()
 	idpServer.IDP.ServiceProviderProvider = service_providers.InMemoryServiceProviderProvider{
 		Logger:      logr,
 		Store: store,
+		Index: serviceIndex,
 	}
 
-	err = addUsers(usersFilePath, idpServer.Store)
+	tlsKeyPair, err := newTLSKeyPair(idpConfig.TLS)
+	if err != nil {
+		logr.Fatal("Unable to load server cert", err)
+	}
+
+	idpReloader := &reloader{
+		configFile:  *configFile,
+		usersFile:   *usersFilePath,
+		usersFormat: *usersFormat,
+		store:       store,
+		index:       serviceIndex,
+		tlsKeyPair:  tlsKeyPair,
+		keyRing:     keyRing,
+		policies:    attributePolicies,
+		logr:        logr,
+		config:      idpConfig,
+	}
+	err = idpReloader.syncUsers(&reloadSummary{})
 	if err != nil {
 		logr.Fatalf("%s", err)
 	}
 
+	sloURL := *baseURL
+	sloURL.Path = sloURL.Path + "/slo"
+	artifactResolutionURL := *baseURL
+	artifactResolutionURL.Path = artifactResolutionURL.Path + "/artifact"
+	ecpURL := *baseURL
+	ecpURL.Path = ecpURL.Path + "/ecp"
+	attributeServiceURL := *baseURL
+	attributeServiceURL.Path = attributeServiceURL.Path + "/attributes"
+	goji.Get("/metadata", metadataHandler{
+		idp:                     &idpServer.IDP,
+		keys:                    keyRing,
+		wantAuthnRequestsSigned: idpConfig.WantAuthnRequestsSigned,
+		sloURL:                  sloURL,
+		artifactResolutionURL:   artifactResolutionURL,
+		ecpURL:                  ecpURL,
+		attributeServiceURL:     attributeServiceURL,
+		nameIDFormats:           nameIDMaker.SupportedFormats(),
+	})
+	goji.Handle("/slo", &logout.Handler{
+		IDP:           &idpServer.IDP,
+		Store:         store,
+		Keys:          keyRing,
+		SLOURL:        sloURL,
+		RequireSigned: idpConfig.WantAuthnRequestsSigned,
+		Logger:        logr,
+	})
+	goji.Handle("/artifact", &artifact.ResolutionHandler{
+		IDP:    &idpServer.IDP,
+		Store:  store,
+		Keys:   keyRing,
+		Logger: logr,
+	})
+	goji.Handle("/ecp", &ecp.Handler{
+		IDP:           &idpServer.IDP,
+		Store:         store,
+		RequireSigned: idpConfig.WantAuthnRequestsSigned,
+		Logger:        logr,
+	})
+	goji.Handle("/attributes", &attributes.Handler{
+		IDP:      &idpServer.IDP,
+		Store:    store,
+		Keys:     keyRing,
+		Policies: attributePolicies,
+		Release:  idpConfig.AttributeRelease,
+		Logger:   logr,
+	})
+	var ssoHandler http.Handler = &artifact.SSOHandler{
+		IDP:    &idpServer.IDP,
+		Store:  store,
+		Logger: logr,
+	}
+	if idpConfig.WantAuthnRequestsSigned {
+		ssoHandler = newSignedAuthnRequests(&idpServer.IDP, ssoHandler, logr)
+	}
+	goji.Handle("/sso", ssoHandler)
+	usersHandler := &idpusers.Handler{IDP: &idpServer.IDP, Store: store, BcryptCost: idpConfig.BcryptCost, Logger: logr}
+	goji.Handle("/login", usersHandler.HandleLogin)
+	goji.Get("/users/:id", usersHandler.HandleGetUser)
+	goji.Put("/users/:id", usersHandler.HandlePutUser)
 	goji.Handle("/*", idpServer)
+	goji.DefaultMux.Compile()
+
+	listenURL, err := url.Parse(idpConfig.ListenAddress)
+	if err != nil {
+		logr.Fatalf("cannot parse listen address: %v", err)
+	}
+	// Signals are caught from before the server is listening, so they are handled once
+	// startup is done rather than killing the process.
+	interruptSignal := make(chan os.Signal, 1)
+	signal.Notify(interruptSignal, os.Interrupt, syscall.SIGTERM)
+	hangupSignal := make(chan os.Signal, 1)
+	signal.Notify(hangupSignal, syscall.SIGHUP)
+	promoteSignal := make(chan os.Signal, 1)
+	signal.Notify(promoteSignal, syscall.SIGUSR1)
 
-	tlsListener := createTLSListener(baseURL, logr, idpConfig)
+	listener := createListener(listenURL, logr, tlsKeyPair)
 
+	trustedProxies, err := proxy.ParseCIDRs(idpConfig.TrustedProxies)
+	if err != nil {
+		logr.Fatal("Cannot parse trusted proxies:", err)
+	}
+	server := &http.Server{Handler: proxy.ForwardedHeaders{
+		TrustedProxies: trustedProxies,
+		Handler:        goji.DefaultMux,
+	}}
 	go func() {
-		goji.ServeListener(tlsListener)
+		err := server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			logr.Fatal("Server failed:", err)
+		}
 	}()
 
 	logr.Print("Server Listening")
 
-	bootstrap := service_providers.SPBootstrap{
-		MetadataURLs: idpConfig.ServiceProviderMetadataURLs,
-		Timeout:      3 * time.Minute,
-		BackOffDuration: 20 * time.Second,
-		SpMetadataConfigurer: service_providers.SPMetadataConfigurerStore{
-			Store: store,
-		},
-		Logger: logr,
+	metadataTLS := idpConfig.SPMetadataTLS
+	if metadataTLS.InsecureSkipVerify {
+		logr.Print("WARNING: TLS verification of SP metadata urls is disabled")
 	}
-	err = bootstrap.Run()
+	err = idpReloader.syncServices(idpConfig, &reloadSummary{})
 	if err != nil {
 		logr.Fatal("Cannot bootstrap SPs:", err)
 	}
 
-	interruptSignal := make(chan os.Signal, 1)
-	signal.Notify(interruptSignal)
+	reload := make(chan struct{}, 1)
+	if idpConfig.Reload.Watch {
+		watchInterval := time.Duration(idpConfig.Reload.Interval)
+		if watchInterval == 0 {
+			watchInterval = defaultReloadInterval
+		}
+		background.Go(func(stop <-chan struct{}) {
+			watchFiles([]string{*configFile, *usersFilePath}, watchInterval, reload, stop)
+		})
+	}
 
-	select {
-	case <-interruptSignal:
-		logr.Print("Stopping Server")
+	// Reloads run off the signal loop, so a slow metadata fetch cannot hold up shutdown.
+	// A reload asked for while one runs is started once it is done.
+	reloadDone := make(chan struct{})
+	reloading, reloadPending := false, false
+	startReload := func() {
+		if reloading {
+			reloadPending = true
+			return
+		}
+		reloading = true
+		go func() {
+			idpReloader.Reload()
+			reloadDone <- struct{}{}
+		}()
 	}
+
+	for stopping := false; !stopping; {
+		select {
+		case <-hangupSignal:
+			startReload()
+		case <-reload:
+			startReload()
+		case <-reloadDone:
+			reloading = false
+			if reloadPending {
+				reloadPending = false
+				startReload()
+			}
+		case <-promoteSignal:
+			idpReloader.PromoteSigningKey()
+		case <-interruptSignal:
+			stopping = true
+		}
+	}
+	idpReloader.Stop()
+	if reloading {
+		<-reloadDone
+	}
+	logr.Print("Stopping Server")
+
+	shutdownTimeout := time.Duration(idpReloader.config.ShutdownTimeout)
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	os.Exit(shutdown(server, shutdownTimeout, store, background, logr))
 }
 
-func createTLSListener(baseURL *url.URL, logr *log.Logger, idpConfig *config.Config) net.Listener {
-	l, err := net.Listen("tcp", baseURL.Host)
+// shutdown stops accepting connections, waits up to timeout for in-flight requests
+// to finish, stops the background tasks and closes the store. It returns the exit
+// status for the process.
+func shutdown(server *http.Server, timeout time.Duration, store samlidp.Store, background *backgroundTasks, logr *log.Logger) int {
+	exitStatus := 0
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logr.Printf("ERROR: requests still in flight after %s, closing their connections: %s", timeout, err)
+		server.Close()
+		exitStatus = 1
+	}
+
+	background.Stop()
+	if closer, ok := store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logr.Printf("ERROR: closing store: %s", err)
+			exitStatus = 1
+		}
+	}
+
+	logr.Print("Server Stopped")
+	return exitStatus
+}
+
+// createListener listens on the host of listenURL, serving TLS with keyPair unless
+// the scheme is http.
+func createListener(listenURL *url.URL, logr *log.Logger, keyPair *tlsKeyPair) net.Listener {
+	l, err := net.Listen("tcp", listenURL.Host)
 	if err != nil {
 		logr.Fatal("Cannot create tcp listener:", err)
 
 	}
-	serverCert, err := tls.LoadX509KeyPair(idpConfig.Certificate, idpConfig.PrivateKey)
-	if err != nil {
-		logr.Fatal("Unable to load server cert", err)
+	if listenURL.Scheme == "http" {
+		logr.Print("Serving plain HTTP, TLS must be terminated in front of the IdP")
+		return l
 	}
 	tlsListener := tls.NewListener(l, &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
+		GetCertificate: keyPair.GetCertificate,
+		// SPs resolving artifacts can authenticate with a client certificate.
+		ClientAuth: tls.RequestClientCert,
 	})
-	if err != nil {
-		logr.Fatal("Cannot create tls listener:", err)
-	}
 	return tlsListener
 }
 
-func addUsers(usersFilePath *string, store samlidp.Store) error {
-	usersFileContent, err := ioutil.ReadFile(*usersFilePath)
+// newAttributePolicies converts the attribute_policies in the config.
+func newAttributePolicies(idpConfig *config.Config) map[string]attributes.Policy {
+	policies := map[string]attributes.Policy{}
+	for entityID, attributePolicy := range idpConfig.AttributePolicies {
+		policy := attributes.Policy{Groups: attributePolicy.Groups}
+		for _, rule := range attributePolicy.Attributes {
+			policy.Rules = append(policy.Rules, attributes.Rule{
+				Source:       rule.Source,
+				Name:         rule.Name,
+				FriendlyName: rule.FriendlyName,
+				NameFormat:   rule.NameFormat,
+				Transforms:   rule.Transforms,
+			})
+		}
+		policies[entityID] = policy
+	}
+	return policies
+}
+
+// newNameIDMaker converts the nameid settings in the config. Persistent NameIDs can
+// only be configured for an SP when a salt is set.
+func newNameIDMaker(idpConfig *config.Config, store samlidp.Store) (nameid.AssertionMaker, error) {
+	salt, err := readNameIDSalt(idpConfig.NameID)
 	if err != nil {
-		return err
+		return nameid.AssertionMaker{}, err
+	}
+	formats := map[string]string{}
+	for entityID, format := range idpConfig.NameID.Formats {
+		formats[entityID], err = nameid.ParseFormat(format)
+		if err != nil {
+			return nameid.AssertionMaker{}, fmt.Errorf("%s: %s", entityID, err)
+		}
+		if formats[entityID] == nameid.PersistentFormat && len(salt) == 0 {
+			return nameid.AssertionMaker{}, fmt.Errorf("%s: persistent NameIDs need salt_env or salt_file", entityID)
+		}
 	}
-	usersToAdd := &[]samlidp.User{}
-	err = json.Unmarshal(usersFileContent, usersToAdd)
+	return nameid.AssertionMaker{Store: store, Formats: formats, Salt: salt}, nil
+}
+
+// backgroundTasks runs the goroutines that work in the background until shutdown, so
+// they can be stopped before the store is closed.
+type backgroundTasks struct {
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newBackgroundTasks() *backgroundTasks {
+	return &backgroundTasks{stop: make(chan struct{})}
+}
+
+// Go runs task in a goroutine. task must return once stop is closed.
+func (b *backgroundTasks) Go(task func(stop <-chan struct{})) {
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		task(b.stop)
+	}()
+}
+
+// Stop closes the stop channel of the tasks and waits for them to return.
+func (b *backgroundTasks) Stop() {
+	close(b.stop)
+	b.wg.Wait()
+}
+
+// sweepTransientIDs deletes the transient NameIDs of expired sessions every interval
+// until stop is closed.
+func sweepTransientIDs(store samlidp.Store, interval time.Duration, stop <-chan struct{}, logr *log.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := nameid.DeleteExpired(store); err != nil {
+				logr.Printf("ERROR: deleting expired transient NameIDs: %s", err)
+			}
+		}
+	}
+}
+
+func readNameIDSalt(nameIDConfig config.NameID) ([]byte, error) {
+	if nameIDConfig.SaltEnv != "" {
+		salt := os.Getenv(nameIDConfig.SaltEnv)
+		if salt == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", nameIDConfig.SaltEnv)
+		}
+		return []byte(salt), nil
+	}
+	if nameIDConfig.SaltFile != "" {
+		salt, err := ioutil.ReadFile(nameIDConfig.SaltFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(salt, "\r\n"), nil
+	}
+	return nil, nil
+}
+
+// newSPMetadataConfigurer builds the configurer storing the metadata of the SPs in
+// sp_metadata_urls, with the trust settings from sp_metadata_tls and sp_metadata_options.
+func newSPMetadataConfigurer(idpConfig *config.Config, store samlidp.Store, serviceIndex *service_providers.ServiceIndex, logr *log.Logger) (service_providers.SPMetadataConfigurerStore, error) {
+	metadataTLS := idpConfig.SPMetadataTLS
+	metadataTLSConfig, err := service_providers.NewMetadataTLSConfig(metadataTLS.CABundle, metadataTLS.ClientCertificate, metadataTLS.ClientPrivateKey, metadataTLS.InsecureSkipVerify)
 	if err != nil {
-		return err
+		return service_providers.SPMetadataConfigurerStore{}, fmt.Errorf("Cannot configure SP metadata TLS: %s", err)
+	}
+
+	signingCerts := map[string]*x509.Certificate{}
+	spTLSConfigs := map[string]*tls.Config{}
+	aggregates := map[string]service_providers.EntityFilter{}
+	for spName, spOptions := range idpConfig.SPMetadataOptions {
+		if spOptions.Aggregate {
+			aggregates[spName] = service_providers.EntityFilter{
+				IncludeEntityIDs: spOptions.IncludeEntityIDs,
+				ExcludeEntityIDs: spOptions.ExcludeEntityIDs,
+				EntityCategories: spOptions.EntityCategories,
+			}
+		}
+		if spOptions.SigningCertificate != "" {
+			signingCerts[spName], err = validateCert(spOptions.SigningCertificate)
+			if err != nil {
+				return service_providers.SPMetadataConfigurerStore{}, fmt.Errorf("Cannot validate metadata signing certificate for %s: %s", spName, err)
+			}
+		}
+		if spOptions.CABundle != "" {
+			spTLSConfigs[spName], err = service_providers.NewMetadataTLSConfig(spOptions.CABundle, metadataTLS.ClientCertificate, metadataTLS.ClientPrivateKey, metadataTLS.InsecureSkipVerify)
+			if err != nil {
+				return service_providers.SPMetadataConfigurerStore{}, fmt.Errorf("Cannot configure SP metadata TLS for %s: %s", spName, err)
+			}
+		}
+	}
+
+	return service_providers.SPMetadataConfigurerStore{
+		Store:               store,
+		SigningCertificates: signingCerts,
+		TLSConfig:           metadataTLSConfig,
+		SPTLSConfigs:        spTLSConfigs,
+		Clients:             &service_providers.MetadataClients{},
+		Aggregates:          aggregates,
+		Index:               serviceIndex,
+		Logger:              logr,
+	}, nil
+}
+
+func createStore(storeConfig config.Store) (samlidp.Store, error) {
+	switch storeConfig.Type {
+	case "", "memory":
+		return &samlidp.MemoryStore{}, nil
+	case "file":
+		if storeConfig.Path == "" {
+			return nil, errors.New("file store requires a path")
+		}
+		return idpstore.NewFileStore(storeConfig.Path)
+	case "sqlite":
+		if storeConfig.Path == "" {
+			return nil, errors.New("sqlite store requires a path")
+		}
+		return idpstore.NewSQLStore("sqlite3", storeConfig.Path)
+	case "postgres":
+		if storeConfig.DataSource == "" {
+			return nil, errors.New("postgres store requires a data_source")
+		}
+		return idpstore.NewSQLStore("postgres", storeConfig.DataSource)
+	default:
+		return nil, fmt.Errorf("unknown store type %q", storeConfig.Type)
 	}
-	for _, user := range *usersToAdd {
-		hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(*user.PlaintextPassword), bcrypt.DefaultCost)
-		user.HashedPassword = hashedPassword
-		user.PlaintextPassword = nil
-		err = store.Put("/users/"+user.Name, user)
+}
+
+func addUsers(users []idpusers.User, store samlidp.Store, bcryptCost int) error {
+	for _, user := range users {
+		if user.PlaintextPassword != nil {
+			hashedPassword, err := idpusers.HashPassword(*user.PlaintextPassword, bcryptCost)
+			if err != nil {
+				return err
+			}
+			user.HashedPassword = hashedPassword
+			user.PlaintextPassword = nil
+		}
+		err := store.Put("/users/"+user.Name, user)
 		if err != nil {
 			return err
 		}
@@ -163,15 +577,68 @@ func validateCert(certPath string) (*x509.Certificate, error) {
 	return x509.ParseCertificate(b.Bytes)
 }
 
-func validateKey(keyPath string) (crypto.PrivateKey, error) {
+func validateKey(keyPath string, passphrase []byte) (crypto.Signer, error) {
 	privateKey, err := ioutil.ReadFile(keyPath)
 	if err != nil {
 		return nil, err
 	}
 
-	b, _ := pem.Decode([]byte(privateKey))
-	if b == nil {
-		return nil, errors.New("no pem block found")
+	return signing.ParsePrivateKey(privateKey, passphrase)
+}
+
+// loadSigningKey loads a key pair, checking that the private key matches the certificate.
+func loadSigningKey(keyPair config.KeyPair) (crypto.Signer, *x509.Certificate, error) {
+	cert, err := validateCert(keyPair.Certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	passphrase, err := readKeyPassphrase(keyPair)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := validateKey(keyPair.PrivateKey, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, signing.CheckKeyMatchesCertificate(key, cert)
+}
+
+// loadSigningKeys loads the signing_keys, or just the signing key pair as the active
+// key when there are none.
+func loadSigningKeys(idpConfig *config.Config) ([]signing.Key, error) {
+	signingKeys := idpConfig.SigningKeys
+	if len(signingKeys) == 0 {
+		signingKeys = []config.SigningKey{{KeyPair: idpConfig.Signing, State: string(signing.KeyStateActive)}}
+	}
+
+	keys := []signing.Key{}
+	for _, signingKey := range signingKeys {
+		key, cert, err := loadSigningKey(signingKey.KeyPair)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", signingKey.Certificate, err)
+		}
+		keys = append(keys, signing.Key{State: signing.KeyState(signingKey.State), Signer: key, Certificate: cert})
+	}
+	return keys, nil
+}
+
+// readKeyPassphrase returns the passphrase of an encrypted private key, taken from the
+// environment variable named by private_key_passphrase_env or the file at
+// private_key_passphrase_file.
+func readKeyPassphrase(keyPair config.KeyPair) ([]byte, error) {
+	if keyPair.PrivateKeyPassphraseEnv != "" {
+		passphrase := os.Getenv(keyPair.PrivateKeyPassphraseEnv)
+		if passphrase == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", keyPair.PrivateKeyPassphraseEnv)
+		}
+		return []byte(passphrase), nil
+	}
+	if keyPair.PrivateKeyPassphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(keyPair.PrivateKeyPassphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(passphrase, "\r\n"), nil
 	}
-	return x509.ParsePKCS1PrivateKey(b.Bytes)
+	return nil, nil
 }
@@ -10,10 +10,25 @@ import (
 	"os"
 	"github.com/DennisDenuto/saml-idp/config"
 	"encoding/json"
+	"encoding/xml"
 	"io/ioutil"
 	"github.com/cznic/fileutil"
 	"github.com/crewjam/saml/samlidp"
 	"crypto/tls"
+	"syscall"
+	"encoding/pem"
+	"encoding/base64"
+	"path/filepath"
+	"crypto/x509"
+	"strings"
+	"time"
+	"net/url"
+	"net"
+	"github.com/crewjam/saml"
+	"github.com/beevik/etree"
+	"github.com/DennisDenuto/saml-idp/signing"
+	idpusers "github.com/DennisDenuto/saml-idp/users"
+	idpstore "github.com/DennisDenuto/saml-idp/store"
 )
 
 var _ = Describe("Main", func() {
@@ -21,6 +36,9 @@ var _ = Describe("Main", func() {
 	var session *gexec.Session
 	var serverStartMessage string
 	var idpAddress string
+	var listenAddress string
+	var generate *config.Generate
+	var wantAuthnRequestsSigned bool
 	var idpCertificate string
 	var idpKey string
 	var idpConfig *config.Config
@@ -28,20 +46,41 @@ var _ = Describe("Main", func() {
 	var usersTempFile *os.File
 	var idpCertificateFile *os.File
 	var idpPrivateKeyFile *os.File
+	var keyPassphrase string
+	var signingKeyPair *config.KeyPair
+	var signingKeys []config.SigningKey
+	var spMetadataURLs map[string]string
+	var storeConfig config.Store
+	var configTempFile *os.File
 
 	BeforeEach(func() {
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 		idpAddress = "https://localhost:9090"
+		listenAddress = ""
+		generate = nil
+		wantAuthnRequestsSigned = false
 		idpCertificate = string(LocalhostCert)
 		idpKey = string(LocalhostKey)
 		serverStartMessage = "Server Listening"
+		keyPassphrase = ""
+		signingKeyPair = nil
+		signingKeys = nil
+		spMetadataURLs = nil
+		storeConfig = config.Store{}
 	})
 
 	BeforeEach(func() {
 		var password = "some-password"
 
 		users = []samlidp.User{{
-			"Bob", &password, []byte(""), []string{"group1"}, "bob@email.com", "BOB", "Bobby", "Bobbie",
+			Name:              "Bob",
+			PlaintextPassword: &password,
+			HashedPassword:    []byte(""),
+			Groups:            []string{"group1"},
+			Email:             "bob@email.com",
+			CommonName:        "BOB",
+			Surname:           "Bobby",
+			GivenName:         "Bobbie",
 		}}
 
 		usersJson, err := json.Marshal(users)
@@ -85,20 +124,40 @@ var _ = Describe("Main", func() {
 			Certificate: idpCertificateFile.Name(),
 			PrivateKey:  idpPrivateKeyFile.Name(),
 		}
+		if signingKeyPair != nil {
+			idpConfig.Signing = *signingKeyPair
+		}
+		idpConfig.SigningKeys = signingKeys
+		idpConfig.ListenAddress = listenAddress
+		idpConfig.WantAuthnRequestsSigned = wantAuthnRequestsSigned
+		idpConfig.ServiceProviderMetadataURLs = spMetadataURLs
+		idpConfig.Store = storeConfig
+		if generate != nil {
+			idpConfig.Generate = *generate
+			os.Remove(idpCertificateFile.Name())
+			os.Remove(idpPrivateKeyFile.Name())
+		}
+		if keyPassphrase != "" {
+			passphraseFile, err := fileutil.TempFile(os.TempDir(), "passphrase", "test")
+			Expect(err).NotTo(HaveOccurred())
+			_, err = passphraseFile.WriteString(keyPassphrase + "\n")
+			Expect(err).NotTo(HaveOccurred())
+			idpConfig.PrivateKeyPassphraseFile = passphraseFile.Name()
+		}
 
 		jsonString, err := json.Marshal(idpConfig)
 		Expect(err).NotTo(HaveOccurred())
 
-		tempFile, err := fileutil.TempFile(os.TempDir(), "config", "idp")
+		configTempFile, err = fileutil.TempFile(os.TempDir(), "config", "idp")
 		Expect(err).NotTo(HaveOccurred())
-		err = ioutil.WriteFile(tempFile.Name(), jsonString, os.ModePerm)
+		err = ioutil.WriteFile(configTempFile.Name(), jsonString, os.ModePerm)
 		Expect(err).NotTo(HaveOccurred())
 
-		cmd = exec.Command(pathToServer, "-c", tempFile.Name(), "-users", usersTempFile.Name())
+		cmd = exec.Command(pathToServer, "-c", configTempFile.Name(), "-users", usersTempFile.Name())
 
 		session, err = gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
 		Expect(err).NotTo(HaveOccurred())
-		Eventually(session).Should(gbytes.Say(serverStartMessage))
+		Eventually(session).Should(gbytes.Say("%s", serverStartMessage))
 	})
 
 	AfterEach(func() {
@@ -119,9 +178,107 @@ var _ = Describe("Main", func() {
 		println(string(bytes))
 	})
 
+	It("should publish the single logout endpoint", func() {
+		response, err := http.Get("https://localhost:9090/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		metadata, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metadata)).To(ContainSubstring(`<SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://localhost:9090/slo">`))
+	})
+
+	It("should publish the ECP single sign on service", func() {
+		response, err := http.Get("https://localhost:9090/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		metadata, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metadata)).To(ContainSubstring(`<SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP" Location="https://localhost:9090/ecp">`))
+	})
+
+	It("should publish the attribute authority", func() {
+		response, err := http.Get("https://localhost:9090/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		metadata, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metadata)).To(ContainSubstring(`<AttributeAuthorityDescriptor`))
+		Expect(string(metadata)).To(ContainSubstring(`<AttributeService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP" Location="https://localhost:9090/attributes">`))
+	})
+
+	It("should publish the supported NameID formats", func() {
+		response, err := http.Get("https://localhost:9090/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		metadata, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metadata)).To(ContainSubstring(`<NameIDFormat>urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress</NameIDFormat>`))
+		Expect(string(metadata)).To(ContainSubstring(`<NameIDFormat>urn:oasis:names:tc:SAML:2.0:nameid-format:transient</NameIDFormat>`))
+	})
+
+	It("should publish the artifact resolution service", func() {
+		response, err := http.Get("https://localhost:9090/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		metadata, err := ioutil.ReadAll(response.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(metadata)).To(ContainSubstring(`<ArtifactResolutionService Binding="urn:oasis:names:tc:SAML:2.0:bindings:SOAP" Location="https://localhost:9090/artifact" index="0" isDefault="true">`))
+	})
+
 	It("should stop server gracefully when interrupt signal is given", func() {
 		session := session.Signal(os.Interrupt)
 		Eventually(session).Should(gbytes.Say("Stopping Server"))
+		Eventually(session).Should(gbytes.Say("Server Stopped"))
+		Eventually(session).Should(gexec.Exit(0))
+	})
+
+	It("should stop server gracefully when terminate signal is given", func() {
+		session := session.Signal(syscall.SIGTERM)
+		Eventually(session).Should(gbytes.Say("Stopping Server"))
+		Eventually(session).Should(gexec.Exit(0))
+	})
+
+	It("should stop server gracefully while a reload waits for SP metadata", func() {
+		hungListener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer hungListener.Close()
+		idpConfig.ServiceProviderMetadataURLs = map[string]string{"hung": "http://" + hungListener.Addr().String() + "/metadata"}
+		jsonString, err := json.Marshal(idpConfig)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(configTempFile.Name(), jsonString, os.ModePerm)).To(Succeed())
+
+		session.Signal(syscall.SIGHUP)
+		Eventually(session).Should(gbytes.Say("Trying hung metatadata url"))
+		session.Signal(syscall.SIGTERM)
+		Eventually(session).Should(gbytes.Say("Stopping Server"))
+		Eventually(session, 5*time.Second).Should(gexec.Exit(0))
+	})
+
+	It("should keep serving on other signals", func() {
+		session.Signal(syscall.SIGWINCH)
+		session.Signal(syscall.SIGCHLD)
+		Consistently(session).ShouldNot(gexec.Exit())
+
+		response, err := http.Get("https://localhost:9090/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(200))
+	})
+
+	It("should reload the users file on hangup signal", func() {
+		var password = "other-password"
+		usersJson, err := json.Marshal([]samlidp.User{{
+			Name:              "Alice",
+			PlaintextPassword: &password,
+			Email:             "alice@email.com",
+		}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ioutil.WriteFile(usersTempFile.Name(), usersJson, os.ModePerm)).To(Succeed())
+
+		session.Signal(syscall.SIGHUP)
+		Eventually(session).Should(gbytes.Say("Reloaded config: users added 1, updated 0, removed 1"))
+
+		response, err := http.Get("https://localhost:9090/users/Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(200))
+
+		response, err = http.Get("https://localhost:9090/users/Bob")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).NotTo(Equal(200))
 	})
 
 	It("should be loaded with users from users file", func() {
@@ -140,6 +297,219 @@ var _ = Describe("Main", func() {
 		Expect(storedUser.Email).To(Equal("bob@email.com"))
 	})
 
+	It("should keep the custom attributes of users put through the REST API", func() {
+		request, err := http.NewRequest("PUT", "https://localhost:9090/users/Carol", strings.NewReader(
+			`{"email": "carol@email.com", "attributes": {"department": ["Engineering"], "roles": ["reader", "writer"]}}`))
+		Expect(err).NotTo(HaveOccurred())
+		response, err := http.DefaultClient.Do(request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(204))
+
+		response, err = http.Get("https://localhost:9090/users/Carol")
+		Expect(err).NotTo(HaveOccurred())
+		storedUser := &idpusers.User{}
+		Expect(json.NewDecoder(response.Body).Decode(storedUser)).To(Succeed())
+		Expect(storedUser.Email).To(Equal("carol@email.com"))
+		Expect(storedUser.Attributes).To(Equal(map[string][]string{
+			"department": {"Engineering"},
+			"roles":      {"reader", "writer"},
+		}))
+	})
+
+	It("should load the custom attributes of users from the users file", func() {
+		Expect(ioutil.WriteFile(usersTempFile.Name(), []byte(
+			`[{"name": "Bob", "password": "some-password", "attributes": {"employee_id": ["1234"]}}]`), os.ModePerm)).To(Succeed())
+		session.Signal(syscall.SIGHUP)
+		Eventually(session).Should(gbytes.Say("Reloaded config: users added 0, updated 1, removed 0"))
+
+		response, err := http.Get("https://localhost:9090/users/Bob")
+		Expect(err).NotTo(HaveOccurred())
+		storedUser := &idpusers.User{}
+		Expect(json.NewDecoder(response.Body).Decode(storedUser)).To(Succeed())
+		Expect(storedUser.Attributes).To(Equal(map[string][]string{"employee_id": {"1234"}}))
+	})
+
+	It("should log in users whose hashed password is in the users file", func() {
+		Expect(ioutil.WriteFile(usersTempFile.Name(), []byte(
+			`[{"name": "Bob", "hashed_password": "$2a$04$K47r.anKVjm0RJhWJRhHQeepuslUgGu2HJ0JF/9QIYKfFXQCHi5hW"}]`), os.ModePerm)).To(Succeed())
+		session.Signal(syscall.SIGHUP)
+		Eventually(session).Should(gbytes.Say("Reloaded config: users added 0, updated 1, removed 0"))
+
+		response, err := http.PostForm("https://localhost:9090/login", url.Values{"user": {"Bob"}, "password": {"secret"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(response.StatusCode).To(Equal(200))
+		loggedIn := &saml.Session{}
+		Expect(json.NewDecoder(response.Body).Decode(loggedIn)).To(Succeed())
+		Expect(loggedIn.UserName).To(Equal("Bob"))
+	})
+
+	Context("Given a service provider with local metadata", func() {
+		BeforeEach(func() {
+			metadataPath, err := filepath.Abs("service_providers/fixtures/saml-sp.xml")
+			Expect(err).NotTo(HaveOccurred())
+			spMetadataURLs = map[string]string{"sp": "file://" + metadataPath}
+		})
+
+		It("should only count the services that changed on reload", func() {
+			session.Signal(syscall.SIGHUP)
+			Eventually(session).Should(gbytes.Say("services added 0, updated 0, removed 0"))
+		})
+	})
+
+	Context("Given a file store left with users and services by an earlier run", func() {
+		var storeDir string
+
+		BeforeEach(func() {
+			var err error
+			storeDir, err = ioutil.TempDir("", "store")
+			Expect(err).NotTo(HaveOccurred())
+			store, err := idpstore.NewFileStore(storeDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.Put("/users/Mallory", samlidp.User{Name: "Mallory"})).To(Succeed())
+			Expect(store.Put("/services/removed-sp", samlidp.Service{Name: "removed-sp"})).To(Succeed())
+			storeConfig = config.Store{Type: "file", Path: storeDir}
+
+			metadataPath, err := filepath.Abs("service_providers/fixtures/saml-sp.xml")
+			Expect(err).NotTo(HaveOccurred())
+			spMetadataURLs = map[string]string{"sp": "file://" + metadataPath}
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(storeDir)
+		})
+
+		It("should delete the users and services that are no longer configured", func() {
+			for path, stored := range map[string]bool{
+				"/users/Bob":           true,
+				"/users/Mallory":       false,
+				"/services/sp":         true,
+				"/services/removed-sp": false,
+			} {
+				response, err := http.Get("https://localhost:9090" + path)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(response.StatusCode == 200).To(Equal(stored), path)
+			}
+		})
+	})
+
+	Context("Given a plain HTTP listen address behind a proxy", func() {
+		BeforeEach(func() {
+			idpAddress = "https://idp.example.com"
+			listenAddress = "http://localhost:9091"
+		})
+
+		It("should serve plain HTTP and advertise the external address", func() {
+			response, err := http.Get("http://localhost:9091/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(200))
+			metadata, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(metadata)).To(ContainSubstring(`entityID="https://idp.example.com/metadata"`))
+			Expect(string(metadata)).To(ContainSubstring(`Location="https://idp.example.com/sso"`))
+		})
+	})
+
+	Context("Given key pair generation and no key pair files", func() {
+		BeforeEach(func() {
+			generate = &config.Generate{Enabled: true, KeyType: "ec"}
+		})
+
+		It("should generate a self-signed key pair and start", func() {
+			response, err := http.Get("https://localhost:9090/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(200))
+			Expect(response.TLS.PeerCertificates[0].Subject.CommonName).To(Equal("localhost"))
+			Expect(response.TLS.PeerCertificates[0].DNSNames).To(Equal([]string{"localhost"}))
+
+			keyPEM, err := ioutil.ReadFile(idpPrivateKeyFile.Name())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(keyPEM)).To(ContainSubstring("BEGIN PRIVATE KEY"))
+		})
+	})
+
+	Context("Given signed AuthnRequests are wanted", func() {
+		var authnRequest *saml.AuthnRequest
+
+		BeforeEach(func() {
+			wantAuthnRequestsSigned = true
+		})
+
+		JustBeforeEach(func() {
+			spCert, err := ioutil.ReadFile("signing/fixtures/rsa.crt")
+			Expect(err).NotTo(HaveOccurred())
+			spCertBlock, _ := pem.Decode(spCert)
+			spMetadata := `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/metadata">` +
+				`<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol" AuthnRequestsSigned="true">` +
+				`<KeyDescriptor use="signing"><KeyInfo xmlns="http://www.w3.org/2000/09/xmldsig#"><X509Data><X509Certificate>` +
+				base64.StdEncoding.EncodeToString(spCertBlock.Bytes) +
+				`</X509Certificate></X509Data></KeyInfo></KeyDescriptor>` +
+				`<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp.example.com/acs" index="1"></AssertionConsumerService>` +
+				`</SPSSODescriptor></EntityDescriptor>`
+			request, err := http.NewRequest("PUT", "https://localhost:9090/services/sp", strings.NewReader(spMetadata))
+			Expect(err).NotTo(HaveOccurred())
+			response, err := http.DefaultClient.Do(request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(http.StatusNoContent))
+
+			authnRequest = &saml.AuthnRequest{
+				ID:                          "id-request",
+				Version:                     "2.0",
+				IssueInstant:                time.Now().UTC(),
+				Destination:                 "https://localhost:9090/sso",
+				Issuer:                      &saml.Issuer{Value: "https://sp.example.com/metadata"},
+				AssertionConsumerServiceURL: "https://sp.example.com/acs",
+			}
+		})
+
+		postAuthnRequest := func(authnRequest *saml.AuthnRequest) *http.Response {
+			doc := etree.NewDocument()
+			doc.SetRoot(authnRequest.Element())
+			requestXML, err := doc.WriteToBytes()
+			Expect(err).NotTo(HaveOccurred())
+
+			response, err := http.PostForm("https://localhost:9090/sso", url.Values{
+				"SAMLRequest": {base64.StdEncoding.EncodeToString(requestXML)},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return response
+		}
+
+		It("should advertise it in the metadata", func() {
+			response, err := http.Get("https://localhost:9090/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			metadata, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(metadata)).To(ContainSubstring(`WantAuthnRequestsSigned="true"`))
+		})
+
+		It("should accept a request signed by the SP", func() {
+			spKeyPEM, err := ioutil.ReadFile("signing/fixtures/rsa-pkcs1.key")
+			Expect(err).NotTo(HaveOccurred())
+			spKey, err := signing.ParsePrivateKey(spKeyPEM, nil)
+			Expect(err).NotTo(HaveOccurred())
+			spCertPEM, err := ioutil.ReadFile("signing/fixtures/rsa.crt")
+			Expect(err).NotTo(HaveOccurred())
+			spCertBlock, _ := pem.Decode(spCertPEM)
+			spCert, err := x509.ParseCertificate(spCertBlock.Bytes)
+			Expect(err).NotTo(HaveOccurred())
+
+			authnRequest.Signature, err = signing.Signer{Key: spKey, Certificate: spCert}.Sign(authnRequest.Element())
+			Expect(err).NotTo(HaveOccurred())
+
+			response := postAuthnRequest(authnRequest)
+			Expect(response.StatusCode).To(Equal(200))
+			loginForm, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(loginForm)).To(ContainSubstring(`name="password"`))
+		})
+
+		It("should reject an unsigned request", func() {
+			response := postAuthnRequest(authnRequest)
+			Expect(response.StatusCode).To(Equal(http.StatusBadRequest))
+			Eventually(session).Should(gbytes.Say("rejecting AuthnRequest"))
+		})
+	})
+
 	Context("Given invalid listen address", func() {
 		BeforeEach(func() {
 			idpAddress = "httasd://invalidurl"
@@ -152,6 +522,19 @@ var _ = Describe("Main", func() {
 		})
 	})
 
+	Context("Given a users file with an invalid user", func() {
+		BeforeEach(func() {
+			Expect(ioutil.WriteFile(usersTempFile.Name(), []byte(
+				"[\n  {\"name\": \"Alice\", \"password\": \"secret\"},\n  {\"name\": \"Bob\"}\n]"), os.ModePerm)).To(Succeed())
+			serverStartMessage = "line 3: user Bob has no password"
+		})
+
+		It("should fail with an error message", func() {
+			Eventually(session).Should(gexec.Exit())
+			Eventually(session).ShouldNot(gexec.Exit(0))
+		})
+	})
+
 	Context("Given invalid certs", func() {
 		BeforeEach(func() {
 			idpCertificate = "not-a-cert"
@@ -164,6 +547,117 @@ var _ = Describe("Main", func() {
 		})
 	})
 
+	Context("Given a passphrase protected EC key", func() {
+		BeforeEach(func() {
+			ecCert, err := ioutil.ReadFile("signing/fixtures/ec.crt")
+			Expect(err).NotTo(HaveOccurred())
+			ecKey, err := ioutil.ReadFile("signing/fixtures/ec-pkcs8-encrypted.key")
+			Expect(err).NotTo(HaveOccurred())
+			idpCertificate = string(ecCert)
+			idpKey = string(ecKey)
+			keyPassphrase = "passphrase"
+		})
+
+		It("should serve metadata", func() {
+			response, err := http.Get("https://localhost:9090/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(200))
+		})
+	})
+
+	Context("Given a separate signing key pair", func() {
+		BeforeEach(func() {
+			signingKeyPair = &config.KeyPair{
+				Certificate: "signing/fixtures/ec.crt",
+				PrivateKey:  "signing/fixtures/ec-sec1.key",
+			}
+		})
+
+		It("should serve the TLS certificate and publish the signing certificate", func() {
+			response, err := http.Get("https://localhost:9090/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(200))
+
+			tlsCert, err := tls.X509KeyPair(LocalhostCert, LocalhostKey)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.TLS.PeerCertificates[0].Raw).To(Equal(tlsCert.Certificate[0]))
+
+			signingCertPEM, err := ioutil.ReadFile("signing/fixtures/ec.crt")
+			Expect(err).NotTo(HaveOccurred())
+			signingCert, _ := pem.Decode(signingCertPEM)
+			metadata, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(metadata)).To(ContainSubstring(base64.StdEncoding.EncodeToString(signingCert.Bytes)))
+		})
+	})
+
+	Context("Given signing keys for a rollover", func() {
+		BeforeEach(func() {
+			signingKeys = []config.SigningKey{
+				{KeyPair: config.KeyPair{Certificate: "signing/fixtures/rsa.crt", PrivateKey: "signing/fixtures/rsa-pkcs1.key"}, State: "active"},
+				{KeyPair: config.KeyPair{Certificate: "signing/fixtures/ec.crt", PrivateKey: "signing/fixtures/ec-sec1.key"}, State: "next"},
+			}
+		})
+
+		It("should publish every signing certificate", func() {
+			response, err := http.Get("https://localhost:9090/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.StatusCode).To(Equal(200))
+			metadata, err := ioutil.ReadAll(response.Body)
+			Expect(err).NotTo(HaveOccurred())
+
+			for _, certFile := range []string{"signing/fixtures/rsa.crt", "signing/fixtures/ec.crt"} {
+				certPEM, err := ioutil.ReadFile(certFile)
+				Expect(err).NotTo(HaveOccurred())
+				cert, _ := pem.Decode(certPEM)
+				Expect(string(metadata)).To(ContainSubstring(base64.StdEncoding.EncodeToString(cert.Bytes)))
+			}
+		})
+
+		It("should promote the next key on SIGUSR1", func() {
+			session.Signal(syscall.SIGUSR1)
+			Eventually(session).Should(gbytes.Say("Promoted signing key"))
+
+			session.Signal(syscall.SIGUSR1)
+			Eventually(session).Should(gbytes.Say("cannot promote signing key: there is no next signing key to promote"))
+		})
+
+		It("should keep publishing the RSA key IDP decrypts with for encryption after promotion", func() {
+			session.Signal(syscall.SIGUSR1)
+			Eventually(session).Should(gbytes.Say("Promoted signing key"))
+
+			response, err := http.Get("https://localhost:9090/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			metadata := &saml.EntityDescriptor{}
+			Expect(xml.NewDecoder(response.Body).Decode(metadata)).To(Succeed())
+			rsaCertPEM, err := ioutil.ReadFile("signing/fixtures/rsa.crt")
+			Expect(err).NotTo(HaveOccurred())
+			rsaCert, _ := pem.Decode(rsaCertPEM)
+
+			encryptionCertificates := []string{}
+			for _, keyDescriptor := range metadata.IDPSSODescriptors[0].KeyDescriptors {
+				if keyDescriptor.Use == "encryption" {
+					encryptionCertificates = append(encryptionCertificates, keyDescriptor.KeyInfo.Certificate)
+				}
+			}
+			Expect(encryptionCertificates).To(Equal([]string{base64.StdEncoding.EncodeToString(rsaCert.Bytes)}))
+		})
+	})
+
+	Context("Given a key that does not match the certificate", func() {
+		BeforeEach(func() {
+			ecKey, err := ioutil.ReadFile("signing/fixtures/ec-sec1.key")
+			Expect(err).NotTo(HaveOccurred())
+			idpKey = string(ecKey)
+			serverStartMessage = "Cannot validate private key:private key does not match the certificate"
+		})
+
+		It("should fail with an error message", func() {
+			Eventually(session).Should(gexec.Exit())
+			Eventually(session).ShouldNot(gexec.Exit(0))
+		})
+	})
+
 	Context("Given invalid key", func() {
 		BeforeEach(func() {
 			idpKey = "not-a-key"
@@ -176,3 +670,45 @@ var _ = Describe("Main", func() {
 		})
 	})
 })
+
+var _ = Describe("generate", func() {
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "generate")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("should write a key pair and exit", func() {
+		certPath := filepath.Join(tempDir, "idp.crt")
+		keyPath := filepath.Join(tempDir, "idp.key")
+		cmd := exec.Command(pathToServer, "generate", "-cert", certPath, "-key", keyPath, "-cn", "idp.example.com", "-sans", "idp.example.com,127.0.0.1")
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gexec.Exit(0))
+
+		keyPair, err := tls.LoadX509KeyPair(certPath, keyPath)
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := x509.ParseCertificate(keyPair.Certificate[0])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.Subject.CommonName).To(Equal("idp.example.com"))
+		Expect(cert.DNSNames).To(Equal([]string{"idp.example.com"}))
+		Expect(cert.IPAddresses).To(HaveLen(1))
+	})
+
+	It("should refuse to replace just one of the files", func() {
+		certPath := filepath.Join(tempDir, "idp.crt")
+		Expect(ioutil.WriteFile(certPath, LocalhostCert, 0644)).To(Succeed())
+
+		cmd := exec.Command(pathToServer, "generate", "-cert", certPath, "-key", filepath.Join(tempDir, "idp.key"))
+		session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(session).Should(gbytes.Say("only one of them exists"))
+		Eventually(session).Should(gexec.Exit(1))
+	})
+})
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+
+	"github.com/DennisDenuto/saml-idp/artifact"
+	"github.com/DennisDenuto/saml-idp/attributes"
+	"github.com/DennisDenuto/saml-idp/signing"
+	"github.com/DennisDenuto/saml-idp/soap"
+	"github.com/crewjam/saml"
+)
+
+// metadataHandler serves the IdP metadata with a KeyDescriptor for every signing key,
+// so SPs trust the next key before it is promoted and the retired key until they
+// have picked up the active one. The saml package only publishes IDP.Certificate.
+type metadataHandler struct {
+	idp                     *saml.IdentityProvider
+	keys                    *signing.KeyRing
+	wantAuthnRequestsSigned bool
+	sloURL                  url.URL
+	artifactResolutionURL   url.URL
+	ecpURL                  url.URL
+	attributeServiceURL     url.URL
+	nameIDFormats           []saml.NameIDFormat
+}
+
+func (h metadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metadata := h.idp.Metadata()
+	for i := range metadata.IDPSSODescriptors {
+		metadata.IDPSSODescriptors[i].KeyDescriptors = h.keyDescriptors()
+		metadata.IDPSSODescriptors[i].NameIDFormats = h.nameIDFormats
+		metadata.IDPSSODescriptors[i].SingleLogoutServices = []saml.Endpoint{
+			{Binding: saml.HTTPRedirectBinding, Location: h.sloURL.String()},
+			{Binding: saml.HTTPPostBinding, Location: h.sloURL.String()},
+		}
+		metadata.IDPSSODescriptors[i].SingleSignOnServices = append(metadata.IDPSSODescriptors[i].SingleSignOnServices,
+			saml.Endpoint{Binding: soap.Binding, Location: h.ecpURL.String()})
+		isDefault := true
+		metadata.IDPSSODescriptors[i].ArtifactResolutionServices = []saml.IndexedEndpoint{
+			{Binding: soap.Binding, Location: h.artifactResolutionURL.String(), Index: artifact.ResolutionServiceIndex, IsDefault: &isDefault},
+		}
+		if h.wantAuthnRequestsSigned {
+			wantAuthnRequestsSigned := true
+			metadata.IDPSSODescriptors[i].WantAuthnRequestsSigned = &wantAuthnRequestsSigned
+		}
+	}
+
+	metadata.AttributeAuthorityDescriptors = []saml.AttributeAuthorityDescriptor{{
+		RoleDescriptor: saml.RoleDescriptor{
+			ValidUntil:                 metadata.ValidUntil,
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			KeyDescriptors:             h.keyDescriptors(),
+		},
+		AttributeServices: []saml.Endpoint{{Binding: soap.Binding, Location: h.attributeServiceURL.String()}},
+		NameIDFormats:     h.nameIDFormats,
+		Attributes:        attributes.Supported(),
+	}}
+
+	buf, err := xml.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(buf)
+}
+
+// keyDescriptors returns the signing KeyDescriptors of the key ring and the encryption
+// KeyDescriptor of the key the IdP decrypts with.
+func (h metadataHandler) keyDescriptors() []saml.KeyDescriptor {
+	return append(h.keys.KeyDescriptors(), signing.EncryptionKeyDescriptors(h.idp.Key, h.idp.Certificate)...)
+}
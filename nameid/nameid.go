@@ -0,0 +1,255 @@
+package nameid
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+const (
+	UnspecifiedFormat  = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	EmailAddressFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	PersistentFormat   = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	TransientFormat    = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+var formats = map[string]string{
+	"unspecified":  UnspecifiedFormat,
+	"emailAddress": EmailAddressFormat,
+	"persistent":   PersistentFormat,
+	"transient":    TransientFormat,
+}
+
+// ParseFormat returns the URN of the NameID format given by its short name
+// (unspecified, emailAddress, persistent or transient) or URN.
+func ParseFormat(format string) (string, error) {
+	if urn, ok := formats[format]; ok {
+		return urn, nil
+	}
+	for _, urn := range formats {
+		if format == urn {
+			return urn, nil
+		}
+	}
+	return "", errors.Errorf("unknown NameID format %q", format)
+}
+
+// identifier is stored under /persistent_ids/<value> or /transient_ids/<value>, so a
+// NameID an SP sends back can be resolved to the user it was issued for.
+type identifier struct {
+	ServiceProvider string
+	UserName        string
+	Expires         time.Time
+}
+
+func persistentKey(value string) string {
+	return fmt.Sprintf("/persistent_ids/%s", value)
+}
+
+func transientKey(value string) string {
+	return fmt.Sprintf("/transient_ids/%s", value)
+}
+
+// AssertionMaker makes assertions with the wrapped saml.AssertionMaker, or
+// saml.DefaultAssertionMaker when it is nil, and replaces their NameID with one in the
+// format Formats configures for the SP, or else the one its NameIDPolicy asks for, or
+// else the first supported one its metadata lists, falling back to unspecified, which
+// is the user name. Persistent NameIDs are only supported when Salt is set.
+type AssertionMaker struct {
+	saml.AssertionMaker
+	Store   samlidp.Store
+	Formats map[string]string
+	Salt    []byte
+}
+
+func (m AssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	assertionMaker := m.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+	if req.Assertion == nil || req.Assertion.Subject == nil || req.Assertion.Subject.NameID == nil {
+		return nil
+	}
+
+	format, err := m.format(req)
+	if err != nil {
+		return err
+	}
+	value, err := m.value(format, req.ServiceProviderMetadata.EntityID, session)
+	if err != nil {
+		return err
+	}
+	req.Assertion.Subject.NameID.Format = format
+	req.Assertion.Subject.NameID.Value = value
+	return nil
+}
+
+// SupportedFormats lists the NameID formats to publish in the IdP metadata.
+func (m AssertionMaker) SupportedFormats() []saml.NameIDFormat {
+	supported := []saml.NameIDFormat{UnspecifiedFormat, EmailAddressFormat, TransientFormat}
+	if len(m.Salt) > 0 {
+		supported = append(supported, PersistentFormat)
+	}
+	return supported
+}
+
+func (m AssertionMaker) supports(format string) bool {
+	for _, supported := range m.SupportedFormats() {
+		if string(supported) == format {
+			return true
+		}
+	}
+	return false
+}
+
+func (m AssertionMaker) format(req *saml.IdpAuthnRequest) (string, error) {
+	entityID := req.ServiceProviderMetadata.EntityID
+	if format, ok := m.Formats[entityID]; ok {
+		return format, nil
+	}
+	if policy := req.Request.NameIDPolicy; policy != nil && policy.Format != nil && *policy.Format != UnspecifiedFormat {
+		if !m.supports(*policy.Format) {
+			return "", errors.Errorf("%s asked for the unsupported NameID format %s", entityID, *policy.Format)
+		}
+		return *policy.Format, nil
+	}
+	for _, descriptor := range req.ServiceProviderMetadata.SPSSODescriptors {
+		for _, format := range descriptor.NameIDFormats {
+			if m.supports(string(format)) {
+				return string(format), nil
+			}
+		}
+	}
+	return UnspecifiedFormat, nil
+}
+
+func (m AssertionMaker) value(format string, entityID string, session *saml.Session) (string, error) {
+	switch format {
+	case EmailAddressFormat:
+		if session.UserEmail == "" {
+			return "", errors.Errorf("user %s has no email address", session.UserName)
+		}
+		return session.UserEmail, nil
+	case PersistentFormat:
+		return m.persistentID(entityID, session.UserName)
+	case TransientFormat:
+		return m.transientID(entityID, session)
+	default:
+		return session.NameID, nil
+	}
+}
+
+// persistentID derives the pairwise identifier of the user for the SP from Salt, so
+// it is opaque, stable and different for every SP, and stores it for resolution.
+func (m AssertionMaker) persistentID(entityID string, userName string) (string, error) {
+	if len(m.Salt) == 0 {
+		return "", errors.New("persistent NameIDs need a salt")
+	}
+	mac := hmac.New(sha256.New, m.Salt)
+	mac.Write([]byte(entityID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(userName))
+	value := base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	err := m.Store.Get(persistentKey(value), &identifier{})
+	if err == samlidp.ErrNotFound {
+		return value, m.Store.Put(persistentKey(value), &identifier{ServiceProvider: entityID, UserName: userName})
+	}
+	return value, err
+}
+
+// transientID returns a random identifier that can be resolved until the session expires.
+func (m AssertionMaker) transientID(entityID string, session *saml.Session) (string, error) {
+	value := base64.RawURLEncoding.EncodeToString(randomBytes(20))
+	err := m.Store.Put(transientKey(value), &identifier{
+		ServiceProvider: entityID,
+		UserName:        session.UserName,
+		Expires:         session.ExpireTime,
+	})
+	return value, err
+}
+
+// DeleteExpired deletes the transient identifiers of expired sessions. It is meant to
+// run periodically, off the SSO request path.
+func DeleteExpired(store samlidp.Store) error {
+	values, err := store.List(transientKey(""))
+	if err != nil {
+		return err
+	}
+	now := saml.TimeNow()
+	for _, value := range values {
+		issued := identifier{}
+		if err := store.Get(transientKey(value), &issued); err != nil {
+			continue
+		}
+		if now.After(issued.Expires) {
+			if err := store.Delete(transientKey(value)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UserName returns the name of the user the NameID the SP entityID sent refers to, or
+// samlidp.ErrNotFound when there is no such user. Persistent and transient NameIDs
+// only resolve for the SP they were issued to. An expired transient NameID is deleted.
+func UserName(store samlidp.Store, nameID *saml.NameID, entityID string) (string, error) {
+	switch nameID.Format {
+	case PersistentFormat, TransientFormat:
+		key := persistentKey(nameID.Value)
+		if nameID.Format == TransientFormat {
+			key = transientKey(nameID.Value)
+		}
+		issued := identifier{}
+		if err := store.Get(key, &issued); err != nil {
+			return "", err
+		}
+		if issued.ServiceProvider != entityID {
+			return "", samlidp.ErrNotFound
+		}
+		if nameID.Format == TransientFormat && saml.TimeNow().After(issued.Expires) {
+			if err := store.Delete(key); err != nil {
+				return "", err
+			}
+			return "", samlidp.ErrNotFound
+		}
+		return issued.UserName, nil
+	case EmailAddressFormat:
+		userNames, err := store.List("/users/")
+		if err != nil {
+			return "", err
+		}
+		for _, userName := range userNames {
+			user := samlidp.User{}
+			if err := store.Get(fmt.Sprintf("/users/%s", userName), &user); err != nil {
+				continue
+			}
+			if user.Email != "" && strings.EqualFold(user.Email, nameID.Value) {
+				return user.Name, nil
+			}
+		}
+		return "", samlidp.ErrNotFound
+	default:
+		return nameID.Value, nil
+	}
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
@@ -0,0 +1,13 @@
+package nameid_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestNameid(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Nameid Suite")
+}
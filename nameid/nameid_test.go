@@ -0,0 +1,178 @@
+package nameid_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/nameid"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net/http/httptest"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("AssertionMaker", func() {
+	var store *samlidp.MemoryStore
+	var assertionMaker AssertionMaker
+	var serviceProvider *saml.EntityDescriptor
+	var request saml.AuthnRequest
+
+	makeNameID := func() *saml.NameID {
+		req := &saml.IdpAuthnRequest{
+			HTTPRequest:             httptest.NewRequest("GET", "https://idp.example.com/sso", nil),
+			Request:                 request,
+			ServiceProviderMetadata: serviceProvider,
+		}
+		session := &saml.Session{
+			NameID:     "bob",
+			UserName:   "bob",
+			UserEmail:  "bob@example.com",
+			ExpireTime: saml.TimeNow().Add(time.Hour),
+		}
+		Expect(assertionMaker.MakeAssertion(req, session)).To(Succeed())
+		return req.Assertion.Subject.NameID
+	}
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		Expect(store.Put("/users/bob", samlidp.User{Name: "bob", Email: "Bob@Example.com"})).To(Succeed())
+		assertionMaker = AssertionMaker{AssertionMaker: stubAssertionMaker{}, Store: store, Salt: []byte("salt")}
+		serviceProvider = &saml.EntityDescriptor{EntityID: "https://sp.example.com"}
+		request = saml.AuthnRequest{}
+	})
+
+	It("should use the user name when nothing asks for a format", func() {
+		nameID := makeNameID()
+		Expect(nameID.Format).To(Equal(UnspecifiedFormat))
+		Expect(nameID.Value).To(Equal("bob"))
+	})
+
+	It("should use the format the NameIDPolicy asks for", func() {
+		format := EmailAddressFormat
+		request.NameIDPolicy = &saml.NameIDPolicy{Format: &format}
+		nameID := makeNameID()
+		Expect(nameID.Format).To(Equal(EmailAddressFormat))
+		Expect(nameID.Value).To(Equal("bob@example.com"))
+	})
+
+	It("should refuse a format it does not support", func() {
+		format := "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName"
+		request.NameIDPolicy = &saml.NameIDPolicy{Format: &format}
+		req := &saml.IdpAuthnRequest{
+			HTTPRequest:             httptest.NewRequest("GET", "https://idp.example.com/sso", nil),
+			Request:                 request,
+			ServiceProviderMetadata: serviceProvider,
+		}
+		Expect(assertionMaker.MakeAssertion(req, &saml.Session{UserName: "bob"})).To(MatchError(
+			"https://sp.example.com asked for the unsupported NameID format urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName"))
+	})
+
+	It("should prefer the configured format over the metadata", func() {
+		serviceProvider.SPSSODescriptors = []saml.SPSSODescriptor{{SSODescriptor: saml.SSODescriptor{
+			NameIDFormats: []saml.NameIDFormat{EmailAddressFormat},
+		}}}
+		Expect(makeNameID().Format).To(Equal(EmailAddressFormat))
+
+		assertionMaker.Formats = map[string]string{"https://sp.example.com": TransientFormat}
+		Expect(makeNameID().Format).To(Equal(TransientFormat))
+	})
+
+	Context("with persistent NameIDs", func() {
+		BeforeEach(func() {
+			assertionMaker.Formats = map[string]string{
+				"https://sp.example.com":    PersistentFormat,
+				"https://other.example.com": PersistentFormat,
+			}
+		})
+
+		It("should issue a stable opaque identifier per SP", func() {
+			nameID := makeNameID()
+			Expect(nameID.Format).To(Equal(PersistentFormat))
+			Expect(nameID.Value).NotTo(ContainSubstring("bob"))
+			Expect(makeNameID().Value).To(Equal(nameID.Value))
+
+			serviceProvider = &saml.EntityDescriptor{EntityID: "https://other.example.com"}
+			Expect(makeNameID().Value).NotTo(Equal(nameID.Value))
+		})
+
+		It("should only resolve the identifier for the SP it was issued to", func() {
+			nameID := makeNameID()
+			Expect(UserName(store, nameID, "https://sp.example.com")).To(Equal("bob"))
+			_, err := UserName(store, nameID, "https://other.example.com")
+			Expect(err).To(Equal(samlidp.ErrNotFound))
+		})
+	})
+
+	Context("with transient NameIDs", func() {
+		BeforeEach(func() {
+			assertionMaker.Formats = map[string]string{"https://sp.example.com": TransientFormat}
+		})
+
+		AfterEach(func() {
+			saml.TimeNow = func() time.Time { return time.Now().UTC() }
+		})
+
+		It("should issue a random identifier that resolves until the session expires", func() {
+			nameID := makeNameID()
+			Expect(makeNameID().Value).NotTo(Equal(nameID.Value))
+			Expect(UserName(store, nameID, "https://sp.example.com")).To(Equal("bob"))
+
+			saml.TimeNow = func() time.Time { return time.Now().Add(2 * time.Hour) }
+			_, err := UserName(store, nameID, "https://sp.example.com")
+			Expect(err).To(Equal(samlidp.ErrNotFound))
+			Expect(store.Get("/transient_ids/"+nameID.Value, &struct{}{})).To(Equal(samlidp.ErrNotFound))
+		})
+
+		It("should leave deleting expired identifiers to DeleteExpired", func() {
+			expired := makeNameID()
+			saml.TimeNow = func() time.Time { return time.Now().Add(2 * time.Hour) }
+			current := makeNameID()
+			Expect(store.Get("/transient_ids/"+expired.Value, &struct{}{})).To(Succeed())
+
+			Expect(DeleteExpired(store)).To(Succeed())
+			Expect(store.Get("/transient_ids/"+expired.Value, &struct{}{})).To(Equal(samlidp.ErrNotFound))
+			Expect(UserName(store, current, "https://sp.example.com")).To(Equal("bob"))
+		})
+	})
+
+	It("should not support persistent NameIDs without a salt", func() {
+		assertionMaker.Salt = nil
+		Expect(assertionMaker.SupportedFormats()).NotTo(ContainElement(saml.NameIDFormat(PersistentFormat)))
+	})
+})
+
+var _ = Describe("UserName", func() {
+	var store *samlidp.MemoryStore
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		Expect(store.Put("/users/bob", samlidp.User{Name: "bob", Email: "Bob@Example.com"})).To(Succeed())
+	})
+
+	It("should find the user by email address", func() {
+		Expect(UserName(store, &saml.NameID{Format: EmailAddressFormat, Value: "bob@example.com"}, "https://sp.example.com")).To(Equal("bob"))
+		_, err := UserName(store, &saml.NameID{Format: EmailAddressFormat, Value: "alice@example.com"}, "https://sp.example.com")
+		Expect(err).To(Equal(samlidp.ErrNotFound))
+	})
+
+	It("should take other NameIDs to be the user name", func() {
+		Expect(UserName(store, &saml.NameID{Value: "bob"}, "https://sp.example.com")).To(Equal("bob"))
+	})
+})
+
+var _ = Describe("ParseFormat", func() {
+	It("should accept short names and URNs", func() {
+		Expect(ParseFormat("persistent")).To(Equal(PersistentFormat))
+		Expect(ParseFormat(EmailAddressFormat)).To(Equal(EmailAddressFormat))
+		_, err := ParseFormat("kerberos")
+		Expect(err).To(MatchError(`unknown NameID format "kerberos"`))
+	})
+})
+
+type stubAssertionMaker struct{}
+
+func (stubAssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	req.Assertion = &saml.Assertion{Subject: &saml.Subject{NameID: &saml.NameID{Value: session.NameID}}}
+	return nil
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ForwardedHeaders sets the scheme and host of request URLs, which the server leaves
+// empty, so handlers can tell how the client reached the IdP. Requests from one of
+// TrustedProxies take them from X-Forwarded-Proto and X-Forwarded-Host; from anywhere
+// else those headers are dropped.
+type ForwardedHeaders struct {
+	TrustedProxies []*net.IPNet
+	Handler        http.Handler
+}
+
+// ParseCIDRs parses the CIDRs of trusted proxies, accepting a bare IP as a single host.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %q", cidr)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (f ForwardedHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.URL.Scheme = "http"
+	if r.TLS != nil {
+		r.URL.Scheme = "https"
+	}
+	r.URL.Host = r.Host
+
+	if f.trusted(r.RemoteAddr) {
+		if proto := firstValue(r.Header.Get("X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			r.URL.Scheme = proto
+		}
+		if host := firstValue(r.Header.Get("X-Forwarded-Host")); host != "" {
+			r.Host = host
+			r.URL.Host = host
+		}
+	} else {
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+	}
+
+	f.Handler.ServeHTTP(w, r)
+}
+
+func (f ForwardedHeaders) trusted(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range f.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstValue returns the value added by the proxy closest to the client when proxies
+// are chained and each one appends to the header.
+func firstValue(header string) string {
+	return strings.TrimSpace(strings.Split(header, ",")[0])
+}
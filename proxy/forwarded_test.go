@@ -0,0 +1,88 @@
+package proxy_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/proxy"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+)
+
+var _ = Describe("ForwardedHeaders", func() {
+	var handler ForwardedHeaders
+	var request *http.Request
+	var served *http.Request
+
+	BeforeEach(func() {
+		trustedProxies, err := ParseCIDRs([]string{"10.0.0.0/8", "192.168.1.1"})
+		Expect(err).NotTo(HaveOccurred())
+		handler = ForwardedHeaders{
+			TrustedProxies: trustedProxies,
+			Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				served = r
+			}),
+		}
+
+		request = httptest.NewRequest("GET", "/metadata", nil)
+		request.Host = "idp.internal:8080"
+		request.Header.Set("X-Forwarded-Proto", "https")
+		request.Header.Set("X-Forwarded-Host", "idp.example.com, proxy.internal")
+	})
+
+	Context("when the request comes from a trusted proxy", func() {
+		BeforeEach(func() {
+			request.RemoteAddr = "10.1.2.3:4567"
+		})
+
+		It("should use the forwarded scheme and host", func() {
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(served.URL.Scheme).To(Equal("https"))
+			Expect(served.URL.Host).To(Equal("idp.example.com"))
+			Expect(served.Host).To(Equal("idp.example.com"))
+		})
+
+		It("should ignore an unknown forwarded scheme", func() {
+			request.Header.Set("X-Forwarded-Proto", "gopher")
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(served.URL.Scheme).To(Equal("http"))
+		})
+	})
+
+	Context("when the request comes from a trusted proxy IP", func() {
+		BeforeEach(func() {
+			request.RemoteAddr = "192.168.1.1:4567"
+		})
+
+		It("should use the forwarded scheme", func() {
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(served.URL.Scheme).To(Equal("https"))
+		})
+	})
+
+	Context("when the request does not come from a trusted proxy", func() {
+		BeforeEach(func() {
+			request.RemoteAddr = "192.168.1.2:4567"
+		})
+
+		It("should drop the forwarded headers", func() {
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(served.URL.Scheme).To(Equal("http"))
+			Expect(served.URL.Host).To(Equal("idp.internal:8080"))
+			Expect(served.Header.Get("X-Forwarded-Proto")).To(BeEmpty())
+			Expect(served.Header.Get("X-Forwarded-Host")).To(BeEmpty())
+		})
+
+		It("should use https for TLS connections", func() {
+			request.TLS = &tls.ConnectionState{}
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+			Expect(served.URL.Scheme).To(Equal("https"))
+		})
+	})
+
+	It("should reject an invalid CIDR", func() {
+		_, err := ParseCIDRs([]string{"10.0.0.0/33"})
+		Expect(err).To(MatchError(ContainSubstring(`invalid trusted proxy "10.0.0.0/33"`)))
+	})
+})
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/attributes"
+	"github.com/DennisDenuto/saml-idp/config"
+	"github.com/DennisDenuto/saml-idp/service_providers"
+	"github.com/DennisDenuto/saml-idp/signing"
+	idpusers "github.com/DennisDenuto/saml-idp/users"
+	"github.com/crewjam/saml/samlidp"
+)
+
+const defaultReloadInterval = 5 * time.Second
+
+// reloader applies the config and users files to the running IdP, at startup and
+// again on every SIGHUP. Only users and services it loaded itself are ever removed,
+// so users and services added through the REST API and all sessions are kept.
+type reloader struct {
+	configFile  string
+	usersFile   string
+	usersFormat string
+	store       samlidp.Store
+	index       *service_providers.ServiceIndex
+	tlsKeyPair  *tlsKeyPair
+	keyRing     *signing.KeyRing
+	policies    *attributes.Policies
+	logr        *log.Logger
+
+	config       *config.Config
+	users        map[string]idpusers.User
+	metadataURLs map[string]string
+
+	// mu guards stopRefresh and stopped, as Stop is called from the signal loop while
+	// a reload may be fetching metadata.
+	mu          sync.Mutex
+	stopRefresh chan struct{}
+	stopped     chan struct{}
+}
+
+type reloadSummary struct {
+	usersAdded, usersUpdated, usersRemoved          int
+	servicesAdded, servicesUpdated, servicesRemoved int
+}
+
+func (s reloadSummary) String() string {
+	return fmt.Sprintf("users added %d, updated %d, removed %d; services added %d, updated %d, removed %d",
+		s.usersAdded, s.usersUpdated, s.usersRemoved, s.servicesAdded, s.servicesUpdated, s.servicesRemoved)
+}
+
+// Reload re-reads the config and users files. A file that cannot be read leaves
+// the running configuration untouched.
+func (r *reloader) Reload() {
+	r.logr.Print("Reloading config")
+
+	configFileContents, err := ioutil.ReadFile(r.configFile)
+	if err != nil {
+		r.logr.Printf("ERROR: reload failed, cannot read config: %s", err)
+		return
+	}
+	idpConfig, err := config.NewConfig(configFileContents)
+	if err != nil {
+		r.logr.Printf("ERROR: reload failed, invalid config: %s", err)
+		return
+	}
+	if idpConfig.Address != r.config.Address || idpConfig.ListenAddress != r.config.ListenAddress ||
+		!reflect.DeepEqual(idpConfig.TrustedProxies, r.config.TrustedProxies) || !reflect.DeepEqual(idpConfig.Store, r.config.Store) ||
+		idpConfig.WantAuthnRequestsSigned != r.config.WantAuthnRequestsSigned || !reflect.DeepEqual(idpConfig.AttributeRelease, r.config.AttributeRelease) ||
+		!reflect.DeepEqual(idpConfig.NameID, r.config.NameID) || idpConfig.BcryptCost != r.config.BcryptCost {
+		r.logr.Print("WARNING: address, listen address, trusted proxies, store, want_authn_requests_signed, attribute_release, nameid and bcrypt_cost changes only take effect after a restart")
+	}
+
+	summary := reloadSummary{}
+	if err := r.tlsKeyPair.Load(idpConfig.TLS); err != nil {
+		r.logr.Printf("ERROR: keeping the current TLS certificate: %s", err)
+	}
+	if err := r.reloadSigningKeys(idpConfig); err != nil {
+		r.logr.Printf("ERROR: keeping the current signing keys: %s", err)
+	}
+	if err := r.policies.Set(newAttributePolicies(idpConfig)); err != nil {
+		r.logr.Printf("ERROR: keeping the current attribute policies: %s", err)
+	}
+	if err := r.syncUsers(&summary); err != nil {
+		r.logr.Printf("ERROR: keeping the current users: %s", err)
+	}
+	if err := r.syncServices(idpConfig, &summary); err != nil {
+		r.logr.Printf("ERROR: reloading services: %s", err)
+	}
+	r.config = idpConfig
+
+	r.logr.Printf("Reloaded config: %s", summary)
+}
+
+func (r *reloader) reloadSigningKeys(idpConfig *config.Config) error {
+	signingKeys, err := loadSigningKeys(idpConfig)
+	if err != nil {
+		return err
+	}
+	return r.keyRing.Set(signingKeys)
+}
+
+// PromoteSigningKey makes the next signing key active. The promotion only lasts until
+// the next reload, so the states in signing_keys need updating to match.
+func (r *reloader) PromoteSigningKey() {
+	if err := r.keyRing.Promote(); err != nil {
+		r.logr.Printf("ERROR: cannot promote signing key: %s", err)
+		return
+	}
+	r.logr.Printf("Promoted signing key %s, update the signing_keys states in the config to keep it active", r.keyRing.Active().Certificate.Subject)
+}
+
+// syncUsers stores the users in the users file that are new or changed since the last
+// load and deletes every stored user that is not in it, including ones left in a
+// persistent store by an earlier run.
+func (r *reloader) syncUsers(summary *reloadSummary) error {
+	users, err := idpusers.ReadFile(r.usersFile, r.usersFormat)
+	if err != nil {
+		return err
+	}
+
+	current := map[string]idpusers.User{}
+	changed := []idpusers.User{}
+	for _, user := range users {
+		current[user.Name] = user
+		previous, ok := r.users[user.Name]
+		switch {
+		case !ok:
+			summary.usersAdded++
+		case !reflect.DeepEqual(previous, user):
+			summary.usersUpdated++
+		default:
+			continue
+		}
+		changed = append(changed, user)
+	}
+
+	if err := addUsers(changed, r.store, r.config.BcryptCost); err != nil {
+		return err
+	}
+	stored, err := r.store.List("/users/")
+	if err != nil {
+		return err
+	}
+	for _, name := range stored {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		if err := r.store.Delete("/users/" + name); err != nil {
+			return err
+		}
+		summary.usersRemoved++
+	}
+
+	r.users = current
+	return nil
+}
+
+// syncServices deletes the services of SPs removed from sp_metadata_urls, fetches the
+// metadata of every configured SP again and restarts the refresher. Once every SP has
+// been fetched, stored services no configured SP provides, such as ones left in a
+// persistent store by an earlier run, are deleted too.
+func (r *reloader) syncServices(idpConfig *config.Config, summary *reloadSummary) error {
+	configurer, err := newSPMetadataConfigurer(idpConfig, r.store, r.index, r.logr)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.stopRefresh != nil {
+		close(r.stopRefresh)
+		r.stopRefresh = nil
+	}
+	stopped := r.stopChannel()
+	r.mu.Unlock()
+
+	for spName := range r.metadataURLs {
+		if _, ok := idpConfig.ServiceProviderMetadataURLs[spName]; ok {
+			continue
+		}
+		for _, name := range r.index.RemoveSource(spName) {
+			if err := r.store.Delete("/services/" + name); err != nil {
+				return err
+			}
+		}
+		summary.servicesRemoved++
+	}
+	for spName, metadataURL := range idpConfig.ServiceProviderMetadataURLs {
+		previousURL, ok := r.metadataURLs[spName]
+		switch {
+		case !ok:
+			summary.servicesAdded++
+		case previousURL != metadataURL || !reflect.DeepEqual(idpConfig.SPMetadataOptions[spName], r.config.SPMetadataOptions[spName]):
+			summary.servicesUpdated++
+		}
+	}
+	r.metadataURLs = idpConfig.ServiceProviderMetadataURLs
+
+	bootstrap := service_providers.SPBootstrap{
+		MetadataURLs:         idpConfig.ServiceProviderMetadataURLs,
+		Timeout:              3 * time.Minute,
+		BackOffDuration:      20 * time.Second,
+		SpMetadataConfigurer: configurer,
+		Logger:               r.logr,
+		Stop:                 stopped,
+	}
+	cacheInfos, err := bootstrap.Fetch()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-stopped:
+		return err
+	default:
+	}
+	if err == nil {
+		err = r.deleteUnsourcedServices(summary)
+	}
+	if idpConfig.SPMetadataRefresh.Enabled {
+		r.stopRefresh = make(chan struct{})
+		refresher := service_providers.SPMetadataRefresher{
+			MetadataURLs:         idpConfig.ServiceProviderMetadataURLs,
+			SpMetadataConfigurer: configurer,
+			CacheInfos:           cacheInfos,
+			Interval:             time.Duration(idpConfig.SPMetadataRefresh.Interval),
+			MinInterval:          time.Duration(idpConfig.SPMetadataRefresh.MinInterval),
+			MaxInterval:          time.Duration(idpConfig.SPMetadataRefresh.MaxInterval),
+			Logger:               r.logr,
+		}
+		go refresher.Run(r.stopRefresh)
+	}
+
+	return err
+}
+
+// deleteUnsourcedServices deletes the stored services that no configured SP provides.
+func (r *reloader) deleteUnsourcedServices(summary *reloadSummary) error {
+	stored, err := r.store.List("/services/")
+	if err != nil {
+		return err
+	}
+	for _, name := range stored {
+		if r.index.HasSource(name) {
+			continue
+		}
+		if err := r.store.Delete("/services/" + name); err != nil {
+			return err
+		}
+		summary.servicesRemoved++
+	}
+	return nil
+}
+
+// Stop stops the metadata refresher and makes a reload in progress stop waiting for
+// SP metadata.
+func (r *reloader) Stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	close(r.stopChannel())
+	if r.stopRefresh != nil {
+		close(r.stopRefresh)
+		r.stopRefresh = nil
+	}
+}
+
+// stopChannel returns the channel Stop closes. r.mu must be held.
+func (r *reloader) stopChannel() chan struct{} {
+	if r.stopped == nil {
+		r.stopped = make(chan struct{})
+	}
+	return r.stopped
+}
+
+// watchFiles polls the modification time and size of files every interval until stop
+// is closed, and sends on changed when any of them differs from the previous poll.
+func watchFiles(files []string, interval time.Duration, changed chan<- struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	previous := statFiles(files)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		current := statFiles(files)
+		if reflect.DeepEqual(previous, current) {
+			continue
+		}
+		previous = current
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func statFiles(files []string) []string {
+	stats := []string{}
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			stats = append(stats, "")
+			continue
+		}
+		stats = append(stats, fmt.Sprintf("%s %d", info.ModTime(), info.Size()))
+	}
+	return stats
+}
+
+// tlsKeyPair holds the certificate served by the TLS listener so it can be replaced
+// without closing the listener.
+type tlsKeyPair struct {
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+}
+
+func newTLSKeyPair(keyPairConfig config.KeyPair) (*tlsKeyPair, error) {
+	keyPair := &tlsKeyPair{}
+	return keyPair, keyPair.Load(keyPairConfig)
+}
+
+// Load replaces the certificate, keeping the current one when the files are invalid.
+// Unlike tls.LoadX509KeyPair it accepts encrypted private keys.
+func (k *tlsKeyPair) Load(keyPairConfig config.KeyPair) error {
+	certFile := keyPairConfig.Certificate
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return err
+	}
+	certificate := tls.Certificate{}
+	for block, rest := pem.Decode(certPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			certificate.Certificate = append(certificate.Certificate, block.Bytes)
+		}
+	}
+	if len(certificate.Certificate) == 0 {
+		return fmt.Errorf("no certificate found in %s", certFile)
+	}
+	certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := readKeyPassphrase(keyPairConfig)
+	if err != nil {
+		return err
+	}
+	key, err := validateKey(keyPairConfig.PrivateKey, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := signing.CheckKeyMatchesCertificate(key, certificate.Leaf); err != nil {
+		return err
+	}
+	certificate.PrivateKey = key
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.certificate = &certificate
+	return nil
+}
+
+func (k *tlsKeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.certificate, nil
+}
@@ -6,15 +6,27 @@ import (
 	"encoding/xml"
 	"errors"
 	"io/ioutil"
+	"crypto/x509"
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
 )
 
-func GetSPMetadata(r io.Reader) (spMetadata *saml.EntityDescriptor, err error) {
+// GetSPMetadata parses the SP metadata read from r. When signingCert is not nil the
+// metadata must carry an enveloped signature made with that certificate, and only
+// the signed content is parsed.
+func GetSPMetadata(r io.Reader, signingCert *x509.Certificate) (spMetadata *saml.EntityDescriptor, err error) {
 	var bytes []byte
 
 	if bytes, err = ioutil.ReadAll(r); err != nil {
 		return nil, err
 	}
 
+	if signingCert != nil {
+		if bytes, err = verifyMetadataSignature(bytes, signingCert); err != nil {
+			return nil, err
+		}
+	}
+
 	spMetadata = &saml.EntityDescriptor{}
 
 	if err := xml.Unmarshal(bytes, &spMetadata); err != nil {
@@ -40,3 +52,25 @@ func GetSPMetadata(r io.Reader) (spMetadata *saml.EntityDescriptor, err error) {
 
 	return spMetadata, nil
 }
+
+func verifyMetadataSignature(metadata []byte, signingCert *x509.Certificate) ([]byte, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(metadata); err != nil {
+		return nil, err
+	}
+	if doc.Root() == nil {
+		return nil, errors.New("metadata contained no root element")
+	}
+
+	validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+		Roots: []*x509.Certificate{signingCert},
+	})
+	signedEl, err := validationContext.Validate(doc.Root())
+	if err != nil {
+		return nil, errors.New("metadata signature verification failed: " + err.Error())
+	}
+
+	signedDoc := etree.NewDocument()
+	signedDoc.SetRoot(signedEl)
+	return signedDoc.WriteToBytes()
+}
@@ -0,0 +1,87 @@
+package service_providers_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/service_providers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/x509"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var _ = Describe("SPMetadata", func() {
+	var signingCert *x509.Certificate
+	var signedMetadata string
+
+	BeforeEach(func() {
+		var keyStore dsig.X509KeyStore
+		keyStore, signingCert = RandomSigningKeyStore()
+		signedMetadata = SignMetadata(keyStore, UnsignedSPMetadata)
+	})
+
+	Context("when no signing certificate is pinned", func() {
+		It("should accept unsigned metadata", func() {
+			metadata, err := GetSPMetadata(strings.NewReader(UnsignedSPMetadata), nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+		})
+	})
+
+	Context("when a signing certificate is pinned", func() {
+		It("should accept metadata signed with that certificate", func() {
+			metadata, err := GetSPMetadata(strings.NewReader(signedMetadata), signingCert)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+			Expect(metadata.SPSSODescriptors[0].AssertionConsumerServices[0].Location).To(Equal("https://sp.example.com/acs"))
+		})
+
+		It("should reject unsigned metadata", func() {
+			_, err := GetSPMetadata(strings.NewReader(UnsignedSPMetadata), signingCert)
+			Expect(err).To(MatchError(ContainSubstring("metadata signature verification failed")))
+		})
+
+		It("should reject metadata whose ACS url was tampered with", func() {
+			tampered := strings.Replace(signedMetadata, "https://sp.example.com/acs", "https://evil.example.com/acs", 1)
+			_, err := GetSPMetadata(strings.NewReader(tampered), signingCert)
+			Expect(err).To(MatchError(ContainSubstring("metadata signature verification failed")))
+		})
+
+		It("should reject metadata signed with another certificate", func() {
+			otherKeyStore, _ := RandomSigningKeyStore()
+			_, err := GetSPMetadata(strings.NewReader(SignMetadata(otherKeyStore, UnsignedSPMetadata)), signingCert)
+			Expect(err).To(MatchError(ContainSubstring("metadata signature verification failed")))
+		})
+	})
+})
+
+const UnsignedSPMetadata = `<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/metadata" ID="sp-metadata">` +
+	`<SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+	`<AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp.example.com/acs" index="0"></AssertionConsumerService>` +
+	`</SPSSODescriptor>` +
+	`</EntityDescriptor>`
+
+func RandomSigningKeyStore() (dsig.X509KeyStore, *x509.Certificate) {
+	keyStore := dsig.RandomKeyStoreForTest()
+	_, certBytes, err := keyStore.GetKeyPair()
+	Expect(err).NotTo(HaveOccurred())
+	cert, err := x509.ParseCertificate(certBytes)
+	Expect(err).NotTo(HaveOccurred())
+	return keyStore, cert
+}
+
+func SignMetadata(keyStore dsig.X509KeyStore, metadata string) string {
+	doc := etree.NewDocument()
+	Expect(doc.ReadFromString(metadata)).To(Succeed())
+
+	signedEl, err := dsig.NewDefaultSigningContext(keyStore).SignEnveloped(doc.Root())
+	Expect(err).NotTo(HaveOccurred())
+
+	signedDoc := etree.NewDocument()
+	signedDoc.SetRoot(signedEl)
+	signed, err := signedDoc.WriteToString()
+	Expect(err).NotTo(HaveOccurred())
+	return signed
+}
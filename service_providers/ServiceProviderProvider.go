@@ -6,19 +6,58 @@ import (
 	"github.com/crewjam/saml/samlidp"
 	"fmt"
 	"github.com/crewjam/saml/logger"
+	"os"
 )
 
 type InMemoryServiceProviderProvider struct {
 	Logger logger.Interface
-	Store  *samlidp.MemoryStore
+	Store  samlidp.Store
+	Index  *ServiceIndex
 }
 
+// GetServiceProvider looks serviceProviderID up as an entityID first and as a service
+// name second. Services added through the /services API are not indexed, so as a last
+// resort every stored service is checked for a matching entityID.
 func (imp InMemoryServiceProviderProvider) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
 	service := samlidp.Service{}
+
+	if imp.Index != nil {
+		if name, ok := imp.Index.Name(serviceProviderID); ok {
+			err := imp.Store.Get(fmt.Sprintf("/services/%s", name), &service)
+			if err == nil {
+				return &service.Metadata, nil
+			}
+			if err != samlidp.ErrNotFound {
+				imp.Logger.Printf("ERROR: %s", err)
+				return nil, err
+			}
+		}
+	}
+
 	err := imp.Store.Get(fmt.Sprintf("/services/%s", serviceProviderID), &service)
+	if err == nil {
+		return &service.Metadata, nil
+	}
+	if err != samlidp.ErrNotFound {
+		imp.Logger.Printf("ERROR: %s", err)
+		return nil, err
+	}
+
+	names, err := imp.Store.List("/services/")
 	if err != nil {
 		imp.Logger.Printf("ERROR: %s", err)
 		return nil, err
 	}
-	return &service.Metadata, nil
+	for _, name := range names {
+		service := samlidp.Service{}
+		if err := imp.Store.Get(fmt.Sprintf("/services/%s", name), &service); err != nil {
+			continue
+		}
+		if service.Metadata.EntityID == serviceProviderID {
+			return &service.Metadata, nil
+		}
+	}
+
+	imp.Logger.Printf("ERROR: no service provider with entityID or name %s", serviceProviderID)
+	return nil, os.ErrNotExist
 }
@@ -0,0 +1,95 @@
+package service_providers_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/service_providers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"log"
+	"os"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("ServiceProviderProvider", func() {
+	var store *samlidp.MemoryStore
+	var index *ServiceIndex
+	var provider InMemoryServiceProviderProvider
+	var logOutput *bytes.Buffer
+	var configurer SPMetadataConfigurerStore
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		index = NewServiceIndex()
+		logOutput = &bytes.Buffer{}
+		provider = InMemoryServiceProviderProvider{
+			Logger: logger.DefaultLogger,
+			Store:  store,
+			Index:  index,
+		}
+		configurer = SPMetadataConfigurerStore{
+			Store:  store,
+			Index:  index,
+			Logger: log.New(logOutput, "", 0),
+		}
+	})
+
+	Context("when an SP is configured under a friendly name", func() {
+		BeforeEach(func() {
+			_, err := configurer.AddSP("example", UnsignedSPMetadata)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should find the SP by entityID", func() {
+			metadata, err := provider.GetServiceProvider(nil, "https://sp.example.com/metadata")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+		})
+
+		It("should find the SP by name", func() {
+			metadata, err := provider.GetServiceProvider(nil, "example")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+		})
+
+		It("should warn that the name and entityID differ", func() {
+			Expect(logOutput.String()).To(ContainSubstring("WARNING: SP example has entityID https://sp.example.com/metadata"))
+		})
+
+		It("should warn when another SP claims the same entityID", func() {
+			_, err := configurer.AddSP("duplicate", UnsignedSPMetadata)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(logOutput.String()).To(ContainSubstring("WARNING: entityID https://sp.example.com/metadata is configured by both example and duplicate, using duplicate"))
+		})
+
+		It("should return the services to delete when the SP is removed", func() {
+			Expect(index.RemoveSource("example")).To(Equal([]string{"example"}))
+			_, ok := index.Name("https://sp.example.com/metadata")
+			Expect(ok).To(BeFalse())
+			Expect(index.RemoveSource("example")).To(BeEmpty())
+		})
+
+		It("should keep services another SP still provides", func() {
+			index.AddSource("other", "example")
+			Expect(index.RemoveSource("example")).To(BeEmpty())
+		})
+	})
+
+	It("should find services added without the index by entityID", func() {
+		Expect(store.Put("/services/rest-added", &samlidp.Service{
+			Metadata: saml.EntityDescriptor{EntityID: "https://rest.example.com"},
+		})).To(Succeed())
+
+		metadata, err := provider.GetServiceProvider(nil, "https://rest.example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(metadata.EntityID).To(Equal("https://rest.example.com"))
+	})
+
+	It("should return os.ErrNotExist for unknown SPs", func() {
+		_, err := provider.GetServiceProvider(nil, "https://unknown.example.com")
+		Expect(err).To(Equal(os.ErrNotExist))
+	})
+})
@@ -0,0 +1,167 @@
+package service_providers
+
+import (
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/crewjam/saml"
+)
+
+// EntityCategoryAttributeName is the entity attribute that carries the entity
+// categories (REFEDS R&S, SIRTFI, ...) of an entity in federation metadata.
+const EntityCategoryAttributeName = "http://macedir.org/entity-category"
+
+// EntityFilter selects which SP entities of an EntitiesDescriptor aggregate are
+// imported. Empty lists do not filter.
+type EntityFilter struct {
+	IncludeEntityIDs []string
+	ExcludeEntityIDs []string
+	EntityCategories []string
+}
+
+// Allows reports whether an entity passes the filter: it must be included (when an
+// include list is given), not excluded, and carry one of the entity categories
+// (when categories are given).
+func (f EntityFilter) Allows(entityID string, entityCategories []string) bool {
+	if len(f.IncludeEntityIDs) > 0 && !contains(f.IncludeEntityIDs, entityID) {
+		return false
+	}
+	if contains(f.ExcludeEntityIDs, entityID) {
+		return false
+	}
+	if len(f.EntityCategories) == 0 {
+		return true
+	}
+	for _, category := range entityCategories {
+		if contains(f.EntityCategories, category) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetAggregateSPMetadata parses SP metadata read from r and returns every SP entity
+// that passes filter. r may hold a single EntityDescriptor or an EntitiesDescriptor
+// aggregate, possibly nested. signingCert is handled as in GetSPMetadata.
+func GetAggregateSPMetadata(r io.Reader, signingCert *x509.Certificate, filter EntityFilter) ([]saml.EntityDescriptor, error) {
+	bytes, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if signingCert != nil {
+		if bytes, err = verifyMetadataSignature(bytes, signingCert); err != nil {
+			return nil, err
+		}
+	}
+
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(bytes, &root); err != nil {
+		return nil, err
+	}
+
+	var entityDescriptors []saml.EntityDescriptor
+	var categories entityCategories
+	if root.XMLName.Local == "EntitiesDescriptor" {
+		entities := saml.EntitiesDescriptor{}
+		if err := xml.Unmarshal(bytes, &entities); err != nil {
+			return nil, err
+		}
+		entityDescriptors = flattenEntities(entities)
+
+		aggregateCategories := aggregateEntityCategories{}
+		if err := xml.Unmarshal(bytes, &aggregateCategories); err != nil {
+			return nil, err
+		}
+		categories = aggregateCategories.flatten()
+	} else {
+		entity := saml.EntityDescriptor{}
+		if err := xml.Unmarshal(bytes, &entity); err != nil {
+			return nil, err
+		}
+		entityDescriptors = []saml.EntityDescriptor{entity}
+
+		entityCategory := entityCategoryDescriptor{}
+		if err := xml.Unmarshal(bytes, &entityCategory); err != nil {
+			return nil, err
+		}
+		categories = entityCategories{entityCategory.EntityID: entityCategory.categories()}
+	}
+
+	spMetadata := []saml.EntityDescriptor{}
+	for _, e := range entityDescriptors {
+		if len(e.SPSSODescriptors) == 0 {
+			continue
+		}
+		if filter.Allows(e.EntityID, categories[e.EntityID]) {
+			spMetadata = append(spMetadata, e)
+		}
+	}
+
+	if len(spMetadata) == 0 {
+		return nil, errors.New("metadata contained no matching service provider metadata")
+	}
+	return spMetadata, nil
+}
+
+func flattenEntities(entities saml.EntitiesDescriptor) []saml.EntityDescriptor {
+	entityDescriptors := append([]saml.EntityDescriptor{}, entities.EntityDescriptors...)
+	for _, nested := range entities.EntitiesDescriptors {
+		entityDescriptors = append(entityDescriptors, flattenEntities(nested)...)
+	}
+	return entityDescriptors
+}
+
+// entityCategories maps entityIDs to their entity categories. saml.EntityDescriptor
+// does not model md:Extensions, so they are read in a separate pass.
+type entityCategories map[string][]string
+
+type entityCategoryDescriptor struct {
+	EntityID   string `xml:"entityID,attr"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"AttributeValue"`
+	} `xml:"Extensions>EntityAttributes>Attribute"`
+}
+
+func (e entityCategoryDescriptor) categories() []string {
+	categories := []string{}
+	for _, attribute := range e.Attributes {
+		if attribute.Name == EntityCategoryAttributeName {
+			categories = append(categories, attribute.Values...)
+		}
+	}
+	return categories
+}
+
+type aggregateEntityCategories struct {
+	EntitiesDescriptors []aggregateEntityCategories `xml:"EntitiesDescriptor"`
+	EntityDescriptors   []entityCategoryDescriptor  `xml:"EntityDescriptor"`
+}
+
+func (a aggregateEntityCategories) flatten() entityCategories {
+	categories := entityCategories{}
+	for _, e := range a.EntityDescriptors {
+		categories[e.EntityID] = e.categories()
+	}
+	for _, nested := range a.EntitiesDescriptors {
+		for entityID, nestedCategories := range nested.flatten() {
+			categories[entityID] = nestedCategories
+		}
+	}
+	return categories
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package service_providers_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/service_providers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"strings"
+
+	"github.com/DennisDenuto/saml-idp/service_providers/service_providersfakes"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("Aggregate", func() {
+	entityIDs := func(entities []saml.EntityDescriptor) []string {
+		ids := []string{}
+		for _, e := range entities {
+			ids = append(ids, e.EntityID)
+		}
+		return ids
+	}
+
+	It("should return every SP entity of the aggregate, including nested ones", func() {
+		entities, err := GetAggregateSPMetadata(strings.NewReader(AggregateSPMetadata), nil, EntityFilter{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entityIDs(entities)).To(ConsistOf("https://sp1.example.com", "https://sp2.example.com", "https://sp3.example.com"))
+	})
+
+	It("should treat a single EntityDescriptor as an aggregate of one", func() {
+		entities, err := GetAggregateSPMetadata(strings.NewReader(UnsignedSPMetadata), nil, EntityFilter{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entityIDs(entities)).To(ConsistOf("https://sp.example.com/metadata"))
+	})
+
+	It("should only return allowed entity IDs", func() {
+		entities, err := GetAggregateSPMetadata(strings.NewReader(AggregateSPMetadata), nil, EntityFilter{
+			IncludeEntityIDs: []string{"https://sp1.example.com", "https://sp2.example.com"},
+			ExcludeEntityIDs: []string{"https://sp2.example.com"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entityIDs(entities)).To(ConsistOf("https://sp1.example.com"))
+	})
+
+	It("should only return entities in one of the entity categories", func() {
+		entities, err := GetAggregateSPMetadata(strings.NewReader(AggregateSPMetadata), nil, EntityFilter{
+			EntityCategories: []string{"http://refeds.org/category/research-and-scholarship"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entityIDs(entities)).To(ConsistOf("https://sp1.example.com", "https://sp3.example.com"))
+	})
+
+	It("should fail when nothing matches", func() {
+		_, err := GetAggregateSPMetadata(strings.NewReader(AggregateSPMetadata), nil, EntityFilter{
+			IncludeEntityIDs: []string{"https://unknown.example.com"},
+		})
+		Expect(err).To(MatchError("metadata contained no matching service provider metadata"))
+	})
+
+	It("should verify the aggregate signature", func() {
+		keyStore, signingCert := RandomSigningKeyStore()
+		otherKeyStore, _ := RandomSigningKeyStore()
+
+		entities, err := GetAggregateSPMetadata(strings.NewReader(SignMetadata(keyStore, AggregateSPMetadata)), signingCert, EntityFilter{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(entities).To(HaveLen(3))
+
+		_, err = GetAggregateSPMetadata(strings.NewReader(SignMetadata(otherKeyStore, AggregateSPMetadata)), signingCert, EntityFilter{})
+		Expect(err).To(MatchError(ContainSubstring("metadata signature verification failed")))
+	})
+
+	Context("when an SP is configured as an aggregate", func() {
+		It("should store every matching SP entity keyed by entityID", func() {
+			store := &service_providersfakes.FakeStore{}
+			configurer := SPMetadataConfigurerStore{
+				Store: store,
+				Aggregates: map[string]EntityFilter{
+					"federation": {ExcludeEntityIDs: []string{"https://sp3.example.com"}},
+				},
+			}
+
+			_, err := configurer.AddSP("federation", AggregateSPMetadata)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(store.PutCallCount()).To(Equal(2))
+			key, value := store.PutArgsForCall(0)
+			Expect(key).To(Equal("/services/https://sp1.example.com"))
+			Expect(value.(*samlidp.Service).Name).To(Equal("https://sp1.example.com"))
+			Expect(value.(*samlidp.Service).Metadata.EntityID).To(Equal("https://sp1.example.com"))
+			key, _ = store.PutArgsForCall(1)
+			Expect(key).To(Equal("/services/https://sp2.example.com"))
+		})
+
+		It("should delete the entities a refreshed aggregate no longer lists", func() {
+			store := &service_providersfakes.FakeStore{}
+			index := NewServiceIndex()
+			configurer := SPMetadataConfigurerStore{
+				Store:      store,
+				Aggregates: map[string]EntityFilter{"federation": {}},
+				Index:      index,
+			}
+			_, err := configurer.AddSP("federation", AggregateSPMetadata)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.DeleteCallCount()).To(Equal(0))
+
+			configurer.Aggregates = map[string]EntityFilter{
+				"federation": {ExcludeEntityIDs: []string{"https://sp3.example.com"}},
+			}
+			_, err = configurer.RefreshSP("federation", AggregateSPMetadata, "")
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(store.DeleteCallCount()).To(Equal(1))
+			Expect(store.DeleteArgsForCall(0)).To(Equal("/services/https://sp3.example.com"))
+			_, ok := index.Name("https://sp3.example.com")
+			Expect(ok).To(BeFalse())
+			name, ok := index.Name("https://sp1.example.com")
+			Expect(ok).To(BeTrue())
+			Expect(name).To(Equal("https://sp1.example.com"))
+		})
+	})
+})
+
+const AggregateSPMetadata = `<md:EntitiesDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" xmlns:mdattr="urn:oasis:names:tc:SAML:metadata:attribute" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="federation" Name="federation">` +
+	`<md:EntityDescriptor entityID="https://sp1.example.com">` +
+	`<md:Extensions><mdattr:EntityAttributes>` +
+	`<saml:Attribute Name="http://macedir.org/entity-category" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">` +
+	`<saml:AttributeValue>http://refeds.org/category/research-and-scholarship</saml:AttributeValue>` +
+	`</saml:Attribute>` +
+	`</mdattr:EntityAttributes></md:Extensions>` +
+	`<md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+	`<md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp1.example.com/acs" index="0"/>` +
+	`</md:SPSSODescriptor>` +
+	`</md:EntityDescriptor>` +
+	`<md:EntityDescriptor entityID="https://idp.example.com">` +
+	`<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+	`<md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/sso"/>` +
+	`</md:IDPSSODescriptor>` +
+	`</md:EntityDescriptor>` +
+	`<md:EntityDescriptor entityID="https://sp2.example.com">` +
+	`<md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+	`<md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp2.example.com/acs" index="0"/>` +
+	`</md:SPSSODescriptor>` +
+	`</md:EntityDescriptor>` +
+	`<md:EntitiesDescriptor Name="nested">` +
+	`<md:EntityDescriptor entityID="https://sp3.example.com">` +
+	`<md:Extensions><mdattr:EntityAttributes>` +
+	`<saml:Attribute Name="http://macedir.org/entity-category" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">` +
+	`<saml:AttributeValue>http://refeds.org/category/research-and-scholarship</saml:AttributeValue>` +
+	`</saml:Attribute>` +
+	`</mdattr:EntityAttributes></md:Extensions>` +
+	`<md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+	`<md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp3.example.com/acs" index="0"/>` +
+	`</md:SPSSODescriptor>` +
+	`</md:EntityDescriptor>` +
+	`</md:EntitiesDescriptor>` +
+	`</md:EntitiesDescriptor>`
@@ -8,12 +8,17 @@ import (
 	"time"
 	"sync"
 	"crypto/tls"
+	"crypto/x509"
+	"bytes"
+	"io"
+	"github.com/crewjam/saml"
 	"github.com/crewjam/saml/samlidp"
 )
 
 //go:generate counterfeiter . Store
 type Store interface {
 	Put(key string, value interface{}) error
+	Delete(key string) error
 }
 
 type SPBootstrap struct {
@@ -22,21 +27,36 @@ type SPBootstrap struct {
 	SpMetadataConfigurer SPMetadataConfigurer
 	BackOffDuration      time.Duration
 	Logger               logger.Interface
+	// Stop, when closed, makes Run give up waiting for the metadata.
+	Stop <-chan struct{}
 }
 
 func (s SPBootstrap) Run() error {
+	_, err := s.Fetch()
+	return err
+}
+
+// Fetch adds every SP like Run, and also returns the caching hints of the metadata
+// fetched for each SP so the SPMetadataRefresher can start from them.
+func (s SPBootstrap) Fetch() (map[string]SPMetadataCacheInfo, error) {
 	var wg = &sync.WaitGroup{}
 	var errChan = make(chan error, len(s.MetadataURLs))
+	var mutex sync.Mutex
+	var cacheInfos = map[string]SPMetadataCacheInfo{}
 	for spName, metadataUrl := range s.MetadataURLs {
 		wg.Add(1)
 		go func(spName string, metadataUrl string) {
 			defer wg.Done()
 			AddSPFunc := s.SpMetadataConfigurer.AddSP
 			backOffFunc := BackOff(s.Logger, s.BackOffDuration, AddSPFunc)
-			err := AddSPRetrier(s.Logger, backOffFunc)(spName, metadataUrl)
+			cacheInfo, err := AddSPRetrier(s.Logger, backOffFunc)(spName, metadataUrl)
 			if err != nil {
 				errChan <- err
+				return
 			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			cacheInfos[spName] = cacheInfo
 		}(spName, metadataUrl)
 	}
 	go func() {
@@ -44,75 +64,254 @@ func (s SPBootstrap) Run() error {
 		close(errChan)
 	}()
 
+	fetched := func() map[string]SPMetadataCacheInfo {
+		mutex.Lock()
+		defer mutex.Unlock()
+		copied := map[string]SPMetadataCacheInfo{}
+		for spName, cacheInfo := range cacheInfos {
+			copied[spName] = cacheInfo
+		}
+		return copied
+	}
+
 	timeout := time.After(s.Timeout)
 	for {
 		select {
 		case err := <-errChan:
-			return err
+			return fetched(), err
 		case <-timeout:
-			return errors.New("timedout waiting for SP metadata")
+			return fetched(), errors.New("timedout waiting for SP metadata")
+		case <-s.Stop:
+			return fetched(), errors.New("stopped waiting for SP metadata")
 		}
 	}
-	return nil
 }
 
-func BackOff(logger logger.Interface, backOffDuration time.Duration, f func(string, string) error) AddSPFunc {
-	return AddSPFunc(func(spID string, url string) error {
-		err := f(spID, url)
+func BackOff(logger logger.Interface, backOffDuration time.Duration, f AddSPFunc) AddSPFunc {
+	return AddSPFunc(func(spID string, url string) (SPMetadataCacheInfo, error) {
+		cacheInfo, err := f(spID, url)
 		if err == nil {
-			return nil
+			return cacheInfo, nil
 		}
 		logger.Printf("Backing off. Sleeping for %v", backOffDuration)
 		time.Sleep(backOffDuration)
-		return err
+		return SPMetadataCacheInfo{}, err
 	})
 }
 
 func AddSPRetrier(logger logger.Interface, f AddSPFunc) AddSPFunc {
-	return AddSPFunc(func(spId string, url string) error {
+	return AddSPFunc(func(spId string, url string) (SPMetadataCacheInfo, error) {
 		var err error
 		for numRetries := 0; numRetries < 3; numRetries++ {
-			logger.Printf("Trying %s metatadata url: (%s) call attempt: %d", spId, url, numRetries)
-			err = f(spId, url)
+			logger.Printf("Trying %s metatadata url: (%s) call attempt: %d", spId, MetadataSourceDescription(url), numRetries)
+			var cacheInfo SPMetadataCacheInfo
+			cacheInfo, err = f(spId, url)
 			if err == nil {
-				return nil
+				return cacheInfo, nil
 			}
 		}
-		return errors.Wrap(err, "Failed Adding SP after 3 retries")
+		return SPMetadataCacheInfo{}, errors.Wrap(err, "Failed Adding SP after 3 retries")
 	})
 
 }
 
-type AddSPFunc func(string, string) error
+type AddSPFunc func(string, string) (SPMetadataCacheInfo, error)
 
 //go:generate counterfeiter . SPMetadataConfigurer
 type SPMetadataConfigurer interface {
-	AddSP(string, string) error
+	AddSP(string, string) (SPMetadataCacheInfo, error)
+	RefreshSP(string, string, string) (SPMetadataCacheInfo, error)
 }
 
 type SPMetadataConfigurerStore struct {
 	Store Store
+	// SigningCertificates pins, per SP, the certificate its metadata must be signed with.
+	SigningCertificates map[string]*x509.Certificate
+	// TLSConfig is used to fetch metadata unless the SP has an entry in SPTLSConfigs.
+	TLSConfig    *tls.Config
+	SPTLSConfigs map[string]*tls.Config
+	// Clients reuses an http.Client per TLS config across fetches.
+	Clients *MetadataClients
+	// Aggregates marks the SPs whose metadata is an EntitiesDescriptor aggregate. Every
+	// SP entity in it that passes the filter is stored, keyed by entityID.
+	Aggregates map[string]EntityFilter
+	// Index, when set, is told the entityID and source of every stored service.
+	Index  *ServiceIndex
+	Logger logger.Interface
+}
+
+// AddSP fetches and stores the metadata of an SP, returning its caching hints.
+func (s SPMetadataConfigurerStore) AddSP(spId string, metadataURL string) (SPMetadataCacheInfo, error) {
+	return s.storeSPMetadata("AddSP", spId, metadataURL, "")
 }
 
-func (s SPMetadataConfigurerStore) AddSP(spId string, metadataURL string) error {
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+// RefreshSP re-fetches the metadata of an already configured SP. The etag of the
+// previous fetch is sent as If-None-Match; when the server answers 304 Not Modified
+// the store is left untouched.
+func (s SPMetadataConfigurerStore) RefreshSP(spId string, metadataURL string, etag string) (SPMetadataCacheInfo, error) {
+	return s.storeSPMetadata("RefreshSP", spId, metadataURL, etag)
+}
+
+func (s SPMetadataConfigurerStore) storeSPMetadata(op string, spId string, metadataURL string, etag string) (SPMetadataCacheInfo, error) {
+	if IsLocalSPMetadata(metadataURL) {
+		return s.storeLocalSPMetadata(op, spId, metadataURL, etag)
+	}
+	return s.storeRemoteSPMetadata(op, spId, metadataURL, etag)
+}
+
+func (s SPMetadataConfigurerStore) storeRemoteSPMetadata(op string, spId string, metadataURL string, etag string) (SPMetadataCacheInfo, error) {
+	tlsConfig := s.TLSConfig
+	if spTLSConfig, ok := s.SPTLSConfigs[spId]; ok {
+		tlsConfig = spTLSConfig
 	}
-	client := &http.Client{Transport: tr}
+	client := s.Clients.Client(tlsConfig)
 
-	response, err := client.Get(metadataURL)
+	request, err := http.NewRequest("GET", metadataURL, nil)
 	if err != nil {
-		return errors.Wrap(err, "AddSP Unable to get metadata xml")
+		return SPMetadataCacheInfo{}, errors.Wrapf(err, "%s Unable to get metadata xml", op)
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return SPMetadataCacheInfo{}, errors.Wrapf(describeFetchError(err), "%s Unable to get metadata xml", op)
 	}
 	defer response.Body.Close()
 
+	cacheInfo := NewSPMetadataCacheInfo(response.Header)
+	if etag != "" && response.StatusCode == http.StatusNotModified {
+		cacheInfo.NotModified = true
+		return cacheInfo, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return SPMetadataCacheInfo{}, errors.Errorf("%s unexpected status fetching metadata xml: %s", op, response.Status)
+	}
+
+	stored, err := s.putSPMetadata(op, spId, spId, response.Body)
+	if err != nil {
+		return SPMetadataCacheInfo{}, err
+	}
+	if err := s.deleteWithdrawnServices(op, spId, s.serviceNames(spId, spId, stored)); err != nil {
+		return SPMetadataCacheInfo{}, err
+	}
+
+	return cacheInfo.withEntityHints(stored), nil
+}
+
+func (s SPMetadataConfigurerStore) storeLocalSPMetadata(op string, spId string, metadataURL string, etag string) (SPMetadataCacheInfo, error) {
+	documents, err := ReadLocalSPMetadata(spId, metadataURL)
+	if err != nil {
+		return SPMetadataCacheInfo{}, errors.Wrapf(err, "%s Unable to read metadata xml", op)
+	}
+
+	cacheInfo := SPMetadataCacheInfo{ETag: documents.ETag()}
+	if etag != "" && etag == cacheInfo.ETag {
+		cacheInfo.NotModified = true
+		return cacheInfo, nil
+	}
+
+	names := []string{}
+	for _, document := range documents {
+		stored, err := s.putSPMetadata(op, spId, document.Name, bytes.NewReader(document.Contents))
+		if err != nil {
+			return SPMetadataCacheInfo{}, err
+		}
+		cacheInfo = cacheInfo.withEntityHints(stored)
+		names = append(names, s.serviceNames(spId, document.Name, stored)...)
+	}
+	if err := s.deleteWithdrawnServices(op, spId, names); err != nil {
+		return SPMetadataCacheInfo{}, err
+	}
+
+	return cacheInfo, nil
+}
+
+// putSPMetadata parses metadata configured for spId, verifying it against the SP's pinned
+// signing certificate, and stores it as the service called name. When spId is an
+// aggregate every matching SP entity is stored under its entityID instead.
+func (s SPMetadataConfigurerStore) putSPMetadata(op string, spId string, name string, r io.Reader) ([]saml.EntityDescriptor, error) {
+	if filter, ok := s.Aggregates[spId]; ok {
+		entities, err := GetAggregateSPMetadata(r, s.SigningCertificates[spId], filter)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s could not retrieve SP metadata", op)
+		}
+		for _, entity := range entities {
+			service := samlidp.Service{Name: entity.EntityID, Metadata: entity}
+			if err := s.Store.Put(fmt.Sprintf("/services/%s", entity.EntityID), &service); err != nil {
+				return nil, err
+			}
+			s.indexService(op, spId, entity.EntityID, entity.EntityID)
+		}
+		return entities, nil
+	}
+
 	service := samlidp.Service{}
 
-	metadata, err := GetSPMetadata(response.Body)
+	metadata, err := GetSPMetadata(r, s.SigningCertificates[spId])
 	if err != nil {
-		return errors.Wrap(err, "AddSP could not retrieve SP metadata")
+		return nil, errors.Wrapf(err, "%s could not retrieve SP metadata", op)
 	}
 	service.Metadata = *metadata
 
-	return s.Store.Put(fmt.Sprintf("/services/%s", spId), &service)
+	if err := s.Store.Put(fmt.Sprintf("/services/%s", name), &service); err != nil {
+		return nil, err
+	}
+	s.indexService(op, spId, name, metadata.EntityID)
+
+	return []saml.EntityDescriptor{*metadata}, nil
+}
+
+// serviceNames returns the names putSPMetadata stored the entities read for name under.
+func (s SPMetadataConfigurerStore) serviceNames(spId string, name string, stored []saml.EntityDescriptor) []string {
+	if _, ok := s.Aggregates[spId]; !ok {
+		return []string{name}
+	}
+	names := []string{}
+	for _, entity := range stored {
+		names = append(names, entity.EntityID)
+	}
+	return names
+}
+
+// deleteWithdrawnServices deletes the services stored from spId on an earlier fetch
+// that its metadata no longer lists, as a reload does for a removed sp_metadata_urls
+// entry. Without an Index there is no record of earlier fetches and nothing is deleted.
+func (s SPMetadataConfigurerStore) deleteWithdrawnServices(op string, spId string, names []string) error {
+	if s.Index == nil {
+		return nil
+	}
+
+	for _, name := range s.Index.ReplaceSource(spId, names) {
+		err := s.Store.Delete(fmt.Sprintf("/services/%s", name))
+		if err != nil && err != samlidp.ErrNotFound {
+			return err
+		}
+		if s.Logger != nil {
+			s.Logger.Printf("%s removed SP %s, which %s no longer lists", op, name, spId)
+		}
+	}
+	return nil
+}
+
+// indexService records the entityID of the service stored as name, and that it came
+// from spId. At startup it warns when the two differ, as SP-initiated logins are
+// matched on the entityID only.
+func (s SPMetadataConfigurerStore) indexService(op string, spId string, name string, entityID string) {
+	if s.Index == nil {
+		return
+	}
+
+	s.Index.AddSource(spId, name)
+	previousName := s.Index.Add(name, entityID)
+	if s.Logger == nil || op != "AddSP" {
+		return
+	}
+	if previousName != "" {
+		s.Logger.Printf("WARNING: entityID %s is configured by both %s and %s, using %s", entityID, previousName, name, name)
+	}
+	if name != entityID {
+		s.Logger.Printf("WARNING: SP %s has entityID %s, AuthnRequests from it are matched on the entityID", name, entityID)
+	}
 }
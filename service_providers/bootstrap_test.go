@@ -14,6 +14,8 @@ import (
 	"io/ioutil"
 	"github.com/crewjam/saml/samlidp"
 	"encoding/xml"
+	"crypto/x509"
+	dsig "github.com/russellhaering/goxmldsig"
 )
 
 var _ = Describe("Bootstrap", func() {
@@ -63,6 +65,15 @@ var _ = Describe("Bootstrap", func() {
 			Expect(SamlSPMetadataToString(value.(*samlidp.Service))).To(Equal(SamlSPMetadataContent()))
 		})
 
+		It("should return the caching hints of each fetch", func() {
+			server.SetHandler(0, ghttp.RespondWith(200, SamlSPMetadataContent(), http.Header{"ETag": []string{`"v1"`}}))
+
+			cacheInfos, err := bootstrap.Fetch()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cacheInfos).To(HaveKey("sp_id"))
+			Expect(cacheInfos["sp_id"].ETag).To(Equal(`"v1"`))
+		})
+
 		Context("when sp metadata service is initially unavailable but eventually comes back up", func() {
 			BeforeEach(func() {
 				server.SetHandler(0, ghttp.CombineHandlers(
@@ -123,9 +134,9 @@ var _ = Describe("Bootstrap", func() {
 
 		BeforeEach(func() {
 			configurer = &service_providersfakes.FakeSPMetadataConfigurer{}
-			configurer.AddSPStub = func(string, string) error {
+			configurer.AddSPStub = func(string, string) (SPMetadataCacheInfo, error) {
 				time.Sleep(10 * time.Minute)
-				return nil
+				return SPMetadataCacheInfo{}, nil
 			}
 
 			bootstrap.Timeout = 1
@@ -133,13 +144,11 @@ var _ = Describe("Bootstrap", func() {
 		})
 
 		It("should timeout with an error", func() {
-			errChan := make(chan error)
-			Eventually(func() chan error {
-				go func(chan error) {
-					errChan <- bootstrap.Run()
-				}(errChan)
-				return errChan
-			}, 5, 1).Should(Receive(HaveOccurred()))
+			errChan := make(chan error, 1)
+			go func(bootstrap SPBootstrap) {
+				errChan <- bootstrap.Run()
+			}(bootstrap)
+			Eventually(errChan, 5).Should(Receive(HaveOccurred()))
 		})
 	})
 
@@ -178,6 +187,39 @@ var _ = Describe("Bootstrap", func() {
 
 	})
 
+	Context("when the sp metadata signing certificate is pinned", func() {
+		var keyStore dsig.X509KeyStore
+		var signingCert *x509.Certificate
+
+		BeforeEach(func() {
+			keyStore, signingCert = RandomSigningKeyStore()
+			bootstrap.SpMetadataConfigurer = SPMetadataConfigurerStore{
+				Store: store,
+				SigningCertificates: map[string]*x509.Certificate{
+					"sp_id": signingCert,
+				},
+			}
+		})
+
+		It("should store signed metadata", func() {
+			server.AppendHandlers(ghttp.RespondWith(200, SignMetadata(keyStore, UnsignedSPMetadata)))
+
+			err := bootstrap.Run()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.PutCallCount()).To(Equal(1))
+			_, value := store.PutArgsForCall(0)
+			Expect(value.(*samlidp.Service).Metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+		})
+
+		It("should refuse unsigned metadata", func() {
+			server.RouteToHandler("GET", "/metadata", ghttp.RespondWith(200, UnsignedSPMetadata))
+
+			err := bootstrap.Run()
+			Expect(err).To(MatchError(ContainSubstring("AddSP could not retrieve SP metadata: metadata signature verification failed")))
+			Expect(store.PutCallCount()).To(Equal(0))
+		})
+	})
+
 	Context("when second SP metadata fails", func() {
 		BeforeEach(func() {
 			bootstrap.MetadataURLs = map[string]string{
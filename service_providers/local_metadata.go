@@ -0,0 +1,111 @@
+package service_providers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LocalSPMetadata is a metadata document that was read from the config file or
+// the local filesystem rather than fetched over HTTP.
+type LocalSPMetadata struct {
+	Name     string
+	Contents []byte
+}
+
+type LocalSPMetadataDocuments []LocalSPMetadata
+
+// ETag identifies the current contents of the documents so a refresh can tell
+// whether anything changed on disk.
+func (documents LocalSPMetadataDocuments) ETag() string {
+	hash := sha256.New()
+	for _, document := range documents {
+		hash.Write([]byte(document.Name))
+		hash.Write([]byte{0})
+		hash.Write(document.Contents)
+		hash.Write([]byte{0})
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+}
+
+// IsLocalSPMetadata reports whether an sp_metadata_urls value is inline XML or a
+// file:// url instead of an address to fetch.
+func IsLocalSPMetadata(metadataURL string) bool {
+	return isInlineSPMetadata(metadataURL) || strings.HasPrefix(metadataURL, "file://")
+}
+
+// MetadataSourceDescription returns a loggable description of an sp_metadata_urls value.
+func MetadataSourceDescription(metadataURL string) string {
+	if isInlineSPMetadata(metadataURL) {
+		return "inline metadata"
+	}
+	return metadataURL
+}
+
+// ReadLocalSPMetadata reads the metadata configured for spId. Inline XML and a
+// file:// url naming a file yield a single document called spId. A file:// url
+// naming a directory yields one document per *.xml file in it, each named after
+// the file without its extension. A file:// url may only name the host localhost.
+func ReadLocalSPMetadata(spId string, metadataURL string) (LocalSPMetadataDocuments, error) {
+	if isInlineSPMetadata(metadataURL) {
+		return LocalSPMetadataDocuments{{Name: spId, Contents: []byte(metadataURL)}}, nil
+	}
+
+	fileURL, err := url.Parse(metadataURL)
+	if err != nil {
+		return nil, err
+	}
+	if fileURL.Host != "" && fileURL.Host != "localhost" {
+		return nil, errors.Errorf("cannot read %s: file:// urls must name a local file, not one on host %q", metadataURL, fileURL.Host)
+	}
+	path := fileURL.Path
+	if path == "" {
+		path = fileURL.Opaque
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return LocalSPMetadataDocuments{{Name: spId, Contents: contents}}, nil
+	}
+
+	paths, err := filepath.Glob(filepath.Join(path, "*.xml"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("no *.xml metadata files found in %s", path)
+	}
+	sort.Strings(paths)
+
+	documents := LocalSPMetadataDocuments{}
+	for _, metadataPath := range paths {
+		contents, err := ioutil.ReadFile(metadataPath)
+		if err != nil {
+			return nil, err
+		}
+		documents = append(documents, LocalSPMetadata{
+			Name:     strings.TrimSuffix(filepath.Base(metadataPath), filepath.Ext(metadataPath)),
+			Contents: contents,
+		})
+	}
+	return documents, nil
+}
+
+func isInlineSPMetadata(metadataURL string) bool {
+	return strings.HasPrefix(strings.TrimSpace(metadataURL), "<")
+}
@@ -0,0 +1,147 @@
+package service_providers_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/service_providers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/DennisDenuto/saml-idp/service_providers/service_providersfakes"
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("Local SP metadata", func() {
+	var store *service_providersfakes.FakeStore
+	var configurer SPMetadataConfigurerStore
+	var tempDir string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "local-metadata")
+		Expect(err).NotTo(HaveOccurred())
+
+		store = &service_providersfakes.FakeStore{}
+		configurer = SPMetadataConfigurerStore{Store: store}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	It("should store inline metadata", func() {
+		_, err := configurer.AddSP("sp_id", UnsignedSPMetadata)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.PutCallCount()).To(Equal(1))
+		key, value := store.PutArgsForCall(0)
+		Expect(key).To(Equal("/services/sp_id"))
+		Expect(value.(*samlidp.Service).Metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+	})
+
+	It("should store metadata from a file:// url", func() {
+		metadataPath := filepath.Join(tempDir, "sp.xml")
+		Expect(ioutil.WriteFile(metadataPath, []byte(SamlSPMetadataContent()), 0600)).To(Succeed())
+
+		_, err := configurer.AddSP("sp_id", "file://"+metadataPath)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.PutCallCount()).To(Equal(1))
+		key, value := store.PutArgsForCall(0)
+		Expect(key).To(Equal("/services/sp_id"))
+		Expect(SamlSPMetadataToString(value.(*samlidp.Service))).To(Equal(SamlSPMetadataContent()))
+	})
+
+	It("should store every *.xml file of a directory under its file name", func() {
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "uaa.xml"), []byte(SamlSPMetadataContent()), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "example.xml"), []byte(UnsignedSPMetadata), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "README"), []byte("not metadata"), 0600)).To(Succeed())
+
+		_, err := configurer.AddSP("local_sps", "file://"+tempDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.PutCallCount()).To(Equal(2))
+		key, value := store.PutArgsForCall(0)
+		Expect(key).To(Equal("/services/example"))
+		Expect(value.(*samlidp.Service).Metadata.EntityID).To(Equal("https://sp.example.com/metadata"))
+		key, value = store.PutArgsForCall(1)
+		Expect(key).To(Equal("/services/uaa"))
+		Expect(value.(*samlidp.Service).Metadata.EntityID).To(Equal("uaa_sp_entity_id"))
+	})
+
+	It("should delete the services of files removed from a directory on refresh", func() {
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "uaa.xml"), []byte(SamlSPMetadataContent()), 0600)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(tempDir, "example.xml"), []byte(UnsignedSPMetadata), 0600)).To(Succeed())
+		index := NewServiceIndex()
+		configurer.Index = index
+		_, err := configurer.AddSP("local_sps", "file://"+tempDir)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(os.Remove(filepath.Join(tempDir, "example.xml"))).To(Succeed())
+		_, err = configurer.RefreshSP("local_sps", "file://"+tempDir, "")
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(store.DeleteCallCount()).To(Equal(1))
+		Expect(store.DeleteArgsForCall(0)).To(Equal("/services/example"))
+		_, ok := index.Name("https://sp.example.com/metadata")
+		Expect(ok).To(BeFalse())
+		name, ok := index.Name("uaa_sp_entity_id")
+		Expect(ok).To(BeTrue())
+		Expect(name).To(Equal("uaa"))
+	})
+
+	It("should fail on a directory without metadata files", func() {
+		_, err := configurer.AddSP("local_sps", "file://"+tempDir)
+		Expect(err).To(MatchError("AddSP Unable to read metadata xml: no *.xml metadata files found in " + tempDir))
+	})
+
+	It("should fail on a missing file", func() {
+		_, err := configurer.AddSP("sp_id", "file://"+filepath.Join(tempDir, "missing.xml"))
+		Expect(err).To(MatchError(ContainSubstring("AddSP Unable to read metadata xml")))
+	})
+
+	It("should read a file:// url naming localhost", func() {
+		metadataPath := filepath.Join(tempDir, "sp.xml")
+		Expect(ioutil.WriteFile(metadataPath, []byte(UnsignedSPMetadata), 0600)).To(Succeed())
+
+		_, err := configurer.AddSP("sp_id", "file://localhost"+metadataPath)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(store.PutCallCount()).To(Equal(1))
+	})
+
+	It("should fail on a file:// url naming another host", func() {
+		_, err := configurer.AddSP("sp_id", "file://fileserver/metadata/sp.xml")
+		Expect(err).To(MatchError(`AddSP Unable to read metadata xml: cannot read file://fileserver/metadata/sp.xml: file:// urls must name a local file, not one on host "fileserver"`))
+		Expect(store.PutCallCount()).To(Equal(0))
+	})
+
+	It("should report unchanged files as not modified on refresh", func() {
+		metadataPath := filepath.Join(tempDir, "sp.xml")
+		Expect(ioutil.WriteFile(metadataPath, []byte(UnsignedSPMetadata), 0600)).To(Succeed())
+
+		info, err := configurer.RefreshSP("sp_id", "file://"+metadataPath, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.ETag).NotTo(BeEmpty())
+
+		unchanged, err := configurer.RefreshSP("sp_id", "file://"+metadataPath, info.ETag)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(unchanged.NotModified).To(BeTrue())
+		Expect(store.PutCallCount()).To(Equal(1))
+
+		changed := strings.Replace(UnsignedSPMetadata, "https://sp.example.com/acs", "https://sp.example.com/new-acs", 1)
+		Expect(ioutil.WriteFile(metadataPath, []byte(changed), 0600)).To(Succeed())
+
+		modified, err := configurer.RefreshSP("sp_id", "file://"+metadataPath, info.ETag)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(modified.NotModified).To(BeFalse())
+		Expect(store.PutCallCount()).To(Equal(2))
+	})
+
+	It("should describe inline metadata without logging all of it", func() {
+		Expect(MetadataSourceDescription(UnsignedSPMetadata)).To(Equal("inline metadata"))
+		Expect(MetadataSourceDescription("https://sp.example.com/metadata")).To(Equal("https://sp.example.com/metadata"))
+	})
+})
@@ -0,0 +1,110 @@
+package service_providers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NewMetadataTLSConfig builds the TLS settings used to fetch SP metadata. Without a
+// caBundle the system roots are trusted. clientCertificate and clientPrivateKey
+// enable mutual TLS and must be given together.
+func NewMetadataTLSConfig(caBundle string, clientCertificate string, clientPrivateKey string, insecureSkipVerify bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caBundle != "" {
+		caBundleContents, err := ioutil.ReadFile(caBundle)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to read CA bundle")
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caBundleContents) {
+			return nil, errors.Errorf("No certificates found in CA bundle %s", caBundle)
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if clientCertificate != "" || clientPrivateKey != "" {
+		if clientCertificate == "" || clientPrivateKey == "" {
+			return nil, errors.New("client certificate and client private key must be set together")
+		}
+		clientCert, err := tls.LoadX509KeyPair(clientCertificate, clientPrivateKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
+
+// DefaultMetadataFetchTimeout bounds a fetch of SP metadata, so a hung metadata server
+// cannot stall the bootstrap or refresh of its SP.
+const DefaultMetadataFetchTimeout = 30 * time.Second
+
+// MetadataClients hands out one http.Client per TLS config, so repeated fetches of SP
+// metadata reuse their keep-alive connections. Timeout, DefaultMetadataFetchTimeout
+// when 0, bounds each fetch.
+type MetadataClients struct {
+	Timeout time.Duration
+
+	mutex   sync.Mutex
+	clients map[*tls.Config]*http.Client
+}
+
+// Client returns the client for tlsConfig, creating it on first use. A nil
+// MetadataClients returns a new client every time.
+func (c *MetadataClients) Client(tlsConfig *tls.Config) *http.Client {
+	if c == nil {
+		return newMetadataClient(tlsConfig, DefaultMetadataFetchTimeout)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if client, ok := c.clients[tlsConfig]; ok {
+		return client
+	}
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultMetadataFetchTimeout
+	}
+	if c.clients == nil {
+		c.clients = map[*tls.Config]*http.Client{}
+	}
+	c.clients[tlsConfig] = newMetadataClient(tlsConfig, timeout)
+	return c.clients[tlsConfig]
+}
+
+func newMetadataClient(tlsConfig *tls.Config, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+			IdleConnTimeout: 90 * time.Second,
+		},
+	}
+}
+
+// describeFetchError makes certificate problems stand out from the generic
+// transport error returned by http.Client.
+func describeFetchError(err error) error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		return err
+	}
+
+	switch urlErr.Err.(type) {
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError, *tls.CertificateVerificationError:
+		return errors.Wrap(err, "TLS verification of metadata url failed")
+	}
+	return err
+}
@@ -0,0 +1,195 @@
+package service_providers_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/service_providers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/service_providers/service_providersfakes"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Metadata TLS", func() {
+	var server *ghttp.Server
+	var store *service_providersfakes.FakeStore
+	var tempDir string
+	var serverCABundle string
+
+	BeforeEach(func() {
+		var err error
+		tempDir, err = ioutil.TempDir("", "metadata-tls")
+		Expect(err).NotTo(HaveOccurred())
+
+		server = ghttp.NewUnstartedServer()
+		server.HTTPTestServer.StartTLS()
+		server.RouteToHandler("GET", "/metadata", ghttp.RespondWith(200, SamlSPMetadataContent()))
+
+		serverCABundle = filepath.Join(tempDir, "ca.pem")
+		writePEM(serverCABundle, "CERTIFICATE", server.HTTPTestServer.Certificate().Raw)
+
+		store = &service_providersfakes.FakeStore{}
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	addSP := func(tlsConfig *tls.Config) error {
+		_, err := SPMetadataConfigurerStore{
+			Store:     store,
+			TLSConfig: tlsConfig,
+		}.AddSP("sp_id", fmt.Sprintf("%s/metadata", server.URL()))
+		return err
+	}
+
+	It("should reject an untrusted metadata server and say why", func() {
+		tlsConfig, err := NewMetadataTLSConfig("", "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+
+		err = addSP(tlsConfig)
+		Expect(err).To(MatchError(ContainSubstring("AddSP Unable to get metadata xml: TLS verification of metadata url failed")))
+		Expect(store.PutCallCount()).To(Equal(0))
+	})
+
+	It("should trust a metadata server signed by the configured CA bundle", func() {
+		tlsConfig, err := NewMetadataTLSConfig(serverCABundle, "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(addSP(tlsConfig)).To(Succeed())
+		Expect(store.PutCallCount()).To(Equal(1))
+	})
+
+	It("should skip verification only when explicitly asked to", func() {
+		tlsConfig, err := NewMetadataTLSConfig("", "", "", true)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(addSP(tlsConfig)).To(Succeed())
+	})
+
+	It("should prefer the per sp TLS config", func() {
+		defaultTLSConfig, err := NewMetadataTLSConfig("", "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+		spTLSConfig, err := NewMetadataTLSConfig(serverCABundle, "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = SPMetadataConfigurerStore{
+			Store:        store,
+			TLSConfig:    defaultTLSConfig,
+			SPTLSConfigs: map[string]*tls.Config{"sp_id": spTLSConfig},
+		}.AddSP("sp_id", fmt.Sprintf("%s/metadata", server.URL()))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should reuse the client of a TLS config", func() {
+		tlsConfig, err := NewMetadataTLSConfig(serverCABundle, "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+		otherTLSConfig, err := NewMetadataTLSConfig(serverCABundle, "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+
+		clients := &MetadataClients{}
+		Expect(clients.Client(tlsConfig)).To(BeIdenticalTo(clients.Client(tlsConfig)))
+		Expect(clients.Client(otherTLSConfig)).NotTo(BeIdenticalTo(clients.Client(tlsConfig)))
+		Expect(clients.Client(tlsConfig).Timeout).To(Equal(DefaultMetadataFetchTimeout))
+	})
+
+	It("should give up on a metadata server that does not answer", func() {
+		hung := make(chan struct{})
+		defer close(hung)
+		server.RouteToHandler("GET", "/metadata", func(w http.ResponseWriter, r *http.Request) {
+			<-hung
+		})
+		tlsConfig, err := NewMetadataTLSConfig(serverCABundle, "", "", false)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = SPMetadataConfigurerStore{
+			Store:     store,
+			TLSConfig: tlsConfig,
+			Clients:   &MetadataClients{Timeout: 100 * time.Millisecond},
+		}.AddSP("sp_id", fmt.Sprintf("%s/metadata", server.URL()))
+		Expect(err).To(MatchError(ContainSubstring("Client.Timeout exceeded")))
+	})
+
+	Context("when the metadata server requires a client certificate", func() {
+		var clientCert string
+		var clientKey string
+
+		BeforeEach(func() {
+			server.Close()
+			server = ghttp.NewUnstartedServer()
+			server.HTTPTestServer.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+			server.HTTPTestServer.StartTLS()
+			server.RouteToHandler("GET", "/metadata", ghttp.RespondWith(200, SamlSPMetadataContent()))
+			writePEM(serverCABundle, "CERTIFICATE", server.HTTPTestServer.Certificate().Raw)
+
+			clientCert = filepath.Join(tempDir, "client.pem")
+			clientKey = filepath.Join(tempDir, "client.key")
+			writeSelfSignedPair(clientCert, clientKey)
+		})
+
+		It("should present the configured client certificate", func() {
+			tlsConfig, err := NewMetadataTLSConfig(serverCABundle, clientCert, clientKey, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(addSP(tlsConfig)).To(Succeed())
+			Expect(server.ReceivedRequests()[0].TLS.PeerCertificates).To(HaveLen(1))
+		})
+
+		It("should fail without a client certificate", func() {
+			tlsConfig, err := NewMetadataTLSConfig(serverCABundle, "", "", false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(addSP(tlsConfig)).NotTo(Succeed())
+		})
+
+		It("should require the client certificate and key together", func() {
+			_, err := NewMetadataTLSConfig(serverCABundle, clientCert, "", false)
+			Expect(err).To(MatchError("client certificate and client private key must be set together"))
+		})
+	})
+
+	It("should fail on a CA bundle without certificates", func() {
+		emptyBundle := filepath.Join(tempDir, "empty.pem")
+		Expect(ioutil.WriteFile(emptyBundle, []byte("nothing here"), 0600)).To(Succeed())
+
+		_, err := NewMetadataTLSConfig(emptyBundle, "", "", false)
+		Expect(err).To(MatchError(fmt.Sprintf("No certificates found in CA bundle %s", emptyBundle)))
+	})
+})
+
+func writePEM(path string, blockType string, der []byte) {
+	err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	Expect(err).NotTo(HaveOccurred())
+}
+
+func writeSelfSignedPair(certPath string, keyPath string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "metadata-client"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).NotTo(HaveOccurred())
+
+	writePEM(certPath, "CERTIFICATE", der)
+	writePEM(keyPath, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+}
@@ -0,0 +1,215 @@
+package service_providers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+)
+
+const (
+	DefaultRefreshInterval    = time.Hour
+	DefaultMinRefreshInterval = 5 * time.Minute
+	DefaultMaxRefreshInterval = 24 * time.Hour
+)
+
+// SPMetadataCacheInfo holds the caching hints that came back with a fetch of SP
+// metadata, both from the HTTP response and from the EntityDescriptor itself.
+type SPMetadataCacheInfo struct {
+	ETag          string
+	NotModified   bool
+	NoCache       bool
+	MaxAge        time.Duration
+	ValidUntil    time.Time
+	CacheDuration time.Duration
+}
+
+// NewSPMetadataCacheInfo reads the ETag and Cache-Control headers of a metadata response.
+func NewSPMetadataCacheInfo(header http.Header) SPMetadataCacheInfo {
+	info := SPMetadataCacheInfo{
+		ETag: header.Get("ETag"),
+	}
+
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			info.NoCache = true
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && seconds >= 0 {
+				info.MaxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+
+	return info
+}
+
+// RefreshAfter returns how long the metadata may be served before it should be
+// fetched again: the shortest of max-age, cacheDuration and the time left until
+// validUntil, or defaultInterval when none of those were given.
+func (info SPMetadataCacheInfo) RefreshAfter(now time.Time, defaultInterval time.Duration) time.Duration {
+	if info.NoCache {
+		return 0
+	}
+
+	candidates := []time.Duration{info.MaxAge, info.CacheDuration}
+	if !info.ValidUntil.IsZero() {
+		candidates = append(candidates, info.ValidUntil.Sub(now))
+	}
+
+	refreshAfter := time.Duration(-1)
+	for _, candidate := range candidates {
+		if candidate <= 0 {
+			continue
+		}
+		if refreshAfter < 0 || candidate < refreshAfter {
+			refreshAfter = candidate
+		}
+	}
+
+	if refreshAfter < 0 {
+		return defaultInterval
+	}
+	return refreshAfter
+}
+
+// withEntityHints records the earliest validUntil and shortest cacheDuration of the
+// stored entities.
+func (info SPMetadataCacheInfo) withEntityHints(entities []saml.EntityDescriptor) SPMetadataCacheInfo {
+	for _, entity := range entities {
+		if !entity.ValidUntil.IsZero() && (info.ValidUntil.IsZero() || entity.ValidUntil.Before(info.ValidUntil)) {
+			info.ValidUntil = entity.ValidUntil
+		}
+		if entity.CacheDuration > 0 && (info.CacheDuration == 0 || entity.CacheDuration < info.CacheDuration) {
+			info.CacheDuration = entity.CacheDuration
+		}
+	}
+	return info
+}
+
+// merge folds the result of a later fetch into info. A 304 response carries no
+// EntityDescriptor, so the validUntil/cacheDuration of the last good copy are kept.
+func (info SPMetadataCacheInfo) merge(next SPMetadataCacheInfo) SPMetadataCacheInfo {
+	if !next.NotModified {
+		return next
+	}
+
+	if next.ETag != "" {
+		info.ETag = next.ETag
+	}
+	info.NoCache = next.NoCache
+	info.MaxAge = next.MaxAge
+	info.NotModified = true
+	return info
+}
+
+// SPMetadataRefresher periodically re-fetches the metadata of every configured SP
+// so that certificate or ACS rotations on the SP side are picked up without a
+// restart. When a fetch fails the previously stored metadata keeps being served, and
+// the refresh is retried after a wait that doubles from MinInterval up to MaxInterval.
+type SPMetadataRefresher struct {
+	MetadataURLs         map[string]string
+	SpMetadataConfigurer SPMetadataConfigurer
+	// CacheInfos holds, by SP name, the caching hints of the fetch that stored the
+	// current metadata, which decide when the first refresh happens.
+	CacheInfos  map[string]SPMetadataCacheInfo
+	Interval    time.Duration
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	Logger      logger.Interface
+}
+
+// Run refreshes every SP until stop is closed.
+func (r SPMetadataRefresher) Run(stop <-chan struct{}) {
+	var wg = &sync.WaitGroup{}
+	for spName, metadataUrl := range r.MetadataURLs {
+		wg.Add(1)
+		go func(spName string, metadataUrl string) {
+			defer wg.Done()
+			r.refreshLoop(stop, spName, metadataUrl)
+		}(spName, metadataUrl)
+	}
+	wg.Wait()
+}
+
+func (r SPMetadataRefresher) refreshLoop(stop <-chan struct{}, spName string, metadataUrl string) {
+	cacheInfo := r.CacheInfos[spName]
+	wait := r.clamp(cacheInfo.RefreshAfter(time.Now(), r.interval()))
+	failedWait := time.Duration(0)
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		next, err := r.SpMetadataConfigurer.RefreshSP(spName, metadataUrl, cacheInfo.ETag)
+		if err != nil {
+			r.Logger.Printf("Unable to refresh %s metadata url: (%s), keeping last good copy: %s", spName, MetadataSourceDescription(metadataUrl), err)
+			failedWait = r.backOff(failedWait)
+			wait = failedWait
+			continue
+		}
+		failedWait = 0
+
+		cacheInfo = cacheInfo.merge(next)
+		wait = r.clamp(cacheInfo.RefreshAfter(time.Now(), r.interval()))
+		if next.NotModified {
+			r.Logger.Printf("%s metadata url: (%s) not modified, next refresh in %v", spName, MetadataSourceDescription(metadataUrl), wait)
+		} else {
+			r.Logger.Printf("Refreshed %s metadata url: (%s), next refresh in %v", spName, MetadataSourceDescription(metadataUrl), wait)
+		}
+	}
+}
+
+// backOff returns the wait after a failed refresh, given the wait after the previous
+// one, or 0 when the previous refresh succeeded.
+func (r SPMetadataRefresher) backOff(previous time.Duration) time.Duration {
+	if previous <= 0 {
+		return r.minInterval()
+	}
+	if previous >= r.maxInterval()/2 {
+		return r.maxInterval()
+	}
+	return 2 * previous
+}
+
+func (r SPMetadataRefresher) clamp(d time.Duration) time.Duration {
+	if d < r.minInterval() {
+		return r.minInterval()
+	}
+	if d > r.maxInterval() {
+		return r.maxInterval()
+	}
+	return d
+}
+
+func (r SPMetadataRefresher) interval() time.Duration {
+	if r.Interval > 0 {
+		return r.Interval
+	}
+	return DefaultRefreshInterval
+}
+
+func (r SPMetadataRefresher) minInterval() time.Duration {
+	if r.MinInterval > 0 {
+		return r.MinInterval
+	}
+	return DefaultMinRefreshInterval
+}
+
+func (r SPMetadataRefresher) maxInterval() time.Duration {
+	if r.MaxInterval > 0 {
+		return r.MaxInterval
+	}
+	return DefaultMaxRefreshInterval
+}
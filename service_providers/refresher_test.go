@@ -0,0 +1,209 @@
+package service_providers_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/service_providers"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/DennisDenuto/saml-idp/service_providers/service_providersfakes"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/onsi/gomega/ghttp"
+)
+
+var _ = Describe("Refresher", func() {
+	Describe("SPMetadataCacheInfo", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+		})
+
+		It("should parse ETag and Cache-Control headers", func() {
+			header := http.Header{}
+			header.Set("ETag", `"v1"`)
+			header.Set("Cache-Control", "public, max-age=600")
+
+			info := NewSPMetadataCacheInfo(header)
+			Expect(info.ETag).To(Equal(`"v1"`))
+			Expect(info.MaxAge).To(Equal(10 * time.Minute))
+			Expect(info.NoCache).To(BeFalse())
+		})
+
+		It("should refresh after the shortest of max-age, cacheDuration and validUntil", func() {
+			info := SPMetadataCacheInfo{
+				MaxAge:        time.Hour,
+				CacheDuration: 30 * time.Minute,
+				ValidUntil:    now.Add(2 * time.Hour),
+			}
+			Expect(info.RefreshAfter(now, 6*time.Hour)).To(Equal(30 * time.Minute))
+
+			info.ValidUntil = now.Add(10 * time.Minute)
+			Expect(info.RefreshAfter(now, 6*time.Hour)).To(Equal(10 * time.Minute))
+		})
+
+		It("should fall back to the default interval without hints", func() {
+			Expect(SPMetadataCacheInfo{}.RefreshAfter(now, 6*time.Hour)).To(Equal(6 * time.Hour))
+		})
+
+		It("should refresh immediately when caching is disallowed", func() {
+			info := NewSPMetadataCacheInfo(http.Header{"Cache-Control": []string{"no-cache"}})
+			Expect(info.RefreshAfter(now, 6*time.Hour)).To(BeZero())
+		})
+	})
+
+	Describe("SPMetadataConfigurerStore RefreshSP", func() {
+		var store *service_providersfakes.FakeStore
+		var server *ghttp.Server
+		var configurer SPMetadataConfigurerStore
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			store = &service_providersfakes.FakeStore{}
+			configurer = SPMetadataConfigurerStore{Store: store}
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		It("should store changed metadata and return its etag", func() {
+			server.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/metadata"),
+				ghttp.RespondWith(200, SamlSPMetadataContent(), http.Header{"ETag": []string{`"v2"`}}),
+			))
+
+			info, err := configurer.RefreshSP("sp_id", fmt.Sprintf("%s/metadata", server.URL()), `"v1"`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.ETag).To(Equal(`"v2"`))
+			Expect(info.NotModified).To(BeFalse())
+			Expect(server.ReceivedRequests()[0].Header.Get("If-None-Match")).To(Equal(`"v1"`))
+
+			Expect(store.PutCallCount()).To(Equal(1))
+			key, value := store.PutArgsForCall(0)
+			Expect(key).To(Equal("/services/sp_id"))
+			Expect(SamlSPMetadataToString(value.(*samlidp.Service))).To(Equal(SamlSPMetadataContent()))
+		})
+
+		It("should leave the store untouched when metadata is not modified", func() {
+			server.AppendHandlers(ghttp.RespondWith(304, ""))
+
+			info, err := configurer.RefreshSP("sp_id", fmt.Sprintf("%s/metadata", server.URL()), `"v1"`)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.NotModified).To(BeTrue())
+			Expect(store.PutCallCount()).To(Equal(0))
+		})
+
+		It("should return an error and leave the store untouched when the server fails", func() {
+			server.AppendHandlers(ghttp.RespondWith(500, SamlSPMetadataContent()))
+
+			_, err := configurer.RefreshSP("sp_id", fmt.Sprintf("%s/metadata", server.URL()), "")
+			Expect(err).To(MatchError("RefreshSP unexpected status fetching metadata xml: 500 Internal Server Error"))
+			Expect(store.PutCallCount()).To(Equal(0))
+		})
+	})
+
+	Describe("SPMetadataRefresher", func() {
+		var configurer *service_providersfakes.FakeSPMetadataConfigurer
+		var refresher SPMetadataRefresher
+		var stop chan struct{}
+		var done chan struct{}
+
+		BeforeEach(func() {
+			configurer = &service_providersfakes.FakeSPMetadataConfigurer{}
+			refresher = SPMetadataRefresher{
+				MetadataURLs: map[string]string{
+					"sp_id": "http://sp/metadata",
+				},
+				SpMetadataConfigurer: configurer,
+				Interval:             10 * time.Millisecond,
+				MinInterval:          10 * time.Millisecond,
+				MaxInterval:          time.Second,
+				Logger:               logger.DefaultLogger,
+			}
+			stop = make(chan struct{})
+			done = make(chan struct{})
+		})
+
+		JustBeforeEach(func() {
+			go func(refresher SPMetadataRefresher) {
+				refresher.Run(stop)
+				close(done)
+			}(refresher)
+		})
+
+		AfterEach(func() {
+			close(stop)
+			Eventually(done).Should(BeClosed())
+		})
+
+		Context("when metadata is served with an etag", func() {
+			BeforeEach(func() {
+				configurer.RefreshSPReturns(SPMetadataCacheInfo{ETag: `"v1"`}, nil)
+			})
+
+			It("should periodically refresh, sending back the last etag", func() {
+				Eventually(configurer.RefreshSPCallCount).Should(BeNumerically(">=", 2))
+
+				spID, url, etag := configurer.RefreshSPArgsForCall(0)
+				Expect(spID).To(Equal("sp_id"))
+				Expect(url).To(Equal("http://sp/metadata"))
+				Expect(etag).To(BeEmpty())
+
+				_, _, etag = configurer.RefreshSPArgsForCall(1)
+				Expect(etag).To(Equal(`"v1"`))
+			})
+		})
+
+		Context("when the bootstrap fetch returned caching hints", func() {
+			BeforeEach(func() {
+				refresher.Interval = time.Hour
+				refresher.CacheInfos = map[string]SPMetadataCacheInfo{
+					"sp_id": {ETag: `"v0"`, MaxAge: 20 * time.Millisecond},
+				}
+				configurer.RefreshSPReturns(SPMetadataCacheInfo{ETag: `"v0"`, NotModified: true}, nil)
+			})
+
+			It("should honour them on the first refresh", func() {
+				Eventually(configurer.RefreshSPCallCount).Should(BeNumerically(">=", 1))
+
+				_, _, etag := configurer.RefreshSPArgsForCall(0)
+				Expect(etag).To(Equal(`"v0"`))
+			})
+		})
+
+		Context("when refreshes keep failing", func() {
+			BeforeEach(func() {
+				configurer.RefreshSPReturns(SPMetadataCacheInfo{}, errors.New("boom"))
+			})
+
+			It("should wait longer after each failure", func() {
+				Eventually(configurer.RefreshSPCallCount).Should(BeNumerically(">=", 2))
+				// 10ms, 20ms, 40ms, 80ms and 160ms after the first refresh at 10ms.
+				Consistently(configurer.RefreshSPCallCount, 300*time.Millisecond).Should(BeNumerically("<=", 7))
+			})
+		})
+
+		Context("when a refresh fails", func() {
+			BeforeEach(func() {
+				calls := 0
+				configurer.RefreshSPStub = func(string, string, string) (SPMetadataCacheInfo, error) {
+					calls++
+					if calls == 1 {
+						return SPMetadataCacheInfo{}, errors.New("boom")
+					}
+					return SPMetadataCacheInfo{}, nil
+				}
+			})
+
+			It("should keep retrying", func() {
+				Eventually(configurer.RefreshSPCallCount).Should(BeNumerically(">=", 2))
+			})
+		})
+	})
+})
@@ -0,0 +1,120 @@
+package service_providers
+
+import (
+	"sort"
+	"sync"
+)
+
+// ServiceIndex maps the entityID of each configured SP to the name its service is
+// stored under, so an SP can be found from the Issuer of its AuthnRequest as well
+// as by the friendly name used in the config file and the /services API. It also
+// remembers which sp_metadata_urls entry each service was stored from.
+type ServiceIndex struct {
+	mu      sync.RWMutex
+	names   map[string]string
+	sources map[string]map[string]bool
+}
+
+func NewServiceIndex() *ServiceIndex {
+	return &ServiceIndex{
+		names:   map[string]string{},
+		sources: map[string]map[string]bool{},
+	}
+}
+
+// Add indexes the service stored as name under entityID. If entityID was already
+// indexed under a different name, that name is returned.
+func (i *ServiceIndex) Add(name string, entityID string) (previousName string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	previousName = i.names[entityID]
+	i.names[entityID] = name
+	if previousName == name {
+		return ""
+	}
+	return previousName
+}
+
+// Name returns the name of the service with the given entityID.
+func (i *ServiceIndex) Name(entityID string) (string, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	name, ok := i.names[entityID]
+	return name, ok
+}
+
+// AddSource records that the service stored as name came from the SP configured as spId.
+func (i *ServiceIndex) AddSource(spId string, name string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.sources[spId] == nil {
+		i.sources[spId] = map[string]bool{}
+	}
+	i.sources[spId][name] = true
+}
+
+// RemoveSource forgets the SP configured as spId and returns the names of the services
+// stored from it that no other configured SP provides, so they can be deleted.
+func (i *ServiceIndex) RemoveSource(spId string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	names := i.sources[spId]
+	delete(i.sources, spId)
+	return i.removeUnsourced(names)
+}
+
+// ReplaceSource records that the services stored as names are all the SP configured as
+// spId provides now, and returns the names it no longer provides that no other
+// configured SP does either, so they can be deleted.
+func (i *ServiceIndex) ReplaceSource(spId string, names []string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	previous := i.sources[spId]
+	current := map[string]bool{}
+	for _, name := range names {
+		current[name] = true
+	}
+	i.sources[spId] = current
+	return i.removeUnsourced(previous)
+}
+
+// HasSource returns whether any configured SP provides the service stored as name.
+func (i *ServiceIndex) HasSource(name string) bool {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	return i.hasSource(name)
+}
+
+// removeUnsourced forgets the entityIDs of the given services that no configured SP
+// provides any more and returns their names. i.mu must be held.
+func (i *ServiceIndex) removeUnsourced(names map[string]bool) []string {
+	removed := []string{}
+	for name := range names {
+		if i.hasSource(name) {
+			continue
+		}
+		removed = append(removed, name)
+		for entityID, indexedName := range i.names {
+			if indexedName == name {
+				delete(i.names, entityID)
+			}
+		}
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+func (i *ServiceIndex) hasSource(name string) bool {
+	for _, names := range i.sources {
+		if names[name] {
+			return true
+		}
+	}
+	return false
+}
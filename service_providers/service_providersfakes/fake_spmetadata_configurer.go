@@ -8,20 +8,32 @@ import (
 )
 
 type FakeSPMetadataConfigurer struct {
-	AddSPStub        func(string, string) error
+	AddSPStub        func(string, string) (service_providers.SPMetadataCacheInfo, error)
 	addSPMutex       sync.RWMutex
 	addSPArgsForCall []struct {
 		arg1 string
 		arg2 string
 	}
 	addSPReturns struct {
-		result1 error
+		result1 service_providers.SPMetadataCacheInfo
+		result2 error
+	}
+	RefreshSPStub        func(string, string, string) (service_providers.SPMetadataCacheInfo, error)
+	refreshSPMutex       sync.RWMutex
+	refreshSPArgsForCall []struct {
+		arg1 string
+		arg2 string
+		arg3 string
+	}
+	refreshSPReturns struct {
+		result1 service_providers.SPMetadataCacheInfo
+		result2 error
 	}
 	invocations      map[string][][]interface{}
 	invocationsMutex sync.RWMutex
 }
 
-func (fake *FakeSPMetadataConfigurer) AddSP(arg1 string, arg2 string) error {
+func (fake *FakeSPMetadataConfigurer) AddSP(arg1 string, arg2 string) (service_providers.SPMetadataCacheInfo, error) {
 	fake.addSPMutex.Lock()
 	fake.addSPArgsForCall = append(fake.addSPArgsForCall, struct {
 		arg1 string
@@ -32,7 +44,7 @@ func (fake *FakeSPMetadataConfigurer) AddSP(arg1 string, arg2 string) error {
 	if fake.AddSPStub != nil {
 		return fake.AddSPStub(arg1, arg2)
 	} else {
-		return fake.addSPReturns.result1
+		return fake.addSPReturns.result1, fake.addSPReturns.result2
 	}
 }
 
@@ -48,11 +60,48 @@ func (fake *FakeSPMetadataConfigurer) AddSPArgsForCall(i int) (string, string) {
 	return fake.addSPArgsForCall[i].arg1, fake.addSPArgsForCall[i].arg2
 }
 
-func (fake *FakeSPMetadataConfigurer) AddSPReturns(result1 error) {
+func (fake *FakeSPMetadataConfigurer) AddSPReturns(result1 service_providers.SPMetadataCacheInfo, result2 error) {
 	fake.AddSPStub = nil
 	fake.addSPReturns = struct {
-		result1 error
-	}{result1}
+		result1 service_providers.SPMetadataCacheInfo
+		result2 error
+	}{result1, result2}
+}
+
+func (fake *FakeSPMetadataConfigurer) RefreshSP(arg1 string, arg2 string, arg3 string) (service_providers.SPMetadataCacheInfo, error) {
+	fake.refreshSPMutex.Lock()
+	fake.refreshSPArgsForCall = append(fake.refreshSPArgsForCall, struct {
+		arg1 string
+		arg2 string
+		arg3 string
+	}{arg1, arg2, arg3})
+	fake.recordInvocation("RefreshSP", []interface{}{arg1, arg2, arg3})
+	fake.refreshSPMutex.Unlock()
+	if fake.RefreshSPStub != nil {
+		return fake.RefreshSPStub(arg1, arg2, arg3)
+	} else {
+		return fake.refreshSPReturns.result1, fake.refreshSPReturns.result2
+	}
+}
+
+func (fake *FakeSPMetadataConfigurer) RefreshSPCallCount() int {
+	fake.refreshSPMutex.RLock()
+	defer fake.refreshSPMutex.RUnlock()
+	return len(fake.refreshSPArgsForCall)
+}
+
+func (fake *FakeSPMetadataConfigurer) RefreshSPArgsForCall(i int) (string, string, string) {
+	fake.refreshSPMutex.RLock()
+	defer fake.refreshSPMutex.RUnlock()
+	return fake.refreshSPArgsForCall[i].arg1, fake.refreshSPArgsForCall[i].arg2, fake.refreshSPArgsForCall[i].arg3
+}
+
+func (fake *FakeSPMetadataConfigurer) RefreshSPReturns(result1 service_providers.SPMetadataCacheInfo, result2 error) {
+	fake.RefreshSPStub = nil
+	fake.refreshSPReturns = struct {
+		result1 service_providers.SPMetadataCacheInfo
+		result2 error
+	}{result1, result2}
 }
 
 func (fake *FakeSPMetadataConfigurer) Invocations() map[string][][]interface{} {
@@ -60,6 +109,8 @@ func (fake *FakeSPMetadataConfigurer) Invocations() map[string][][]interface{} {
 	defer fake.invocationsMutex.RUnlock()
 	fake.addSPMutex.RLock()
 	defer fake.addSPMutex.RUnlock()
+	fake.refreshSPMutex.RLock()
+	defer fake.refreshSPMutex.RUnlock()
 	return fake.invocations
 }
 
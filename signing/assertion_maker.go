@@ -0,0 +1,152 @@
+package signing
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/xmlenc"
+)
+
+// AssertionMaker makes assertions with the wrapped saml.AssertionMaker, or
+// saml.DefaultAssertionMaker when it is nil. The saml package can only sign with
+// RSA keys, so when the IdP key is an ECDSA key the assertion and the response are
+// signed and assembled here, leaving the saml package to just write the response.
+// With Keys set they are always signed here, with the active key of the ring.
+type AssertionMaker struct {
+	saml.AssertionMaker
+	Keys *KeyRing
+}
+
+func (m AssertionMaker) MakeAssertion(req *saml.IdpAuthnRequest, session *saml.Session) error {
+	assertionMaker := m.AssertionMaker
+	if assertionMaker == nil {
+		assertionMaker = saml.DefaultAssertionMaker{}
+	}
+	if err := assertionMaker.MakeAssertion(req, session); err != nil {
+		return err
+	}
+
+	var signer Signer
+	if m.Keys != nil {
+		activeKey := m.Keys.Active()
+		signer = Signer{Key: activeKey.Signer, Certificate: activeKey.Certificate}
+	} else if key, ok := req.IDP.Key.(*ecdsa.PrivateKey); ok {
+		signer = Signer{Key: key, Certificate: req.IDP.Certificate}
+	} else {
+		return nil
+	}
+	if err := makeAssertionEl(req, signer); err != nil {
+		return err
+	}
+	return makeResponseEl(req, signer)
+}
+
+// makeAssertionEl does what IdpAuthnRequest.MakeAssertionEl does, signing with signer.
+func makeAssertionEl(req *saml.IdpAuthnRequest, signer Signer) error {
+	signature, err := signer.Sign(req.Assertion.Element())
+	if err != nil {
+		return err
+	}
+	req.Assertion.Signature = signature
+	signedAssertionEl := req.Assertion.Element()
+
+	encryptionCert, err := spEncryptionCert(req.SPSSODescriptor)
+	if err != nil {
+		return err
+	}
+	if encryptionCert == nil {
+		req.AssertionEl = signedAssertionEl
+		return nil
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(signedAssertionEl)
+	signedAssertionBuf, err := doc.WriteToBytes()
+	if err != nil {
+		return err
+	}
+
+	encryptor := xmlenc.OAEP()
+	encryptor.BlockCipher = xmlenc.AES128CBC
+	encryptor.DigestMethod = &xmlenc.SHA1
+	encryptedDataEl, err := encryptor.Encrypt(encryptionCert, signedAssertionBuf)
+	if err != nil {
+		return err
+	}
+	encryptedDataEl.CreateAttr("Type", "http://www.w3.org/2001/04/xmlenc#Element")
+
+	encryptedAssertionEl := etree.NewElement("saml:EncryptedAssertion")
+	encryptedAssertionEl.AddChild(encryptedDataEl)
+	req.AssertionEl = encryptedAssertionEl
+	return nil
+}
+
+// makeResponseEl does what IdpAuthnRequest.MakeResponse does, signing with signer.
+func makeResponseEl(req *saml.IdpAuthnRequest, signer Signer) error {
+	response := &saml.Response{
+		Destination:  req.ACSEndpoint.Location,
+		ID:           fmt.Sprintf("id-%x", randomBytes(20)),
+		InResponseTo: req.Request.ID,
+		IssueInstant: req.Now,
+		Version:      "2.0",
+		Issuer: &saml.Issuer{
+			Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:entity",
+			Value:  req.IDP.MetadataURL.String(),
+		},
+		Status: saml.Status{
+			StatusCode: saml.StatusCode{
+				Value: saml.StatusSuccess,
+			},
+		},
+	}
+
+	responseEl := response.Element()
+	responseEl.AddChild(req.AssertionEl)
+	signature, err := signer.Sign(responseEl)
+	if err != nil {
+		return err
+	}
+
+	response.Signature = signature
+	responseEl = response.Element()
+	responseEl.AddChild(req.AssertionEl)
+	req.ResponseEl = responseEl
+	return nil
+}
+
+// spEncryptionCert returns the certificate the SP wants assertions encrypted with, or
+// nil when it does not publish one.
+func spEncryptionCert(spSSODescriptor *saml.SPSSODescriptor) (*x509.Certificate, error) {
+	certStr := ""
+	for _, keyDescriptor := range spSSODescriptor.KeyDescriptors {
+		if keyDescriptor.Use == "encryption" {
+			certStr = keyDescriptor.KeyInfo.Certificate
+			break
+		}
+	}
+	if certStr == "" {
+		for _, keyDescriptor := range spSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use == "" && keyDescriptor.KeyInfo.Certificate != "" {
+				certStr = keyDescriptor.KeyInfo.Certificate
+				break
+			}
+		}
+	}
+	if certStr == "" {
+		return nil, nil
+	}
+
+	return parseKeyInfoCertificate(certStr)
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
@@ -0,0 +1,109 @@
+package signing_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/signing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/crewjam/saml"
+)
+
+var _ = Describe("AssertionMaker", func() {
+	var req *saml.IdpAuthnRequest
+	var session *saml.Session
+
+	BeforeEach(func() {
+		idpURL, err := url.Parse("https://idp.example.com/metadata")
+		Expect(err).NotTo(HaveOccurred())
+		httpRequest, err := http.NewRequest("GET", "https://idp.example.com/sso", nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		req = &saml.IdpAuthnRequest{
+			IDP: &saml.IdentityProvider{
+				MetadataURL: *idpURL,
+				SSOURL:      *idpURL,
+			},
+			HTTPRequest:             httpRequest,
+			Request:                 saml.AuthnRequest{ID: "id-request"},
+			ServiceProviderMetadata: &saml.EntityDescriptor{EntityID: "https://sp.example.com"},
+			SPSSODescriptor:         &saml.SPSSODescriptor{},
+			ACSEndpoint:             &saml.IndexedEndpoint{Binding: saml.HTTPPostBinding, Location: "https://sp.example.com/acs"},
+			Now:                     time.Now(),
+		}
+		session = &saml.Session{ID: "session", NameID: "bob", UserName: "bob"}
+	})
+
+	Context("when the IdP key is an ECDSA key", func() {
+		BeforeEach(func() {
+			key, err := ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.IDP.Key = key
+			req.IDP.Certificate = readCertificate("ec.crt")
+		})
+
+		It("should sign the assertion and the response", func() {
+			Expect(AssertionMaker{}.MakeAssertion(req, session)).To(Succeed())
+
+			Expect(req.Assertion.Subject.NameID.Value).To(Equal("bob"))
+			VerifyECDSASignature(req.AssertionEl, req.IDP.Certificate)
+
+			Expect(req.ResponseEl.SelectElement("Assertion")).NotTo(BeNil())
+			response := req.ResponseEl.Copy()
+			VerifyECDSASignature(response, req.IDP.Certificate)
+			Expect(response.SelectAttrValue("InResponseTo", "")).To(Equal("id-request"))
+		})
+
+		It("should let the saml package write the response", func() {
+			Expect(AssertionMaker{}.MakeAssertion(req, session)).To(Succeed())
+
+			recorder := httptest.NewRecorder()
+			Expect(req.WriteResponse(recorder)).To(Succeed())
+			Expect(recorder.Body.String()).To(ContainSubstring(`action="https://sp.example.com/acs"`))
+		})
+	})
+
+	Context("when the IdP key is an RSA key", func() {
+		BeforeEach(func() {
+			key, err := ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.IDP.Key = key
+			req.IDP.Certificate = readCertificate("rsa.crt")
+		})
+
+		It("should leave signing to the saml package", func() {
+			Expect(AssertionMaker{}.MakeAssertion(req, session)).To(Succeed())
+			Expect(req.Assertion).NotTo(BeNil())
+			Expect(req.AssertionEl).To(BeNil())
+			Expect(req.ResponseEl).To(BeNil())
+		})
+	})
+
+	Context("when a key ring is given", func() {
+		BeforeEach(func() {
+			key, err := ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.IDP.Key = key
+			req.IDP.Certificate = readCertificate("rsa.crt")
+		})
+
+		It("should sign with the active key of the ring", func() {
+			ecKey, err := ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+			Expect(err).NotTo(HaveOccurred())
+			keyRing, err := NewKeyRing([]Key{
+				{State: KeyStateRetired, Signer: req.IDP.Key.(*rsa.PrivateKey), Certificate: req.IDP.Certificate},
+				{State: KeyStateActive, Signer: ecKey, Certificate: readCertificate("ec.crt")},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(AssertionMaker{Keys: keyRing}.MakeAssertion(req, session)).To(Succeed())
+			VerifyECDSASignature(req.AssertionEl, readCertificate("ec.crt"))
+			VerifyECDSASignature(req.ResponseEl.Copy(), readCertificate("ec.crt"))
+		})
+	})
+})
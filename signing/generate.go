@@ -0,0 +1,91 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	KeyTypeRSA = "rsa"
+	KeyTypeEC  = "ec"
+
+	DefaultValidity = 365 * 24 * time.Hour
+)
+
+// GenerateOptions describes a self-signed certificate. KeyType is "rsa", a 2048 bit
+// RSA key and the default, or "ec", a P-256 key. SANs holds DNS names and IP addresses.
+type GenerateOptions struct {
+	KeyType    string
+	CommonName string
+	SANs       []string
+	Validity   time.Duration
+}
+
+// GenerateKeyPair creates a private key and a self-signed certificate for it, returning
+// the PEM encoded certificate and PKCS#8 private key.
+func GenerateKeyPair(options GenerateOptions) (certPEM []byte, keyPEM []byte, err error) {
+	var key crypto.Signer
+	keyUsage := x509.KeyUsageDigitalSignature
+	switch options.KeyType {
+	case "", KeyTypeRSA:
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+		keyUsage |= x509.KeyUsageKeyEncipherment
+	case KeyTypeEC:
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, nil, errors.Errorf("unsupported key type %q, expected rsa or ec", options.KeyType)
+	}
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot generate private key")
+	}
+
+	validity := options.Validity
+	if validity == 0 {
+		validity = DefaultValidity
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	notBefore := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serialNumber,
+		Subject:               pkix.Name{CommonName: options.CommonName},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, san := range options.SANs {
+		if ip := net.ParseIP(san); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, san)
+		}
+	}
+
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot create certificate")
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot marshal private key")
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
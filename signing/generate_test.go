@@ -0,0 +1,58 @@
+package signing_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/signing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"time"
+)
+
+var _ = Describe("GenerateKeyPair", func() {
+	parse := func(certPEM, keyPEM []byte) (*x509.Certificate, interface{}) {
+		block, _ := pem.Decode(certPEM)
+		Expect(block).NotTo(BeNil())
+		cert, err := x509.ParseCertificate(block.Bytes)
+		Expect(err).NotTo(HaveOccurred())
+
+		key, err := ParsePrivateKey(keyPEM, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(CheckKeyMatchesCertificate(key, cert)).To(Succeed())
+		return cert, key
+	}
+
+	It("should generate an RSA key and self-signed certificate by default", func() {
+		certPEM, keyPEM, err := GenerateKeyPair(GenerateOptions{
+			CommonName: "idp.example.com",
+			SANs:       []string{"idp.example.com", "127.0.0.1"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, key := parse(certPEM, keyPEM)
+		Expect(key).To(BeAssignableToTypeOf(&rsa.PrivateKey{}))
+		Expect(cert.Subject.CommonName).To(Equal("idp.example.com"))
+		Expect(cert.DNSNames).To(Equal([]string{"idp.example.com"}))
+		Expect(cert.IPAddresses[0].Equal(net.ParseIP("127.0.0.1"))).To(BeTrue())
+		Expect(cert.NotAfter).To(BeTemporally("~", time.Now().Add(DefaultValidity), time.Minute))
+		Expect(cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)).To(Succeed())
+	})
+
+	It("should generate an EC key with the given validity", func() {
+		certPEM, keyPEM, err := GenerateKeyPair(GenerateOptions{KeyType: KeyTypeEC, CommonName: "localhost", Validity: time.Hour})
+		Expect(err).NotTo(HaveOccurred())
+
+		cert, key := parse(certPEM, keyPEM)
+		Expect(key).To(BeAssignableToTypeOf(&ecdsa.PrivateKey{}))
+		Expect(cert.NotAfter).To(BeTemporally("~", time.Now().Add(time.Hour), time.Minute))
+	})
+
+	It("should reject an unknown key type", func() {
+		_, _, err := GenerateKeyPair(GenerateOptions{KeyType: "dsa"})
+		Expect(err).To(MatchError(`unsupported key type "dsa", expected rsa or ec`))
+	})
+})
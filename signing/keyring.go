@@ -0,0 +1,139 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"sync"
+
+	"github.com/crewjam/saml"
+	"github.com/pkg/errors"
+)
+
+// KeyState is where a signing key is in a rollover. The next key is published so SPs
+// can start trusting it, the active key signs, and a retired key stays published until
+// SPs have picked up the active one.
+type KeyState string
+
+const (
+	KeyStateNext    KeyState = "next"
+	KeyStateActive  KeyState = "active"
+	KeyStateRetired KeyState = "retired"
+)
+
+type Key struct {
+	State       KeyState
+	Signer      crypto.Signer
+	Certificate *x509.Certificate
+}
+
+// KeyRing holds the IdP signing keys during a rollover.
+type KeyRing struct {
+	mu   sync.RWMutex
+	keys []Key
+}
+
+func NewKeyRing(keys []Key) (*KeyRing, error) {
+	keyRing := &KeyRing{}
+	return keyRing, keyRing.Set(keys)
+}
+
+// Set replaces the keys. Exactly one key must be active and at most one next.
+func (k *KeyRing) Set(keys []Key) error {
+	counts := map[KeyState]int{}
+	for _, key := range keys {
+		switch key.State {
+		case KeyStateNext, KeyStateActive, KeyStateRetired:
+			counts[key.State]++
+		default:
+			return errors.Errorf("unknown signing key state %q", key.State)
+		}
+	}
+	if counts[KeyStateActive] != 1 {
+		return errors.Errorf("expected exactly one active signing key, found %d", counts[KeyStateActive])
+	}
+	if counts[KeyStateNext] > 1 {
+		return errors.Errorf("expected at most one next signing key, found %d", counts[KeyStateNext])
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = append([]Key{}, keys...)
+	return nil
+}
+
+// Active returns the key assertions are signed with.
+func (k *KeyRing) Active() Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	for _, key := range k.keys {
+		if key.State == KeyStateActive {
+			return key
+		}
+	}
+	return Key{}
+}
+
+// Keys returns every key, all of which are published in the metadata.
+func (k *KeyRing) Keys() []Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]Key{}, k.keys...)
+}
+
+// Promote makes the next key active and retires the active one.
+func (k *KeyRing) Promote() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	next := -1
+	for i, key := range k.keys {
+		if key.State == KeyStateNext {
+			next = i
+		}
+	}
+	if next == -1 {
+		return errors.New("there is no next signing key to promote")
+	}
+
+	for i, key := range k.keys {
+		if key.State == KeyStateActive {
+			k.keys[i].State = KeyStateRetired
+		}
+	}
+	k.keys[next].State = KeyStateActive
+	return nil
+}
+
+// KeyDescriptors returns a signing KeyDescriptor for every key.
+func (k *KeyRing) KeyDescriptors() []saml.KeyDescriptor {
+	keyDescriptors := []saml.KeyDescriptor{}
+	for _, key := range k.Keys() {
+		keyDescriptors = append(keyDescriptors, saml.KeyDescriptor{
+			Use:     "signing",
+			KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(key.Certificate.Raw)},
+		})
+	}
+	return keyDescriptors
+}
+
+// EncryptionKeyDescriptors returns the encryption KeyDescriptor for the key the IdP
+// decrypts with, which is only published for an RSA key as assertions are encrypted
+// with RSA-OAEP. It does not follow the KeyRing, since promotion leaves IDP.Key as is.
+func EncryptionKeyDescriptors(key crypto.PrivateKey, certificate *x509.Certificate) []saml.KeyDescriptor {
+	if _, ok := key.(*rsa.PrivateKey); !ok || certificate == nil {
+		return nil
+	}
+	return []saml.KeyDescriptor{{
+		Use:     "encryption",
+		KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(certificate.Raw)},
+		EncryptionMethods: []saml.EncryptionMethod{
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes128-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes192-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#aes256-cbc"},
+			{Algorithm: "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"},
+		},
+	}}
+}
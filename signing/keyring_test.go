@@ -0,0 +1,69 @@
+package signing_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/signing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/base64"
+)
+
+var _ = Describe("KeyRing", func() {
+	var rsaKey, ecKey Key
+
+	BeforeEach(func() {
+		signer, err := ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		rsaKey = Key{State: KeyStateActive, Signer: signer, Certificate: readCertificate("rsa.crt")}
+
+		signer, err = ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		ecKey = Key{State: KeyStateNext, Signer: signer, Certificate: readCertificate("ec.crt")}
+	})
+
+	It("should require exactly one active key", func() {
+		_, err := NewKeyRing([]Key{ecKey})
+		Expect(err).To(MatchError("expected exactly one active signing key, found 0"))
+	})
+
+	It("should reject unknown states", func() {
+		rsaKey.State = "primary"
+		_, err := NewKeyRing([]Key{rsaKey})
+		Expect(err).To(MatchError(`unknown signing key state "primary"`))
+	})
+
+	It("should promote the next key and retire the active one", func() {
+		keyRing, err := NewKeyRing([]Key{rsaKey, ecKey})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keyRing.Active().Certificate).To(Equal(rsaKey.Certificate))
+
+		Expect(keyRing.Promote()).To(Succeed())
+		Expect(keyRing.Active().Certificate).To(Equal(ecKey.Certificate))
+		Expect(keyRing.Keys()[0].State).To(Equal(KeyStateRetired))
+
+		Expect(keyRing.Promote()).To(MatchError("there is no next signing key to promote"))
+	})
+
+	It("should publish every key for signing", func() {
+		keyRing, err := NewKeyRing([]Key{rsaKey, ecKey})
+		Expect(err).NotTo(HaveOccurred())
+
+		keyDescriptors := keyRing.KeyDescriptors()
+		Expect(keyDescriptors).To(HaveLen(2))
+		Expect(keyDescriptors[0].Use).To(Equal("signing"))
+		Expect(keyDescriptors[0].KeyInfo.Certificate).To(Equal(base64.StdEncoding.EncodeToString(rsaKey.Certificate.Raw)))
+		Expect(keyDescriptors[1].Use).To(Equal("signing"))
+		Expect(keyDescriptors[1].KeyInfo.Certificate).To(Equal(base64.StdEncoding.EncodeToString(ecKey.Certificate.Raw)))
+	})
+
+	It("should publish an RSA decryption key for encryption", func() {
+		keyDescriptors := EncryptionKeyDescriptors(rsaKey.Signer, rsaKey.Certificate)
+		Expect(keyDescriptors).To(HaveLen(1))
+		Expect(keyDescriptors[0].Use).To(Equal("encryption"))
+		Expect(keyDescriptors[0].KeyInfo.Certificate).To(Equal(base64.StdEncoding.EncodeToString(rsaKey.Certificate.Raw)))
+	})
+
+	It("should not publish an EC key for encryption", func() {
+		Expect(EncryptionKeyDescriptors(ecKey.Signer, ecKey.Certificate)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,89 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/pkg/errors"
+)
+
+// ParsePrivateKey parses a PEM encoded PKCS#1 RSA, PKCS#8 or SEC1 EC private key.
+// Keys protected with a passphrase, either as a legacy "Proc-Type: 4,ENCRYPTED" block
+// or as a PKCS#8 "ENCRYPTED PRIVATE KEY", are decrypted with passphrase.
+func ParsePrivateKey(pemBytes []byte, passphrase []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no pem block found")
+	}
+
+	der := block.Bytes
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if len(passphrase) == 0 {
+			return nil, errors.New("private key is encrypted but no passphrase was given")
+		}
+		var err error
+		der, err = decryptPKCS8(der, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		return parsePKCS8PrivateKey(der)
+	case x509.IsEncryptedPEMBlock(block):
+		if len(passphrase) == 0 {
+			return nil, errors.New("private key is encrypted but no passphrase was given")
+		}
+		var err error
+		der, err = x509.DecryptPEMBlock(block, passphrase)
+		if err != nil {
+			return nil, errors.Wrap(err, "cannot decrypt private key")
+		}
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		return parsePKCS8PrivateKey(der)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := parsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.Errorf("unsupported private key pem block %q, expected a PKCS#1, PKCS#8 or SEC1 EC private key", block.Type)
+}
+
+func parsePKCS8PrivateKey(der []byte) (crypto.Signer, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, errors.Errorf("unsupported private key type %T, only RSA and ECDSA keys are supported", key)
+}
+
+// CheckKeyMatchesCertificate returns an error unless key is the private key for cert.
+func CheckKeyMatchesCertificate(key crypto.Signer, cert *x509.Certificate) error {
+	publicKey, ok := key.Public().(interface {
+		Equal(crypto.PublicKey) bool
+	})
+	if !ok || !publicKey.Equal(cert.PublicKey) {
+		return errors.New("private key does not match the certificate")
+	}
+	return nil
+}
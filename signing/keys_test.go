@@ -0,0 +1,78 @@
+package signing_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/signing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/onsi/ginkgo/extensions/table"
+)
+
+var _ = Describe("Keys", func() {
+	table.DescribeTable("parsing private keys", func(keyFile string, passphrase string, keyType crypto.Signer) {
+		key, err := ParsePrivateKey(readFixture(keyFile), []byte(passphrase))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(BeAssignableToTypeOf(keyType))
+	},
+		table.Entry("PKCS#1 RSA", "rsa-pkcs1.key", "", &rsa.PrivateKey{}),
+		table.Entry("PKCS#8 RSA", "rsa-pkcs8.key", "", &rsa.PrivateKey{}),
+		table.Entry("SEC1 EC", "ec-sec1.key", "", &ecdsa.PrivateKey{}),
+		table.Entry("PKCS#8 EC", "ec-pkcs8.key", "", &ecdsa.PrivateKey{}),
+		table.Entry("encrypted PKCS#1 RSA", "rsa-pkcs1-encrypted.key", "passphrase", &rsa.PrivateKey{}),
+		table.Entry("encrypted PKCS#8 EC", "ec-pkcs8-encrypted.key", "passphrase", &ecdsa.PrivateKey{}),
+	)
+
+	It("should require a passphrase for encrypted keys", func() {
+		_, err := ParsePrivateKey(readFixture("ec-pkcs8-encrypted.key"), nil)
+		Expect(err).To(MatchError("private key is encrypted but no passphrase was given"))
+
+		_, err = ParsePrivateKey(readFixture("rsa-pkcs1-encrypted.key"), nil)
+		Expect(err).To(MatchError("private key is encrypted but no passphrase was given"))
+	})
+
+	It("should reject a wrong passphrase", func() {
+		_, err := ParsePrivateKey(readFixture("ec-pkcs8-encrypted.key"), []byte("wrong"))
+		Expect(err).To(HaveOccurred())
+
+		_, err = ParsePrivateKey(readFixture("rsa-pkcs1-encrypted.key"), []byte("wrong"))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should reject data without a pem block", func() {
+		_, err := ParsePrivateKey([]byte("not a key"), nil)
+		Expect(err).To(MatchError("no pem block found"))
+	})
+
+	It("should check that a key matches its certificate", func() {
+		rsaKey, err := ParsePrivateKey(readFixture("rsa-pkcs8.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		ecKey, err := ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		Expect(CheckKeyMatchesCertificate(rsaKey, readCertificate("rsa.crt"))).To(Succeed())
+		Expect(CheckKeyMatchesCertificate(ecKey, readCertificate("ec.crt"))).To(Succeed())
+		Expect(CheckKeyMatchesCertificate(ecKey, readCertificate("rsa.crt"))).To(MatchError("private key does not match the certificate"))
+	})
+})
+
+func readFixture(name string) []byte {
+	contents, err := ioutil.ReadFile(filepath.Join("fixtures", name))
+	Expect(err).NotTo(HaveOccurred())
+	return contents
+}
+
+func readCertificate(name string) *x509.Certificate {
+	block, _ := pem.Decode(readFixture(name))
+	Expect(block).NotTo(BeNil())
+	cert, err := x509.ParseCertificate(block.Bytes)
+	Expect(err).NotTo(HaveOccurred())
+	return cert
+}
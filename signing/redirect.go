@@ -0,0 +1,25 @@
+package signing
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/url"
+)
+
+// SignQuery signs a message sent with the HTTP-Redirect binding. query holds the
+// encoded SAMLRequest or SAMLResponse and RelayState parameters, in that order; the
+// SigAlg and Signature parameters are appended to it.
+func (s Signer) SignQuery(query string) (string, error) {
+	signatureMethod, err := s.signatureMethod()
+	if err != nil {
+		return "", err
+	}
+	query += "&SigAlg=" + url.QueryEscape(signatureMethod)
+
+	digest := sha256.Sum256([]byte(query))
+	signature, err := s.sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature)), nil
+}
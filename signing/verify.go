@@ -0,0 +1,261 @@
+package signing
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/pkg/errors"
+	"github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+// SPSigningCertificates returns the certificates of the signing KeyDescriptors of the
+// SP, including those without a use, which are for both signing and encryption.
+func SPSigningCertificates(metadata *saml.EntityDescriptor) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for _, spSSODescriptor := range metadata.SPSSODescriptors {
+		for _, keyDescriptor := range spSSODescriptor.KeyDescriptors {
+			if keyDescriptor.Use != "signing" && keyDescriptor.Use != "" || keyDescriptor.KeyInfo.Certificate == "" {
+				continue
+			}
+			cert, err := parseKeyInfoCertificate(keyDescriptor.KeyInfo.Certificate)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// VerifyEnvelopedSignature checks that el carries an enveloped signature over all of
+// it made with one of certs. RSA signatures are checked by the dsig package, which
+// cannot check ECDSA ones, so those are checked by verifyECDSAEnvelopedSignature.
+func VerifyEnvelopedSignature(el *etree.Element, certs []*x509.Certificate) error {
+	err := errors.New("no signing certificate")
+	for _, cert := range certs {
+		if _, ok := cert.PublicKey.(*ecdsa.PublicKey); ok {
+			if err = verifyECDSAEnvelopedSignature(el, cert); err == nil {
+				return nil
+			}
+			continue
+		}
+		validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{
+			Roots: []*x509.Certificate{cert},
+		})
+		if _, err = validationContext.Validate(el); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(err, "signature verification failed")
+}
+
+// verifyECDSAEnvelopedSignature checks an ECDSA-SHA256 enveloped signature over el
+// made with cert, of the form Signer.Sign creates: a single reference to el with the
+// enveloped signature and exclusive canonicalization transforms and a SHA-256 digest.
+func verifyECDSAEnvelopedSignature(el *etree.Element, cert *x509.Certificate) error {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return err
+	}
+	detached, err := etreeutils.NSDetatch(ctx, el)
+	if err != nil {
+		return err
+	}
+	signature := detached.SelectElement(dsig.SignatureTag)
+	if signature == nil {
+		return errors.New("element is not signed")
+	}
+	signedInfo := signature.SelectElement(dsig.SignedInfoTag)
+	if signedInfo == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+
+	signatureMethod := signedInfo.FindElement("./" + dsig.SignatureMethodTag)
+	if signatureMethod == nil || signatureMethod.SelectAttrValue(dsig.AlgorithmAttr, "") != ECDSASHA256SignatureMethod {
+		return errors.New("signature algorithm does not match the certificate key")
+	}
+	canonicalizationMethod := signedInfo.FindElement("./" + dsig.CanonicalizationMethodTag)
+	if canonicalizationMethod == nil || canonicalizationMethod.SelectAttrValue(dsig.AlgorithmAttr, "") != dsig.CanonicalXML10ExclusiveAlgorithmId.String() {
+		return errors.New("unsupported canonicalization method")
+	}
+	references := signedInfo.SelectElements(dsig.ReferenceTag)
+	if len(references) != 1 {
+		return errors.New("signature must have exactly one reference")
+	}
+	reference := references[0]
+	if uri := reference.SelectAttrValue(dsig.URIAttr, ""); uri != "" && uri != "#"+el.SelectAttrValue(dsig.DefaultIdAttr, "") {
+		return errors.New("signature does not reference the signed element")
+	}
+	if digestMethod := reference.FindElement("./" + dsig.DigestMethodTag); digestMethod == nil || digestMethod.SelectAttrValue(dsig.AlgorithmAttr, "") != SHA256DigestMethod {
+		return errors.New("unsupported digest method")
+	}
+	prefixList := ""
+	for _, transform := range reference.FindElements("./" + dsig.TransformsTag + "/" + dsig.TransformTag) {
+		switch dsig.AlgorithmID(transform.SelectAttrValue(dsig.AlgorithmAttr, "")) {
+		case dsig.EnvelopedSignatureAltorithmId:
+		case dsig.CanonicalXML10ExclusiveAlgorithmId:
+			if inclusiveNamespaces := transform.SelectElement(dsig.InclusiveNamespacesTag); inclusiveNamespaces != nil {
+				prefixList = inclusiveNamespaces.SelectAttrValue(dsig.PrefixListAttr, "")
+			}
+		default:
+			return errors.New("unsupported transform")
+		}
+	}
+
+	// SignedInfo is canonicalized with the namespaces in scope where it is, inside el.
+	signatureContext, err := ctx.SubContext(detached)
+	if err != nil {
+		return err
+	}
+	signatureContext, err = signatureContext.SubContext(signature)
+	if err != nil {
+		return err
+	}
+	detachedSignedInfo, err := etreeutils.NSDetatch(signatureContext, signedInfo)
+	if err != nil {
+		return err
+	}
+	canonicalSignedInfo, err := dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("").Canonicalize(detachedSignedInfo)
+	if err != nil {
+		return err
+	}
+	signatureValueEl := signature.SelectElement(dsig.SignatureValueTag)
+	if signatureValueEl == nil {
+		return errors.New("signature has no SignatureValue")
+	}
+	signatureValue, err := base64.StdEncoding.DecodeString(regexp.MustCompile(`\s+`).ReplaceAllString(signatureValueEl.Text(), ""))
+	if err != nil {
+		return errors.Wrap(err, "cannot decode SignatureValue")
+	}
+	if err := verifySignature(cert, ECDSASHA256SignatureMethod, canonicalSignedInfo, signatureValue); err != nil {
+		return err
+	}
+
+	digestValueEl := reference.SelectElement(dsig.DigestValueTag)
+	if digestValueEl == nil {
+		return errors.New("reference has no DigestValue")
+	}
+	digestValue, err := base64.StdEncoding.DecodeString(strings.TrimSpace(digestValueEl.Text()))
+	if err != nil {
+		return errors.Wrap(err, "cannot decode DigestValue")
+	}
+	detached.RemoveChild(signature)
+	digest, err := canonicalDigest(dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList(prefixList), detached)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(digest, digestValue) {
+		return errors.New("digest does not match the signed element")
+	}
+	return nil
+}
+
+// VerifyRedirectSignature checks the signature of a message sent with the HTTP-Redirect
+// binding, which signs the query parameters as they were encoded by the sender.
+func VerifyRedirectSignature(rawQuery string, certs []*x509.Certificate) error {
+	rawValues := map[string]string{}
+	for _, parameter := range strings.Split(rawQuery, "&") {
+		nameValue := strings.SplitN(parameter, "=", 2)
+		if len(nameValue) == 2 {
+			if _, ok := rawValues[nameValue[0]]; !ok {
+				rawValues[nameValue[0]] = nameValue[1]
+			}
+		}
+	}
+	if rawValues["Signature"] == "" || rawValues["SigAlg"] == "" {
+		return errors.New("message is not signed")
+	}
+
+	messageParameter := "SAMLRequest"
+	if _, ok := rawValues[messageParameter]; !ok {
+		messageParameter = "SAMLResponse"
+	}
+	signed := messageParameter + "=" + rawValues[messageParameter]
+	if relayState, ok := rawValues["RelayState"]; ok {
+		signed += "&RelayState=" + relayState
+	}
+	signed += "&SigAlg=" + rawValues["SigAlg"]
+
+	sigAlg, err := url.QueryUnescape(rawValues["SigAlg"])
+	if err != nil {
+		return errors.Wrap(err, "cannot decode SigAlg")
+	}
+	encodedSignature, err := url.QueryUnescape(rawValues["Signature"])
+	if err != nil {
+		return errors.Wrap(err, "cannot decode Signature")
+	}
+	signature, err := base64.StdEncoding.DecodeString(encodedSignature)
+	if err != nil {
+		return errors.Wrap(err, "cannot decode Signature")
+	}
+
+	err = errors.New("no signing certificate")
+	for _, cert := range certs {
+		if err = verifySignature(cert, sigAlg, []byte(signed), signature); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(err, "signature verification failed")
+}
+
+func verifySignature(cert *x509.Certificate, sigAlg string, signed []byte, signature []byte) error {
+	var hash crypto.Hash
+	switch sigAlg {
+	case dsig.RSASHA1SignatureMethod:
+		hash = crypto.SHA1
+	case dsig.RSASHA256SignatureMethod, ECDSASHA256SignatureMethod:
+		hash = crypto.SHA256
+	default:
+		return errors.Errorf("unsupported signature algorithm %s", sigAlg)
+	}
+	hashed := hash.New()
+	hashed.Write(signed)
+	digest := hashed.Sum(nil)
+
+	switch publicKey := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if sigAlg == ECDSASHA256SignatureMethod {
+			return errors.New("signature algorithm does not match the certificate key")
+		}
+		return rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+	case *ecdsa.PublicKey:
+		if sigAlg != ECDSASHA256SignatureMethod {
+			return errors.New("signature algorithm does not match the certificate key")
+		}
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("malformed ECDSA signature")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	}
+	return errors.Errorf("unsupported certificate key type %T", cert.PublicKey)
+}
+
+func parseKeyInfoCertificate(certStr string) (*x509.Certificate, error) {
+	certBytes, err := base64.StdEncoding.DecodeString(regexp.MustCompile(`\s+`).ReplaceAllString(certStr, ""))
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot decode certificate base64")
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse certificate")
+	}
+	return cert, nil
+}
@@ -0,0 +1,168 @@
+package signing_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/signing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+	"net/url"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/russellhaering/goxmldsig"
+)
+
+var _ = Describe("Verifying SP signatures", func() {
+	var rsaKey, ecKey crypto.Signer
+	var rsaCert, ecCert *x509.Certificate
+
+	BeforeEach(func() {
+		var err error
+		rsaKey, err = ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		rsaCert = readCertificate("rsa.crt")
+		ecKey, err = ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		ecCert = readCertificate("ec.crt")
+	})
+
+	Describe("SPSigningCertificates", func() {
+		It("should return the signing and unspecified use certificates", func() {
+			metadata := &saml.EntityDescriptor{SPSSODescriptors: []saml.SPSSODescriptor{{
+				SSODescriptor: saml.SSODescriptor{RoleDescriptor: saml.RoleDescriptor{KeyDescriptors: []saml.KeyDescriptor{
+					{Use: "encryption", KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(ecCert.Raw)}},
+					{Use: "signing", KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(rsaCert.Raw)}},
+					{KeyInfo: saml.KeyInfo{Certificate: base64.StdEncoding.EncodeToString(ecCert.Raw)}},
+				}}},
+			}}}
+
+			certs, err := SPSigningCertificates(metadata)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(certs).To(Equal([]*x509.Certificate{rsaCert, ecCert}))
+		})
+	})
+
+	Describe("VerifyRedirectSignature", func() {
+		signQuery := func(query string, key crypto.Signer, sigAlg string) string {
+			query += "&SigAlg=" + url.QueryEscape(sigAlg)
+			digest := sha256.Sum256([]byte(query))
+			signature, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+			Expect(err).NotTo(HaveOccurred())
+			if ecdsaKey, ok := key.(*ecdsa.PrivateKey); ok {
+				var rs struct{ R, S *big.Int }
+				_, err := asn1.Unmarshal(signature, &rs)
+				Expect(err).NotTo(HaveOccurred())
+				size := (ecdsaKey.Curve.Params().BitSize + 7) / 8
+				signature = make([]byte, 2*size)
+				rs.R.FillBytes(signature[:size])
+				rs.S.FillBytes(signature[size:])
+			}
+			return query + "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+		}
+		query := "SAMLRequest=" + url.QueryEscape("fZBBa+MwEIX/itHdliw7bi3s") + "&RelayState=state"
+
+		It("should accept an RSA signed query", func() {
+			signedQuery := signQuery(query, rsaKey, dsig.RSASHA256SignatureMethod)
+			Expect(VerifyRedirectSignature(signedQuery, []*x509.Certificate{ecCert, rsaCert})).To(Succeed())
+		})
+
+		It("should accept an ECDSA signed query", func() {
+			signedQuery := signQuery(query, ecKey, ECDSASHA256SignatureMethod)
+			Expect(VerifyRedirectSignature(signedQuery, []*x509.Certificate{ecCert})).To(Succeed())
+		})
+
+		It("should reject a tampered query", func() {
+			signedQuery := signQuery(query, rsaKey, dsig.RSASHA256SignatureMethod)
+			signedQuery = "SAMLRequest=tampered" + signedQuery[len("SAMLRequest="+url.QueryEscape("fZBBa+MwEIX/itHdliw7bi3s")):]
+			Expect(VerifyRedirectSignature(signedQuery, []*x509.Certificate{rsaCert})).To(MatchError(ContainSubstring("signature verification failed")))
+		})
+
+		It("should reject a query signed with another key", func() {
+			signedQuery := signQuery(query, rsaKey, dsig.RSASHA256SignatureMethod)
+			Expect(VerifyRedirectSignature(signedQuery, []*x509.Certificate{ecCert})).To(MatchError(ContainSubstring("signature verification failed")))
+		})
+
+		It("should accept a query signed with a Signer", func() {
+			for _, signer := range []Signer{{Key: rsaKey, Certificate: rsaCert}, {Key: ecKey, Certificate: ecCert}} {
+				signedQuery, err := signer.SignQuery(query)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(VerifyRedirectSignature(signedQuery, []*x509.Certificate{signer.Certificate})).To(Succeed())
+			}
+		})
+
+		It("should reject an unsigned query", func() {
+			Expect(VerifyRedirectSignature(query, []*x509.Certificate{rsaCert})).To(MatchError("message is not signed"))
+		})
+	})
+
+	Describe("VerifyEnvelopedSignature", func() {
+		var requestEl *etree.Element
+
+		BeforeEach(func() {
+			requestEl = etree.NewElement("samlp:AuthnRequest")
+			requestEl.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+			requestEl.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+			requestEl.CreateAttr("ID", "id-request")
+			requestEl.CreateElement("saml:Issuer").SetText("https://sp.example.com")
+
+			signature, err := Signer{Key: rsaKey, Certificate: rsaCert}.Sign(requestEl)
+			Expect(err).NotTo(HaveOccurred())
+			requestEl.InsertChild(nil, signature)
+		})
+
+		It("should accept a signature made with one of the certificates", func() {
+			Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{ecCert, rsaCert})).To(Succeed())
+		})
+
+		It("should reject a tampered element", func() {
+			requestEl.SelectElement("Issuer").SetText("https://attacker.example.com")
+			Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{rsaCert})).To(MatchError(ContainSubstring("signature verification failed")))
+		})
+
+		It("should reject an unsigned element", func() {
+			requestEl.RemoveChild(requestEl.SelectElement("Signature"))
+			Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{rsaCert})).To(MatchError(ContainSubstring("signature verification failed")))
+		})
+
+		Context("when the element is signed with an ECDSA key", func() {
+			BeforeEach(func() {
+				requestEl.RemoveChild(requestEl.SelectElement("Signature"))
+				signature, err := Signer{Key: ecKey, Certificate: ecCert}.Sign(requestEl)
+				Expect(err).NotTo(HaveOccurred())
+				requestEl.InsertChild(nil, signature)
+			})
+
+			It("should accept a signature made with one of the certificates", func() {
+				Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{rsaCert, ecCert})).To(Succeed())
+			})
+
+			It("should accept a signature whose namespaces are declared on a parent", func() {
+				envelope := etree.NewElement("S:Envelope")
+				envelope.CreateAttr("xmlns:S", "http://schemas.xmlsoap.org/soap/envelope/")
+				envelope.CreateAttr("xmlns:samlp", "urn:oasis:names:tc:SAML:2.0:protocol")
+				envelope.CreateAttr("xmlns:saml", "urn:oasis:names:tc:SAML:2.0:assertion")
+				requestEl.RemoveAttr("xmlns:samlp")
+				requestEl.RemoveAttr("xmlns:saml")
+				envelope.AddChild(requestEl)
+				Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{ecCert})).To(Succeed())
+			})
+
+			It("should reject a tampered element", func() {
+				requestEl.SelectElement("Issuer").SetText("https://attacker.example.com")
+				Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{ecCert})).To(MatchError(ContainSubstring("signature verification failed")))
+			})
+
+			It("should reject a signature checked against another certificate", func() {
+				Expect(VerifyEnvelopedSignature(requestEl, []*x509.Certificate{rsaCert})).To(MatchError(ContainSubstring("signature verification failed")))
+			})
+		})
+	})
+})
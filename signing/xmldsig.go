@@ -0,0 +1,151 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"math/big"
+
+	"github.com/beevik/etree"
+	"github.com/pkg/errors"
+	"github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+const (
+	ECDSASHA256SignatureMethod = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	SHA256DigestMethod         = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+// Signer creates enveloped XML signatures with an RSA or ECDSA key. The dsig package
+// vendored through the saml package can only sign with RSA keys.
+type Signer struct {
+	Key         crypto.Signer
+	Certificate *x509.Certificate
+}
+
+func (s Signer) signatureMethod() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return dsig.RSASHA256SignatureMethod, nil
+	case *ecdsa.PrivateKey:
+		return ECDSASHA256SignatureMethod, nil
+	}
+	return "", errors.Errorf("unsupported signing key type %T", s.Key)
+}
+
+// Sign returns a ds:Signature over el, which must have an ID attribute, using SHA-256
+// and exclusive canonicalization. The signature is meant to be inserted into el; where
+// depends on the schema of el, for SAML messages it follows the Issuer.
+func (s Signer) Sign(el *etree.Element) (*etree.Element, error) {
+	signatureMethod, err := s.signatureMethod()
+	if err != nil {
+		return nil, err
+	}
+
+	id := el.SelectAttrValue(dsig.DefaultIdAttr, "")
+	if id == "" {
+		return nil, errors.New("cannot sign an element without an ID")
+	}
+
+	canonicalizer := dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	digest, err := canonicalDigest(canonicalizer, el)
+	if err != nil {
+		return nil, err
+	}
+
+	signature := &etree.Element{Tag: dsig.SignatureTag, Space: dsig.DefaultPrefix}
+	signature.CreateAttr("xmlns:"+dsig.DefaultPrefix, dsig.Namespace)
+
+	signedInfo := createElement(signature, dsig.SignedInfoTag)
+	createElement(signedInfo, dsig.CanonicalizationMethodTag).CreateAttr(dsig.AlgorithmAttr, canonicalizer.Algorithm().String())
+	createElement(signedInfo, dsig.SignatureMethodTag).CreateAttr(dsig.AlgorithmAttr, signatureMethod)
+	reference := createElement(signedInfo, dsig.ReferenceTag)
+	reference.CreateAttr(dsig.URIAttr, "#"+id)
+	transforms := createElement(reference, dsig.TransformsTag)
+	createElement(transforms, dsig.TransformTag).CreateAttr(dsig.AlgorithmAttr, dsig.EnvelopedSignatureAltorithmId.String())
+	createElement(transforms, dsig.TransformTag).CreateAttr(dsig.AlgorithmAttr, canonicalizer.Algorithm().String())
+	createElement(reference, dsig.DigestMethodTag).CreateAttr(dsig.AlgorithmAttr, SHA256DigestMethod)
+	createElement(reference, dsig.DigestValueTag).SetText(base64.StdEncoding.EncodeToString(digest))
+
+	// SignedInfo is canonicalized with the namespaces in scope where the signature
+	// will end up, inside el.
+	elContext, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, err
+	}
+	elContext, err = elContext.SubContext(el)
+	if err != nil {
+		return nil, err
+	}
+	signatureContext, err := elContext.SubContext(signature)
+	if err != nil {
+		return nil, err
+	}
+	detachedSignedInfo, err := etreeutils.NSDetatch(signatureContext, signedInfo)
+	if err != nil {
+		return nil, err
+	}
+	signedInfoDigest, err := canonicalDigest(canonicalizer, detachedSignedInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	signatureValue, err := s.sign(signedInfoDigest)
+	if err != nil {
+		return nil, err
+	}
+	createElement(signature, dsig.SignatureValueTag).SetText(base64.StdEncoding.EncodeToString(signatureValue))
+
+	keyInfo := createElement(signature, dsig.KeyInfoTag)
+	x509Data := createElement(keyInfo, dsig.X509DataTag)
+	createElement(x509Data, dsig.X509CertificateTag).SetText(base64.StdEncoding.EncodeToString(s.Certificate.Raw))
+
+	return signature, nil
+}
+
+// sign signs digest. XML signatures carry ECDSA signatures as the concatenation of r
+// and s, each padded to the size of the curve, rather than the ASN.1 form Go produces.
+func (s Signer) sign(digest []byte) ([]byte, error) {
+	signature, err := s.Key.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := s.Key.(*ecdsa.PrivateKey)
+	if !ok {
+		return signature, nil
+	}
+	var rs struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(signature, &rs); err != nil {
+		return nil, err
+	}
+	size := (ecdsaKey.Curve.Params().BitSize + 7) / 8
+	rawSignature := make([]byte, 2*size)
+	rs.R.FillBytes(rawSignature[:size])
+	rs.S.FillBytes(rawSignature[size:])
+	return rawSignature, nil
+}
+
+func canonicalDigest(canonicalizer dsig.Canonicalizer, el *etree.Element) ([]byte, error) {
+	canonical, err := canonicalizer.Canonicalize(el)
+	if err != nil {
+		return nil, err
+	}
+	hash := crypto.SHA256.New()
+	hash.Write(canonical)
+	return hash.Sum(nil), nil
+}
+
+func createElement(parent *etree.Element, tag string) *etree.Element {
+	child := parent.CreateElement(tag)
+	child.Space = dsig.DefaultPrefix
+	return child
+}
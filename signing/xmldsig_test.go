@@ -0,0 +1,93 @@
+package signing_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/signing"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+
+	"github.com/beevik/etree"
+	"github.com/russellhaering/goxmldsig"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+var _ = Describe("Signer", func() {
+	var el *etree.Element
+
+	BeforeEach(func() {
+		doc := etree.NewDocument()
+		Expect(doc.ReadFromString(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="id-123"><saml:Issuer>https://idp.example.com</saml:Issuer></samlp:Response>`)).To(Succeed())
+		el = doc.Root()
+	})
+
+	It("should create signatures dsig can validate with RSA keys", func() {
+		key, err := ParsePrivateKey(readFixture("rsa-pkcs1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		cert := readCertificate("rsa.crt")
+
+		signature, err := Signer{Key: key, Certificate: cert}.Sign(el)
+		Expect(err).NotTo(HaveOccurred())
+		el.AddChild(signature)
+
+		validationContext := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: []*x509.Certificate{cert}})
+		_, err = validationContext.Validate(el)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("should create ecdsa-sha256 signatures with ECDSA keys", func() {
+		key, err := ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		cert := readCertificate("ec.crt")
+
+		signature, err := Signer{Key: key, Certificate: cert}.Sign(el)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(signature.FindElement("./SignedInfo/SignatureMethod").SelectAttrValue("Algorithm", "")).To(Equal(ECDSASHA256SignatureMethod))
+		el.AddChild(signature)
+
+		VerifyECDSASignature(el, cert)
+	})
+
+	It("should refuse to sign elements without an ID", func() {
+		key, err := ParsePrivateKey(readFixture("ec-sec1.key"), nil)
+		Expect(err).NotTo(HaveOccurred())
+		el.RemoveAttr("ID")
+
+		_, err = Signer{Key: key, Certificate: readCertificate("ec.crt")}.Sign(el)
+		Expect(err).To(MatchError("cannot sign an element without an ID"))
+	})
+})
+
+// VerifyECDSASignature checks the enveloped ecdsa-sha256 signature of el.
+func VerifyECDSASignature(el *etree.Element, cert *x509.Certificate) {
+	canonicalizer := dsig.MakeC14N10ExclusiveCanonicalizerWithPrefixList("")
+	signature := el.SelectElement("Signature")
+	Expect(signature).NotTo(BeNil())
+
+	unsigned := el.Copy()
+	unsigned.RemoveChild(unsigned.SelectElement("Signature"))
+	canonical, err := canonicalizer.Canonicalize(unsigned)
+	Expect(err).NotTo(HaveOccurred())
+	digest := sha256.Sum256(canonical)
+	Expect(signature.FindElement("./SignedInfo/Reference/DigestValue").Text()).To(Equal(base64.StdEncoding.EncodeToString(digest[:])))
+
+	signedInfo := signature.SelectElement("SignedInfo")
+	signedInfoContext, err := etreeutils.NSBuildParentContext(signedInfo)
+	Expect(err).NotTo(HaveOccurred())
+	detachedSignedInfo, err := etreeutils.NSDetatch(signedInfoContext, signedInfo)
+	Expect(err).NotTo(HaveOccurred())
+	canonical, err = canonicalizer.Canonicalize(detachedSignedInfo)
+	Expect(err).NotTo(HaveOccurred())
+	digest = sha256.Sum256(canonical)
+
+	signatureValue, err := base64.StdEncoding.DecodeString(signature.SelectElement("SignatureValue").Text())
+	Expect(err).NotTo(HaveOccurred())
+	half := len(signatureValue) / 2
+	r := new(big.Int).SetBytes(signatureValue[:half])
+	s := new(big.Int).SetBytes(signatureValue[half:])
+	Expect(ecdsa.Verify(cert.PublicKey.(*ecdsa.PublicKey), digest[:], r, s)).To(BeTrue())
+}
@@ -0,0 +1,58 @@
+package soap
+
+import (
+	"github.com/beevik/etree"
+	"github.com/pkg/errors"
+	"github.com/russellhaering/goxmldsig/etreeutils"
+)
+
+const (
+	Namespace = "http://schemas.xmlsoap.org/soap/envelope/"
+	ActorNext = "http://schemas.xmlsoap.org/soap/actor/next"
+)
+
+// Binding is the SAML SOAP binding, over which SPs send messages directly to the IdP.
+const Binding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+
+// ReadBody returns a copy of the first element in the body of a SOAP envelope. The copy
+// declares the namespaces it inherited from the Envelope and Body, so it can be parsed
+// and its signature checked on its own.
+func ReadBody(buffer []byte) (*etree.Element, error) {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(buffer); err != nil {
+		return nil, errors.Wrap(err, "cannot parse SOAP envelope")
+	}
+	envelope := doc.Root()
+	if envelope == nil || envelope.Tag != "Envelope" {
+		return nil, errors.New("expected a SOAP envelope")
+	}
+	for _, body := range envelope.ChildElements() {
+		if body.Tag == "Body" && len(body.ChildElements()) > 0 {
+			return detach(body.ChildElements()[0])
+		}
+	}
+	return nil, errors.New("SOAP envelope has an empty body")
+}
+
+func detach(el *etree.Element) (*etree.Element, error) {
+	ctx, err := etreeutils.NSBuildParentContext(el)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot parse SOAP envelope")
+	}
+	return etreeutils.NSDetatch(ctx, el)
+}
+
+// WriteEnvelope returns a SOAP envelope carrying body, and headers when there are any.
+func WriteEnvelope(body *etree.Element, headers ...*etree.Element) ([]byte, error) {
+	doc := etree.NewDocument()
+	envelope := doc.CreateElement("soap:Envelope")
+	envelope.CreateAttr("xmlns:soap", Namespace)
+	if len(headers) > 0 {
+		header := envelope.CreateElement("soap:Header")
+		for _, el := range headers {
+			header.AddChild(el)
+		}
+	}
+	envelope.CreateElement("soap:Body").AddChild(body)
+	return doc.WriteToBytes()
+}
@@ -0,0 +1,237 @@
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+const fileStoreSuffix = ".json"
+
+// maxFileNameLength is the longest file name most filesystems allow. Keys whose file
+// name would be longer, such as long entityIDs, are kept under hashedKeysDir instead.
+const maxFileNameLength = 255
+
+// hashedKeysDir holds the values of long keys in files named by the SHA-256 of the
+// key, each next to a file of the same name ending in hashedKeySuffix that holds the
+// key itself so List can return it.
+const (
+	hashedKeysDir   = "hashed"
+	hashedKeySuffix = ".key"
+)
+
+// FileStore is an implementation of samlidp.Store that keeps every key as a JSON
+// file in a directory, so users, services, shortcuts and sessions survive a
+// restart. Writes go to a temporary file that is fsynced and then renamed over
+// the old value, so a crash never leaves a half written value behind. Keys too long
+// for a file name are kept in files named by their hash.
+type FileStore struct {
+	mu  sync.RWMutex
+	dir string
+}
+
+// NewFileStore returns a FileStore keeping its files in dir, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "Unable to create store directory")
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Get fetches the data stored in `key` and unmarshals it into `value`.
+func (s *FileStore) Get(key string, value interface{}) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buf, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return samlidp.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, value)
+}
+
+// Put marshals `value` and stores it in `key`.
+func (s *FileStore) Put(key string, value interface{}) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !isHashedKey(key) {
+		return s.writeFile(s.path(key), buf)
+	}
+	if err := os.MkdirAll(filepath.Join(s.dir, hashedKeysDir), 0700); err != nil {
+		return err
+	}
+	if err := s.writeFile(s.keyPath(key), []byte(key)); err != nil {
+		return err
+	}
+	return s.writeFile(s.path(key), buf)
+}
+
+// writeFile replaces the file at path with buf through a temporary file.
+func (s *FileStore) writeFile(path string, buf []byte) error {
+	tempFile, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(buf); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Delete removes `key`
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.removeFile(s.path(key)); err != nil {
+		return err
+	}
+	if !isHashedKey(key) {
+		return nil
+	}
+	return s.removeFile(s.keyPath(key))
+}
+
+func (s *FileStore) removeFile(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// List returns all the keys that start with `prefix`. The prefix is
+// stripped from each returned value. So if keys are ["aa", "ab", "cd"]
+// then List("a") would produce []string{"a", "b"}
+func (s *FileStore) List(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	rv := []string{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, fileStoreSuffix) {
+			continue
+		}
+		key, err := url.QueryUnescape(strings.TrimSuffix(name, fileStoreSuffix))
+		if err != nil {
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			rv = append(rv, strings.TrimPrefix(key, prefix))
+		}
+	}
+
+	hashedKeys, err := s.hashedKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range hashedKeys {
+		if strings.HasPrefix(key, prefix) {
+			rv = append(rv, strings.TrimPrefix(key, prefix))
+		}
+	}
+	return rv, nil
+}
+
+// hashedKeys returns the long keys that have a value stored. A key file without a
+// value is left behind when Put or Delete is interrupted and is skipped.
+func (s *FileStore) hashedKeys() ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(s.dir, hashedKeysDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), hashedKeySuffix) {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(s.dir, hashedKeysDir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key := string(buf)
+		if _, err := os.Stat(s.path(key)); err != nil {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// path maps a key, which may contain slashes (entityIDs, base64 session IDs), to a
+// file directly inside the store directory, or to a file under hashedKeysDir when
+// the escaped key is too long for a file name.
+func (s *FileStore) path(key string) string {
+	if isHashedKey(key) {
+		return filepath.Join(s.dir, hashedKeysDir, hashKey(key)+fileStoreSuffix)
+	}
+	return filepath.Join(s.dir, url.QueryEscape(key)+fileStoreSuffix)
+}
+
+// keyPath is the file that holds a long key next to its value.
+func (s *FileStore) keyPath(key string) string {
+	return filepath.Join(s.dir, hashedKeysDir, hashKey(key)+hashedKeySuffix)
+}
+
+func isHashedKey(key string) bool {
+	return len(url.QueryEscape(key)+fileStoreSuffix) > maxFileNameLength
+}
+
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// syncDir makes renames and removals in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
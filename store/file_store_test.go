@@ -0,0 +1,100 @@
+package store_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/store"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/crewjam/saml/samlidp"
+)
+
+var _ = Describe("FileStore", func() {
+	var dir string
+	var store *FileStore
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "file-store")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = NewFileStore(filepath.Join(dir, "data"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should get what was put", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice", Email: "alice@example.com"})).To(Succeed())
+
+		user := samlidp.User{}
+		Expect(store.Get("/users/alice", &user)).To(Succeed())
+		Expect(user.Email).To(Equal("alice@example.com"))
+	})
+
+	It("should return samlidp.ErrNotFound for unknown keys", func() {
+		Expect(store.Get("/users/unknown", &samlidp.User{})).To(Equal(samlidp.ErrNotFound))
+	})
+
+	It("should delete keys", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice"})).To(Succeed())
+		Expect(store.Delete("/users/alice")).To(Succeed())
+		Expect(store.Get("/users/alice", &samlidp.User{})).To(Equal(samlidp.ErrNotFound))
+		Expect(store.Delete("/users/alice")).To(Succeed())
+	})
+
+	It("should list keys with slashes under a prefix", func() {
+		Expect(store.Put("/services/https://sp.example.com/metadata", samlidp.Service{})).To(Succeed())
+		Expect(store.Put("/services/example", samlidp.Service{})).To(Succeed())
+		Expect(store.Put("/users/alice", samlidp.User{})).To(Succeed())
+
+		names, err := store.List("/services/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("https://sp.example.com/metadata", "example"))
+	})
+
+	It("should keep keys too long for a file name", func() {
+		longKey := "/services/https://sp.example.com/" + strings.Repeat("metadata/", 40)
+		Expect(store.Put(longKey, samlidp.Service{Name: "long"})).To(Succeed())
+		Expect(store.Put("/services/example", samlidp.Service{})).To(Succeed())
+
+		service := samlidp.Service{}
+		Expect(store.Get(longKey, &service)).To(Succeed())
+		Expect(service.Name).To(Equal("long"))
+
+		reopened, err := NewFileStore(filepath.Join(dir, "data"))
+		Expect(err).NotTo(HaveOccurred())
+		names, err := reopened.List("/services/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf(strings.TrimPrefix(longKey, "/services/"), "example"))
+
+		Expect(store.Delete(longKey)).To(Succeed())
+		Expect(store.Get(longKey, &service)).To(Equal(samlidp.ErrNotFound))
+		names, err = store.List("/services/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("example"))
+	})
+
+	It("should keep values across instances", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice"})).To(Succeed())
+
+		reopened, err := NewFileStore(filepath.Join(dir, "data"))
+		Expect(err).NotTo(HaveOccurred())
+		user := samlidp.User{}
+		Expect(reopened.Get("/users/alice", &user)).To(Succeed())
+		Expect(user.Name).To(Equal("alice"))
+	})
+
+	It("should not leave temporary files behind", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice"})).To(Succeed())
+
+		files, err := ioutil.ReadDir(filepath.Join(dir, "data"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(files).To(HaveLen(1))
+	})
+})
@@ -0,0 +1,136 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"unicode/utf8"
+
+	"github.com/crewjam/saml/samlidp"
+	"github.com/pkg/errors"
+)
+
+// migrations are applied in order, each exactly once, and recorded in
+// schema_migrations. Only ever append to this list.
+var migrations = []string{
+	`CREATE TABLE saml_store (
+		name TEXT NOT NULL PRIMARY KEY,
+		data TEXT NOT NULL
+	)`,
+}
+
+// SQLStore is an implementation of samlidp.Store backed by database/sql. The SQL it
+// runs works on both SQLite and Postgres; the caller registers the driver.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore opens the database and brings its schema up to date.
+func NewSQLStore(driverName string, dataSourceName string) (*SQLStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to open store database")
+	}
+	if driverName == "sqlite3" {
+		// SQLite allows a single writer, serialise access instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Unable to connect to store database")
+	}
+
+	s := &SQLStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "Unable to migrate store database")
+	}
+	return s, nil
+}
+
+// Get fetches the data stored in `key` and unmarshals it into `value`.
+func (s *SQLStore) Get(key string, value interface{}) error {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM saml_store WHERE name = $1`, key).Scan(&data)
+	if err == sql.ErrNoRows {
+		return samlidp.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(data), value)
+}
+
+// Put marshals `value` and stores it in `key`.
+func (s *SQLStore) Put(key string, value interface{}) error {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO saml_store (name, data) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET data = excluded.data`, key, string(buf))
+	return err
+}
+
+// Delete removes `key`
+func (s *SQLStore) Delete(key string) error {
+	_, err := s.db.Exec(`DELETE FROM saml_store WHERE name = $1`, key)
+	return err
+}
+
+// List returns all the keys that start with `prefix`. The prefix is
+// stripped from each returned value. So if keys are ["aa", "ab", "cd"]
+// then List("a") would produce []string{"a", "b"}
+func (s *SQLStore) List(prefix string) ([]string, error) {
+	// substr rather than LIKE, which is case insensitive in SQLite and treats _ and % specially
+	rows, err := s.db.Query(`SELECT name FROM saml_store WHERE substr(name, 1, $1) = $2 ORDER BY name`,
+		utf8.RuneCountInString(prefix), prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rv := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		rv = append(rv, name[len(prefix):])
+	}
+	return rv, rows.Err()
+}
+
+// Close closes the underlying database.
+func (s *SQLStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	var current int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[version-1]); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", version)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			tx.Rollback()
+			return errors.Wrapf(err, "migration %d", version)
+		}
+		if err := tx.Commit(); err != nil {
+			return errors.Wrapf(err, "migration %d", version)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package store_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/store"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/crewjam/saml/samlidp"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var _ = Describe("SQLStore", func() {
+	var dir string
+	var store *SQLStore
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "sql-store")
+		Expect(err).NotTo(HaveOccurred())
+		store, err = NewSQLStore("sqlite3", filepath.Join(dir, "store.db"))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		store.Close()
+		os.RemoveAll(dir)
+	})
+
+	It("should get what was put", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice", Email: "alice@example.com"})).To(Succeed())
+
+		user := samlidp.User{}
+		Expect(store.Get("/users/alice", &user)).To(Succeed())
+		Expect(user.Email).To(Equal("alice@example.com"))
+	})
+
+	It("should overwrite existing keys", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice", Email: "old@example.com"})).To(Succeed())
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice", Email: "new@example.com"})).To(Succeed())
+
+		user := samlidp.User{}
+		Expect(store.Get("/users/alice", &user)).To(Succeed())
+		Expect(user.Email).To(Equal("new@example.com"))
+	})
+
+	It("should return samlidp.ErrNotFound for unknown keys", func() {
+		Expect(store.Get("/users/unknown", &samlidp.User{})).To(Equal(samlidp.ErrNotFound))
+	})
+
+	It("should delete keys", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice"})).To(Succeed())
+		Expect(store.Delete("/users/alice")).To(Succeed())
+		Expect(store.Get("/users/alice", &samlidp.User{})).To(Equal(samlidp.ErrNotFound))
+		Expect(store.Delete("/users/alice")).To(Succeed())
+	})
+
+	It("should list keys under a prefix, matching it exactly", func() {
+		Expect(store.Put("/services/https://sp.example.com/metadata", samlidp.Service{})).To(Succeed())
+		Expect(store.Put("/services/example", samlidp.Service{})).To(Succeed())
+		Expect(store.Put("/SERVICES/upper", samlidp.Service{})).To(Succeed())
+		Expect(store.Put("/servicesXother", samlidp.Service{})).To(Succeed())
+		Expect(store.Put("/users/alice", samlidp.User{})).To(Succeed())
+
+		names, err := store.List("/services/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(ConsistOf("https://sp.example.com/metadata", "example"))
+
+		names, err = store.List("/service_/")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(names).To(BeEmpty())
+	})
+
+	It("should keep values across instances without migrating again", func() {
+		Expect(store.Put("/users/alice", samlidp.User{Name: "alice"})).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		var err error
+		store, err = NewSQLStore("sqlite3", filepath.Join(dir, "store.db"))
+		Expect(err).NotTo(HaveOccurred())
+		user := samlidp.User{}
+		Expect(store.Get("/users/alice", &user)).To(Succeed())
+		Expect(user.Name).To(Equal("alice"))
+	})
+
+	It("should fail for unknown drivers", func() {
+		_, err := NewSQLStore("unknown", "")
+		Expect(err).To(MatchError(ContainSubstring("Unable to open store database")))
+	})
+})
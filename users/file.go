@@ -0,0 +1,508 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Formats of the users file.
+const (
+	JSONFormat = "json"
+	YAMLFormat = "yaml"
+	CSVFormat  = "csv"
+	LDIFFormat = "ldif"
+)
+
+// customSourcePrefix names a custom attribute in a csv header, as in attribute policies.
+const customSourcePrefix = "attributes."
+
+// LineError is an error about the user defined on Line of the users file.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+// atLine returns err as a LineError, or as it is when the line is not known.
+func atLine(line int, err error) error {
+	if line == 0 {
+		return err
+	}
+	return &LineError{Line: line, Err: err}
+}
+
+// entry is a user read from the users file, with the line it starts on.
+type entry struct {
+	line int
+	user User
+}
+
+// fileUser is a json or yaml user, whose hashed_password is the hash as text rather
+// than the base64 the store and REST API use.
+type fileUser struct {
+	User
+	HashedPassword string `json:"hashed_password,omitempty"`
+}
+
+func (u fileUser) user() User {
+	user := u.User
+	if u.HashedPassword != "" {
+		user.HashedPassword = []byte(u.HashedPassword)
+	}
+	return user
+}
+
+// FileFormat returns the format of the users file at path from its extension: yaml for
+// .yaml and .yml, csv for .csv, ldif for .ldif and json for any other.
+func FileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return YAMLFormat
+	case ".csv":
+		return CSVFormat
+	case ".ldif":
+		return LDIFFormat
+	default:
+		return JSONFormat
+	}
+}
+
+// ReadFile reads the users file at path in format, or the format FileFormat tells when
+// it is empty.
+func ReadFile(path string, format string) ([]User, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = FileFormat(path)
+	}
+	return Parse(content, format)
+}
+
+// Parse parses and validates the users file content in format. Errors about a user are
+// LineErrors telling the line the user starts on.
+//
+// A json file is an array of users and a yaml file a sequence of them, with the fields
+// of the /users REST API. A csv file has a header row naming the column of each field:
+// name, password, hashed_password, email, common_name, surname, given_name, groups or
+// attributes.<name> for a custom attribute; groups and custom attributes separate their
+// values with semicolons. An ldif file has an entry per user, with the name in uid, the
+// password in userPassword, the groups in memberOf and other attributes besides mail,
+// cn, sn, givenName and objectClass kept as custom attributes.
+//
+// A user has either a password, which is hashed when the user is stored, or a
+// hashed_password in one of the formats ValidateHash accepts. In ldif, userPassword
+// holds a hash when it starts with {CRYPT}, {ARGON2}, {PBKDF2}, {PBKDF2-SHA256} or
+// {PBKDF2-SHA512}.
+func Parse(content []byte, format string) ([]User, error) {
+	var entries []entry
+	var err error
+	switch format {
+	case JSONFormat:
+		entries, err = parseJSON(content)
+	case YAMLFormat:
+		entries, err = parseYAML(content)
+	case CSVFormat:
+		entries, err = parseCSV(content)
+	case LDIFFormat:
+		entries, err = parseLDIF(content)
+	default:
+		return nil, errors.Errorf("unknown users file format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return validate(entries)
+}
+
+// validate checks that every user has a name and either a password or a valid hashed
+// password, and that no name is used twice.
+func validate(entries []entry) ([]User, error) {
+	lines := map[string]int{}
+	users := []User{}
+	for _, entry := range entries {
+		name := entry.user.Name
+		if name == "" {
+			return nil, atLine(entry.line, errors.New("user has no name"))
+		}
+		if strings.Contains(name, "/") {
+			return nil, atLine(entry.line, errors.Errorf("user name %q contains a slash", name))
+		}
+		switch {
+		case entry.user.PlaintextPassword == nil && len(entry.user.HashedPassword) == 0:
+			return nil, atLine(entry.line, errors.Errorf("user %s has no password", name))
+		case entry.user.PlaintextPassword != nil && len(entry.user.HashedPassword) > 0:
+			return nil, atLine(entry.line, errors.Errorf("user %s has both a password and a hashed_password", name))
+		case entry.user.PlaintextPassword == nil:
+			if err := ValidateHash(entry.user.HashedPassword); err != nil {
+				return nil, atLine(entry.line, errors.Wrapf(err, "user %s", name))
+			}
+		}
+		if line, ok := lines[name]; ok {
+			return nil, atLine(entry.line, errors.Errorf("user %s is already defined on line %d", name, line))
+		}
+		lines[name] = entry.line
+		users = append(users, entry.user)
+	}
+	return users, nil
+}
+
+// lineAt returns the line of the byte at offset.
+func lineAt(content []byte, offset int64) int {
+	if offset > int64(len(content)) {
+		offset = int64(len(content))
+	}
+	return bytes.Count(content[:offset], []byte("\n")) + 1
+}
+
+func parseJSON(content []byte) ([]entry, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, jsonError(content, err)
+	}
+	if token != json.Delim('[') {
+		return nil, atLine(lineAt(content, decoder.InputOffset()), errors.New("expected an array of users"))
+	}
+
+	entries := []entry{}
+	for decoder.More() {
+		offset := decoder.InputOffset()
+		for offset < int64(len(content)) && strings.ContainsRune(" \t\r\n,", rune(content[offset])) {
+			offset++
+		}
+		line := lineAt(content, offset)
+		user := fileUser{}
+		if err := decoder.Decode(&user); err != nil {
+			if _, ok := err.(*json.UnmarshalTypeError); ok {
+				return nil, atLine(line, err)
+			}
+			return nil, jsonError(content, err)
+		}
+		entries = append(entries, entry{line: line, user: user.user()})
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, jsonError(content, err)
+	}
+	return entries, nil
+}
+
+// jsonError adds the line of the syntax error the decoder ran into. The offsets of the
+// decoder's errors are relative to its buffer, so the content is checked again in one go.
+func jsonError(content []byte, err error) error {
+	var value interface{}
+	if syntaxError, ok := json.Unmarshal(content, &value).(*json.SyntaxError); ok {
+		return atLine(lineAt(content, syntaxError.Offset), syntaxError)
+	}
+	return err
+}
+
+func parseYAML(content []byte) ([]entry, error) {
+	items := []interface{}{}
+	if err := yaml.Unmarshal(content, &items); err != nil {
+		return nil, err
+	}
+	lines := yamlItemLines(content)
+	if len(lines) != len(items) {
+		lines = make([]int, len(items))
+	}
+
+	entries := []entry{}
+	for i, item := range items {
+		user := fileUser{}
+		buffer, err := json.Marshal(jsonValue(item))
+		if err == nil {
+			err = json.Unmarshal(buffer, &user)
+		}
+		if err != nil {
+			return nil, atLine(lines[i], err)
+		}
+		entries = append(entries, entry{line: lines[i], user: user.user()})
+	}
+	return entries, nil
+}
+
+// yamlItemLines returns the lines of the items of the block sequence at the top of a
+// yaml document. The yaml package does not tell where a value starts, so they are the
+// lines starting with a dash at the indentation of the first one.
+func yamlItemLines(content []byte) []int {
+	lines := []int{}
+	indent := -1
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "-" && !strings.HasPrefix(trimmed, "- ") {
+			continue
+		}
+		if indent == -1 {
+			indent = len(line) - len(trimmed)
+		}
+		if len(line)-len(trimmed) == indent {
+			lines = append(lines, i+1)
+		}
+	}
+	return lines
+}
+
+// jsonValue converts the maps the yaml package decodes into ones encoding/json can
+// marshal, so yaml users have the same fields as json ones.
+func jsonValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		converted := map[string]interface{}{}
+		for key, item := range value {
+			converted[fmt.Sprint(key)] = jsonValue(item)
+		}
+		return converted
+	case []interface{}:
+		converted := []interface{}{}
+		for _, item := range value {
+			converted = append(converted, jsonValue(item))
+		}
+		return converted
+	default:
+		return value
+	}
+}
+
+func parseCSV(content []byte) ([]entry, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err == io.EOF {
+		return []entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		switch header[i] {
+		case "name", "password", "hashed_password", "email", "common_name", "surname", "given_name", "groups":
+		default:
+			if !strings.HasPrefix(header[i], customSourcePrefix) || header[i] == customSourcePrefix {
+				line, _ := reader.FieldPos(i)
+				return nil, atLine(line, errors.Errorf("unknown column %q", header[i]))
+			}
+		}
+	}
+
+	entries := []entry{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		user := User{}
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			if value == "" {
+				continue
+			}
+			switch column {
+			case "name":
+				user.Name = value
+			case "password":
+				user.PlaintextPassword = &value
+			case "hashed_password":
+				user.HashedPassword = []byte(value)
+			case "email":
+				user.Email = value
+			case "common_name":
+				user.CommonName = value
+			case "surname":
+				user.Surname = value
+			case "given_name":
+				user.GivenName = value
+			case "groups":
+				user.Groups = splitValues(value)
+			default:
+				if user.Attributes == nil {
+					user.Attributes = map[string][]string{}
+				}
+				user.Attributes[strings.TrimPrefix(column, customSourcePrefix)] = splitValues(value)
+			}
+		}
+		entries = append(entries, entry{line: line, user: user})
+	}
+	return entries, nil
+}
+
+func splitValues(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ";") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// ldifLine is an unfolded line of an ldif file.
+type ldifLine struct {
+	number int
+	text   string
+}
+
+func parseLDIF(content []byte) ([]entry, error) {
+	entries := []entry{}
+	var record []ldifLine
+	flush := func() error {
+		if len(record) == 0 {
+			return nil
+		}
+		defer func() { record = nil }()
+		if len(record) == 1 && strings.HasPrefix(strings.ToLower(record[0].text), "version:") {
+			return nil
+		}
+		e, err := ldifEntry(record)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	number := 0
+	for scanner.Scan() {
+		number++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case text == "":
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(text, "#"):
+		case strings.HasPrefix(text, " "):
+			if len(record) == 0 {
+				return nil, atLine(number, errors.New("continuation line without a value to continue"))
+			}
+			record[len(record)-1].text += text[1:]
+		default:
+			record = append(record, ldifLine{number: number, text: text})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// ldifEntry maps the attributes of an ldif entry to a user.
+func ldifEntry(record []ldifLine) (entry, error) {
+	e := entry{line: record[0].number}
+	if strings.HasPrefix(strings.ToLower(record[0].text), "version:") {
+		record = record[1:]
+		e.line = record[0].number
+	}
+	for i, line := range record {
+		colon := strings.Index(line.text, ":")
+		if colon <= 0 {
+			return entry{}, atLine(line.number, errors.Errorf("expected an attribute, not %q", line.text))
+		}
+		name := strings.SplitN(line.text[:colon], ";", 2)[0]
+		value := strings.TrimLeft(line.text[colon+1:], " ")
+		switch {
+		case strings.HasPrefix(value, ":"):
+			decoded, err := base64.StdEncoding.DecodeString(strings.TrimLeft(value[1:], " "))
+			if err != nil {
+				return entry{}, atLine(line.number, errors.Wrapf(err, "cannot decode %s", name))
+			}
+			value = string(decoded)
+		case strings.HasPrefix(value, "<"):
+			return entry{}, atLine(line.number, errors.Errorf("%s refers to a URL, which is not supported", name))
+		}
+
+		if i == 0 && !strings.EqualFold(name, "dn") {
+			return entry{}, atLine(line.number, errors.New("entry does not start with dn"))
+		}
+		switch strings.ToLower(name) {
+		case "dn", "objectclass":
+		case "changetype":
+			if !strings.EqualFold(value, "add") {
+				return entry{}, atLine(line.number, errors.Errorf("changetype %s is not supported", value))
+			}
+		case "uid":
+			e.user.Name = value
+		case "userpassword":
+			if !strings.HasPrefix(value, "{") {
+				password := value
+				e.user.PlaintextPassword = &password
+				break
+			}
+			hashedPassword, err := ldapPasswordHash(value)
+			if err != nil {
+				return entry{}, atLine(line.number, err)
+			}
+			e.user.HashedPassword = hashedPassword
+		case "mail":
+			e.user.Email = value
+		case "cn":
+			e.user.CommonName = value
+		case "sn":
+			e.user.Surname = value
+		case "givenname":
+			e.user.GivenName = value
+		case "memberof":
+			e.user.Groups = append(e.user.Groups, groupName(value))
+		default:
+			if e.user.Attributes == nil {
+				e.user.Attributes = map[string][]string{}
+			}
+			e.user.Attributes[name] = append(e.user.Attributes[name], value)
+		}
+	}
+	return e, nil
+}
+
+// ldapPasswordHash converts a userPassword with a {scheme} prefix to the hash formats
+// ValidateHash accepts.
+func ldapPasswordHash(value string) ([]byte, error) {
+	end := strings.Index(value, "}")
+	if end < 0 {
+		return nil, errors.New("userPassword has an unterminated scheme")
+	}
+	scheme, hashed := strings.ToUpper(value[1:end]), value[end+1:]
+	switch scheme {
+	case "CRYPT", "ARGON2":
+		return []byte(hashed), nil
+	case "PBKDF2":
+		return []byte("$pbkdf2$" + hashed), nil
+	case "PBKDF2-SHA256", "PBKDF2-SHA512":
+		return []byte("$" + strings.ToLower(scheme) + "$" + hashed), nil
+	default:
+		return nil, errors.Errorf("userPassword scheme {%s} is not supported", scheme)
+	}
+}
+
+// groupName returns the value of the first RDN of a memberOf DN, so
+// cn=staff,ou=groups,dc=example,dc=com is the group staff.
+func groupName(dn string) string {
+	rdn := strings.SplitN(dn, ",", 2)[0]
+	if equals := strings.Index(rdn, "="); equals >= 0 {
+		return strings.TrimSpace(rdn[equals+1:])
+	}
+	return dn
+}
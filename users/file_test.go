@@ -0,0 +1,209 @@
+package users_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/users"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/crewjam/saml/samlidp"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+var _ = Describe("Parse", func() {
+	password := "secret"
+	bob := User{
+		User: samlidp.User{
+			Name:              "bob",
+			PlaintextPassword: &password,
+			Email:             "bob@example.com",
+			CommonName:        "Bob Smith",
+			Surname:           "Smith",
+			GivenName:         "Bob",
+			Groups:            []string{"staff", "admin"},
+		},
+		Attributes: map[string][]string{"department": {"Engineering"}},
+	}
+	hashedPassword := "$2a$04$K47r.anKVjm0RJhWJRhHQeepuslUgGu2HJ0JF/9QIYKfFXQCHi5hW"
+
+	Context("json", func() {
+		It("should parse an array of users", func() {
+			Expect(Parse([]byte(`[{"name": "bob", "password": "secret", "email": "bob@example.com",
+				"common_name": "Bob Smith", "surname": "Smith", "given_name": "Bob", "groups": ["staff", "admin"],
+				"attributes": {"department": ["Engineering"]}}]`), JSONFormat)).To(Equal([]User{bob}))
+		})
+
+		It("should keep a hashed_password as is", func() {
+			users, err := Parse([]byte(`[{"name": "bob", "hashed_password": "`+hashedPassword+`"}]`), JSONFormat)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(users[0].PlaintextPassword).To(BeNil())
+			Expect(VerifyPassword(users[0].HashedPassword, "secret")).To(Succeed())
+		})
+
+		It("should tell the line of a user with both a password and a hashed_password", func() {
+			_, err := Parse([]byte("[\n  {\"name\": \"bob\", \"password\": \"secret\", \"hashed_password\": \""+hashedPassword+"\"}\n]"), JSONFormat)
+			Expect(err).To(MatchError("line 2: user bob has both a password and a hashed_password"))
+		})
+
+		It("should tell the line of a user with an invalid hashed_password", func() {
+			_, err := Parse([]byte("[\n  {\"name\": \"alice\", \"password\": \"secret\"},\n  {\"name\": \"bob\", \"hashed_password\": \"secret\"}\n]"), JSONFormat)
+			Expect(err).To(MatchError("line 3: user bob: unknown password hash type"))
+		})
+
+		It("should tell the line of a syntax error", func() {
+			_, err := Parse([]byte("[\n  {\"name\": \"bob\",\n  \"password\" \"secret\"}\n]"), JSONFormat)
+			Expect(err).To(BeAssignableToTypeOf(&LineError{}))
+			Expect(err.(*LineError).Line).To(Equal(3))
+		})
+
+		It("should tell the line of a truncated file", func() {
+			_, err := Parse([]byte("[\n  {\"name\": \"bob\", \"password\": \"secret\"}"), JSONFormat)
+			Expect(err).To(MatchError("line 2: unexpected end of JSON input"))
+		})
+
+		It("should tell the line of the user with a wrongly typed field", func() {
+			_, err := Parse([]byte("[\n  {\"name\": \"alice\", \"password\": \"secret\"},\n  {\"name\": 3}\n]"), JSONFormat)
+			Expect(err).To(MatchError(HavePrefix("line 3: json: cannot unmarshal number")))
+		})
+	})
+
+	Context("yaml", func() {
+		It("should parse a sequence of users", func() {
+			Expect(Parse([]byte(`
+- name: bob
+  password: secret
+  email: bob@example.com
+  common_name: Bob Smith
+  surname: Smith
+  given_name: Bob
+  groups:
+  - staff
+  - admin
+  attributes:
+    department: [Engineering]
+`), YAMLFormat)).To(Equal([]User{bob}))
+		})
+
+		It("should tell the line of an invalid user", func() {
+			_, err := Parse([]byte("- name: alice\n  password: secret\n- name: bob\n"), YAMLFormat)
+			Expect(err).To(MatchError("line 3: user bob has no password"))
+		})
+
+		It("should pass on the line of a syntax error", func() {
+			_, err := Parse([]byte("- name: bob\n  password: secret\n\tgroups: []\n"), YAMLFormat)
+			Expect(err).To(MatchError(HavePrefix("yaml: line ")))
+		})
+	})
+
+	Context("csv", func() {
+		It("should map the header row to fields, groups and custom attributes", func() {
+			Expect(Parse([]byte(
+				"name,password,email,common_name,surname,given_name,groups,attributes.department\n"+
+					"bob,secret,bob@example.com,Bob Smith,Smith,Bob,staff; admin,Engineering\n"), CSVFormat)).To(Equal([]User{bob}))
+		})
+
+		It("should read hashed passwords", func() {
+			users, err := Parse([]byte("name,hashed_password\nbob,"+hashedPassword+"\n"), CSVFormat)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(VerifyPassword(users[0].HashedPassword, "secret")).To(Succeed())
+		})
+
+		It("should reject unknown columns", func() {
+			_, err := Parse([]byte("name,password,phone\nbob,secret,555-0100\n"), CSVFormat)
+			Expect(err).To(MatchError(`line 1: unknown column "phone"`))
+		})
+
+		It("should tell the line of an invalid user", func() {
+			_, err := Parse([]byte("name,password\nbob,secret\n,secret\n"), CSVFormat)
+			Expect(err).To(MatchError("line 3: user has no name"))
+		})
+
+		It("should tell the line of a record with the wrong number of fields", func() {
+			_, err := Parse([]byte("name,password\nbob,secret\nalice\n"), CSVFormat)
+			Expect(err).To(MatchError(ContainSubstring("line 3")))
+		})
+	})
+
+	Context("ldif", func() {
+		It("should map the entries to users", func() {
+			Expect(Parse([]byte(`version: 1
+
+# bob
+dn: uid=bob,ou=people,dc=example,dc=com
+objectClass: inetOrgPerson
+uid: bob
+userPassword:: c2VjcmV0
+mail: bob@example.com
+cn: Bob Smith
+sn: Smith
+givenName: Bob
+memberOf: cn=staff,ou=groups,dc=example,dc=com
+memberOf: cn=admin,ou=groups,
+ dc=example,dc=com
+department: Engineering
+`), LDIFFormat)).To(Equal([]User{bob}))
+		})
+
+		It("should tell the line of an invalid entry", func() {
+			_, err := Parse([]byte("dn: uid=alice,dc=example,dc=com\nuid: alice\nuserPassword: secret\n\ndn: uid=bob,dc=example,dc=com\nuid: alice\nuserPassword: secret\n"), LDIFFormat)
+			Expect(err).To(MatchError("line 5: user alice is already defined on line 1"))
+		})
+
+		It("should read hashed passwords with a scheme", func() {
+			pbkdf2Hash := "1000$" + encodeBase64([]byte("salt")) + "$" +
+				encodeBase64(pbkdf2.Key([]byte("secret"), []byte("salt"), 1000, 32, sha256.New))
+			users, err := Parse([]byte("dn: uid=alice,dc=example,dc=com\nuid: alice\nuserPassword: {CRYPT}"+hashedPassword+
+				"\n\ndn: uid=bob,dc=example,dc=com\nuid: bob\nuserPassword: {PBKDF2-SHA256}"+pbkdf2Hash+"\n"), LDIFFormat)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(VerifyPassword(users[0].HashedPassword, "secret")).To(Succeed())
+			Expect(VerifyPassword(users[1].HashedPassword, "secret")).To(Succeed())
+		})
+
+		It("should reject unsupported password schemes", func() {
+			_, err := Parse([]byte("dn: uid=bob,dc=example,dc=com\nuid: bob\nuserPassword: {SSHA}abcdef\n"), LDIFFormat)
+			Expect(err).To(MatchError("line 3: userPassword scheme {SSHA} is not supported"))
+		})
+
+		It("should reject entries without a dn", func() {
+			_, err := Parse([]byte("uid: bob\nuserPassword: secret\n"), LDIFFormat)
+			Expect(err).To(MatchError("line 1: entry does not start with dn"))
+		})
+	})
+
+	It("should reject an unknown format", func() {
+		_, err := Parse([]byte(""), "xml")
+		Expect(err).To(MatchError(`unknown users file format "xml"`))
+	})
+})
+
+var _ = Describe("ReadFile", func() {
+	var dir string
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "users")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("should detect the format from the extension unless one is given", func() {
+		path := filepath.Join(dir, "users.yml")
+		Expect(ioutil.WriteFile(path, []byte("- name: bob\n  password: secret\n"), 0600)).To(Succeed())
+		users, err := ReadFile(path, "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(users).To(HaveLen(1))
+
+		path = filepath.Join(dir, "users.txt")
+		Expect(ioutil.WriteFile(path, []byte("name,password\nbob,secret\n"), 0600)).To(Succeed())
+		users, err = ReadFile(path, CSVFormat)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(users[0].Name).To(Equal("bob"))
+	})
+})
@@ -0,0 +1,104 @@
+package users
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/zenazn/goji/web"
+)
+
+// Handler serves `GET /users/:id` and `PUT /users/:id` like the samlidp package does,
+// but keeps the custom attributes of the user and hashes passwords at BcryptCost, or
+// bcrypt.DefaultCost when it is 0. It also serves `/login` with the IDP's SessionProvider,
+// so passwords are verified whatever their hash type.
+type Handler struct {
+	IDP        *saml.IdentityProvider
+	Store      samlidp.Store
+	BcryptCost int
+	Logger     logger.Interface
+}
+
+// HandleGetUser responds with the user in JSON format, without the HashedPassword.
+func (h *Handler) HandleGetUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	err := h.Store.Get(userKey(c.URLParams["id"]), &user)
+	if err != nil {
+		h.Logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	user.HashedPassword = nil
+	json.NewEncoder(w).Encode(user)
+}
+
+// HandlePutUser stores the user in the request body. A password is hashed into
+// HashedPassword and a hashed_password, which must be a hash VerifyPassword supports, is
+// stored as given; a user with both is rejected. Without either the stored
+// HashedPassword is kept.
+func (h *Handler) HandlePutUser(c web.C, w http.ResponseWriter, r *http.Request) {
+	user := User{}
+	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+		h.Logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	user.Name = c.URLParams["id"]
+
+	switch {
+	case user.PlaintextPassword != nil && len(user.HashedPassword) > 0:
+		h.Logger.Printf("ERROR: user %s has both a password and a hashed_password", user.Name)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	case user.PlaintextPassword != nil:
+		var err error
+		user.HashedPassword, err = HashPassword(*user.PlaintextPassword, h.BcryptCost)
+		if err != nil {
+			h.Logger.Printf("ERROR: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	case len(user.HashedPassword) > 0:
+		if err := ValidateHash(user.HashedPassword); err != nil {
+			h.Logger.Printf("ERROR: user %s: %s", user.Name, err)
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+	default:
+		existingUser := User{}
+		err := h.Store.Get(userKey(user.Name), &existingUser)
+		switch {
+		case err == nil:
+			user.HashedPassword = existingUser.HashedPassword
+		case err == samlidp.ErrNotFound:
+		default:
+			h.Logger.Printf("ERROR: %s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+	}
+	user.PlaintextPassword = nil
+
+	if err := h.Store.Put(userKey(user.Name), &user); err != nil {
+		h.Logger.Printf("ERROR: %s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLogin responds to valid credentials in the `POST /login` form with the JSON
+// session, and otherwise with the login form.
+func (h *Handler) HandleLogin(c web.C, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	}
+	session := h.IDP.SessionProvider.GetSession(w, r, &saml.IdpAuthnRequest{IDP: h.IDP})
+	if session == nil {
+		return
+	}
+	json.NewEncoder(w).Encode(session)
+}
@@ -0,0 +1,108 @@
+package users_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/users"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/crewjam/saml/logger"
+	"github.com/crewjam/saml/samlidp"
+	"github.com/zenazn/goji/web"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var _ = Describe("Handler", func() {
+	var store *samlidp.MemoryStore
+	var handler *Handler
+	var c web.C
+
+	put := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.HandlePutUser(c, w, httptest.NewRequest("PUT", "/users/bob", strings.NewReader(body)))
+		return w.Code
+	}
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		handler = &Handler{Store: store, Logger: logger.DefaultLogger}
+		c = web.C{URLParams: map[string]string{"id": "bob"}}
+	})
+
+	It("should store the user with its attributes and hashed password", func() {
+		Expect(put(`{"password": "secret", "attributes": {"roles": ["reader", "writer"]}}`)).To(Equal(204))
+
+		user := User{}
+		Expect(store.Get("/users/bob", &user)).To(Succeed())
+		Expect(user.Name).To(Equal("bob"))
+		Expect(user.PlaintextPassword).To(BeNil())
+		Expect(bcrypt.CompareHashAndPassword(user.HashedPassword, []byte("secret"))).To(Succeed())
+		Expect(user.Attributes).To(Equal(map[string][]string{"roles": {"reader", "writer"}}))
+	})
+
+	It("should hash passwords at the configured bcrypt cost", func() {
+		handler.BcryptCost = bcrypt.MinCost
+		Expect(put(`{"password": "secret"}`)).To(Equal(204))
+
+		user := User{}
+		Expect(store.Get("/users/bob", &user)).To(Succeed())
+		Expect(bcrypt.Cost(user.HashedPassword)).To(Equal(bcrypt.MinCost))
+	})
+
+	It("should keep the stored password when none is given", func() {
+		Expect(put(`{"password": "secret"}`)).To(Equal(204))
+		Expect(put(`{"email": "bob@example.com"}`)).To(Equal(204))
+
+		user := User{}
+		Expect(store.Get("/users/bob", &user)).To(Succeed())
+		Expect(user.Email).To(Equal("bob@example.com"))
+		Expect(bcrypt.CompareHashAndPassword(user.HashedPassword, []byte("secret"))).To(Succeed())
+	})
+
+	It("should store a supported hashed password as given", func() {
+		Expect(put(`{"password": "secret"}`)).To(Equal(204))
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := json.Marshal(map[string][]byte{"hashed_password": hashedPassword})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(put(string(body))).To(Equal(204))
+
+		user := User{}
+		Expect(store.Get("/users/bob", &user)).To(Succeed())
+		Expect(user.HashedPassword).To(Equal(hashedPassword))
+	})
+
+	It("should reject an unsupported hashed password", func() {
+		body, err := json.Marshal(map[string][]byte{"hashed_password": []byte("secret")})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(put(string(body))).To(Equal(400))
+		Expect(store.Get("/users/bob", &User{})).To(Equal(samlidp.ErrNotFound))
+	})
+
+	It("should reject both a password and a hashed password", func() {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		body, err := json.Marshal(map[string]interface{}{"password": "secret", "hashed_password": hashedPassword})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(put(string(body))).To(Equal(400))
+	})
+
+	It("should respond with the attributes but not the password", func() {
+		Expect(put(`{"password": "secret", "attributes": {"phone": ["555-0100"]}}`)).To(Equal(204))
+
+		w := httptest.NewRecorder()
+		handler.HandleGetUser(c, w, httptest.NewRequest("GET", "/users/bob", nil))
+		Expect(w.Code).To(Equal(200))
+		response := map[string]interface{}{}
+		Expect(json.Unmarshal(w.Body.Bytes(), &response)).To(Succeed())
+		Expect(response).NotTo(HaveKey("hashed_password"))
+		Expect(response["attributes"]).To(Equal(map[string]interface{}{"phone": []interface{}{"555-0100"}}))
+	})
+
+	It("should reject a malformed user", func() {
+		Expect(put(`{`)).To(Equal(400))
+	})
+})
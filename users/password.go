@@ -0,0 +1,167 @@
+package users
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// HashPassword hashes password with bcrypt at cost, or bcrypt.DefaultCost when it is 0.
+func HashPassword(password string, cost int) ([]byte, error) {
+	if cost == 0 {
+		cost = bcrypt.DefaultCost
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), cost)
+}
+
+// ValidateHash checks that hashedPassword is a password hash VerifyPassword knows:
+// bcrypt ($2a$, $2b$ or $2y$), argon2id ($argon2id$v=19$m=<memory>,t=<time>,p=<threads>$
+// <salt>$<hash>) or PBKDF2 ($pbkdf2-sha256$, $pbkdf2-sha512$ or $pbkdf2$ for SHA-1,
+// followed by <iterations>$<salt>$<hash>). Salts and hashes are unpadded base64, and
+// may use . for +.
+func ValidateHash(hashedPassword []byte) error {
+	_, err := parseHash(hashedPassword)
+	return err
+}
+
+// VerifyPassword checks password against hashedPassword, dispatching on its hash type.
+func VerifyPassword(hashedPassword []byte, password string) error {
+	verify, err := parseHash(hashedPassword)
+	if err != nil {
+		return err
+	}
+	return verify(password)
+}
+
+var errMismatchedPassword = errors.New("password does not match")
+
+// parseHash returns the function verifying passwords against hashedPassword.
+func parseHash(hashedPassword []byte) (func(password string) error, error) {
+	encoded := string(hashedPassword)
+	switch {
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		if _, err := bcrypt.Cost(hashedPassword); err != nil {
+			return nil, errors.Wrap(err, "invalid bcrypt hash")
+		}
+		return func(password string) error {
+			return bcrypt.CompareHashAndPassword(hashedPassword, []byte(password))
+		}, nil
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return parseArgon2id(encoded)
+	case strings.HasPrefix(encoded, "$pbkdf2"):
+		return parsePBKDF2(encoded)
+	case encoded == "":
+		return nil, errors.New("no password hash")
+	default:
+		return nil, errors.New("unknown password hash type")
+	}
+}
+
+func parseArgon2id(encoded string) (func(password string) error, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return nil, errors.New("invalid argon2id hash: expected $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>")
+	}
+	var memory, time uint32
+	var threads uint8
+	for _, parameter := range strings.Split(parts[3], ",") {
+		keyValue := strings.SplitN(parameter, "=", 2)
+		if len(keyValue) != 2 {
+			return nil, errors.Errorf("invalid argon2id parameter %q", parameter)
+		}
+		bitSize := 32
+		if keyValue[0] == "p" {
+			bitSize = 8
+		}
+		value, err := strconv.ParseUint(keyValue[1], 10, bitSize)
+		if err != nil || value == 0 {
+			return nil, errors.Errorf("invalid argon2id parameter %q", parameter)
+		}
+		switch keyValue[0] {
+		case "m":
+			memory = uint32(value)
+		case "t":
+			time = uint32(value)
+		case "p":
+			threads = uint8(value)
+		default:
+			return nil, errors.Errorf("invalid argon2id parameter %q", parameter)
+		}
+	}
+	if memory == 0 || time == 0 || threads == 0 {
+		return nil, errors.New("invalid argon2id hash: m, t and p must all be set")
+	}
+	salt, key, err := decodeSaltAndKey(parts[4], parts[5])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid argon2id hash")
+	}
+	return func(password string) error {
+		return compareKeys(key, argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key))))
+	}, nil
+}
+
+func parsePBKDF2(encoded string) (func(password string) error, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 5 {
+		return nil, errors.New("invalid PBKDF2 hash: expected $pbkdf2-<digest>$<iterations>$<salt>$<hash>")
+	}
+	var digest func() hash.Hash
+	switch parts[1] {
+	case "pbkdf2":
+		digest = sha1.New
+	case "pbkdf2-sha256":
+		digest = sha256.New
+	case "pbkdf2-sha512":
+		digest = sha512.New
+	default:
+		return nil, errors.Errorf("invalid PBKDF2 hash: unknown digest %q", parts[1])
+	}
+	iterations, err := strconv.Atoi(parts[2])
+	if err != nil || iterations <= 0 {
+		return nil, errors.Errorf("invalid PBKDF2 hash: invalid iterations %q", parts[2])
+	}
+	salt, key, err := decodeSaltAndKey(parts[3], parts[4])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid PBKDF2 hash")
+	}
+	return func(password string) error {
+		return compareKeys(key, pbkdf2.Key([]byte(password), salt, iterations, len(key), digest))
+	}, nil
+}
+
+func decodeSaltAndKey(encodedSalt string, encodedKey string) ([]byte, []byte, error) {
+	salt, err := decodeBase64(encodedSalt)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot decode salt")
+	}
+	key, err := decodeBase64(encodedKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "cannot decode hash")
+	}
+	if len(key) == 0 {
+		return nil, nil, errors.New("empty hash")
+	}
+	return salt, key, nil
+}
+
+// decodeBase64 decodes unpadded standard base64, also in the variant using . for +.
+func decodeBase64(encoded string) ([]byte, error) {
+	return base64.RawStdEncoding.DecodeString(strings.TrimRight(strings.Replace(encoded, ".", "+", -1), "="))
+}
+
+func compareKeys(expected []byte, actual []byte) error {
+	if subtle.ConstantTimeCompare(expected, actual) != 1 {
+		return errMismatchedPassword
+	}
+	return nil
+}
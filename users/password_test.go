@@ -0,0 +1,71 @@
+package users_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/users"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"strings"
+
+	"github.com/onsi/ginkgo/extensions/table"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func encodeBase64(b []byte) string {
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+var _ = Describe("Passwords", func() {
+	salt := []byte("0123456789abcdef")
+	argon2idHash := "$argon2id$v=19$m=1024,t=1,p=1$" + encodeBase64(salt) + "$" +
+		encodeBase64(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32))
+	pbkdf2SHA256Hash := "$pbkdf2-sha256$1000$" + encodeBase64(salt) + "$" +
+		encodeBase64(pbkdf2.Key([]byte("secret"), salt, 1000, 32, sha256.New))
+	pbkdf2SHA512Hash := "$pbkdf2-sha512$1000$" + strings.Replace(encodeBase64(salt), "+", ".", -1) + "$" +
+		encodeBase64(pbkdf2.Key([]byte("secret"), salt, 1000, 64, sha512.New))
+
+	It("should hash with bcrypt at the given cost", func() {
+		hashedPassword, err := HashPassword("secret", bcrypt.MinCost)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bcrypt.Cost(hashedPassword)).To(Equal(bcrypt.MinCost))
+		Expect(VerifyPassword(hashedPassword, "secret")).To(Succeed())
+		Expect(VerifyPassword(hashedPassword, "wrong")).NotTo(Succeed())
+	})
+
+	It("should hash with bcrypt at the default cost without one", func() {
+		hashedPassword, err := HashPassword("secret", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bcrypt.Cost(hashedPassword)).To(Equal(bcrypt.DefaultCost))
+	})
+
+	It("should verify argon2id hashes", func() {
+		Expect(VerifyPassword([]byte(argon2idHash), "secret")).To(Succeed())
+		Expect(VerifyPassword([]byte(argon2idHash), "wrong")).To(MatchError("password does not match"))
+	})
+
+	It("should verify PBKDF2 hashes", func() {
+		Expect(VerifyPassword([]byte(pbkdf2SHA256Hash), "secret")).To(Succeed())
+		Expect(VerifyPassword([]byte(pbkdf2SHA256Hash), "wrong")).To(MatchError("password does not match"))
+		Expect(VerifyPassword([]byte(pbkdf2SHA512Hash), "secret")).To(Succeed())
+	})
+
+	table.DescribeTable("invalid hashes", func(hashedPassword, errorDescription string) {
+		Expect(ValidateHash([]byte(hashedPassword))).To(MatchError(HavePrefix(errorDescription)))
+		Expect(VerifyPassword([]byte(hashedPassword), "secret")).NotTo(Succeed())
+	},
+		table.Entry("empty", "", "no password hash"),
+		table.Entry("plaintext", "secret", "unknown password hash type"),
+		table.Entry("truncated bcrypt", "$2a$10$abc", "invalid bcrypt hash"),
+		table.Entry("argon2i", "$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$aGFzaA", "unknown password hash type"),
+		table.Entry("argon2id without parameters", "$argon2id$v=19$c2FsdA$aGFzaA", "invalid argon2id hash"),
+		table.Entry("argon2id with a zero parameter", "$argon2id$v=19$m=0,t=1,p=1$c2FsdA$aGFzaA", `invalid argon2id parameter "m=0"`),
+		table.Entry("PBKDF2 with an unknown digest", "$pbkdf2-md5$1000$c2FsdA$aGFzaA", `invalid PBKDF2 hash: unknown digest "pbkdf2-md5"`),
+		table.Entry("PBKDF2 without iterations", "$pbkdf2-sha256$$c2FsdA$aGFzaA", `invalid PBKDF2 hash: invalid iterations ""`),
+		table.Entry("PBKDF2 with an invalid hash", "$pbkdf2-sha256$1000$c2FsdA$!", "invalid PBKDF2 hash: cannot decode hash"),
+	)
+})
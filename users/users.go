@@ -0,0 +1,159 @@
+package users
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+)
+
+// User is a samlidp.User with custom attributes, each of which can have several
+// values. It is stored under /users/<name> in place of the samlidp.User, which
+// ignores the attributes when the samlidp package reads it back.
+type User struct {
+	samlidp.User
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+// Session is a saml.Session with a copy of the custom attributes of its user, stored
+// under /sessions/<id> in place of the saml.Session.
+type Session struct {
+	saml.Session
+	Attributes map[string][]string `json:"attributes,omitempty"`
+}
+
+func sessionKey(id string) string {
+	return fmt.Sprintf("/sessions/%s", id)
+}
+
+func userKey(name string) string {
+	return fmt.Sprintf("/users/%s", name)
+}
+
+// SessionAttributes returns the custom attributes copied onto the stored session.
+func SessionAttributes(store samlidp.Store, session *saml.Session) (map[string][]string, error) {
+	stored := Session{}
+	err := store.Get(sessionKey(session.ID), &stored)
+	if err == samlidp.ErrNotFound {
+		return nil, nil
+	}
+	return stored.Attributes, err
+}
+
+// SessionMaxAge is how long a session lasts, as in the samlidp package.
+const SessionMaxAge = time.Hour
+
+// NewSession returns a new session of user, with a copy of its custom attributes.
+func NewSession(user User, maxAge time.Duration) *Session {
+	return &Session{
+		Session: saml.Session{
+			ID:             base64.StdEncoding.EncodeToString(randomBytes(32)),
+			CreateTime:     saml.TimeNow(),
+			ExpireTime:     saml.TimeNow().Add(maxAge),
+			Index:          hex.EncodeToString(randomBytes(32)),
+			NameID:         user.Name,
+			UserName:       user.Name,
+			Groups:         user.Groups[:],
+			UserEmail:      user.Email,
+			UserCommonName: user.CommonName,
+			UserSurname:    user.Surname,
+			UserGivenName:  user.GivenName,
+		},
+		Attributes: user.Attributes,
+	}
+}
+
+// SessionProvider logs users in with the credentials posted in the login form of the
+// wrapped saml.SessionProvider, verifying the password whatever its hash type. Without
+// valid credentials it falls back to the wrapped SessionProvider, which sends the login
+// form. It copies the custom attributes of the user onto sessions that have none yet.
+type SessionProvider struct {
+	saml.SessionProvider
+	Store samlidp.Store
+}
+
+func (p SessionProvider) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	if r.Method == "POST" && r.PostForm.Get("user") != "" {
+		session, err := p.login(w, r)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return nil
+		}
+		if session != nil {
+			return session
+		}
+	}
+
+	session := p.SessionProvider.GetSession(w, r, req)
+	if session == nil {
+		return nil
+	}
+	if err := p.copyAttributes(session); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil
+	}
+	return session
+}
+
+func (p SessionProvider) copyAttributes(session *saml.Session) error {
+	stored := Session{}
+	if err := p.Store.Get(sessionKey(session.ID), &stored); err != nil {
+		return err
+	}
+	if stored.Attributes != nil {
+		return nil
+	}
+	user := User{}
+	err := p.Store.Get(userKey(session.UserName), &user)
+	if err == samlidp.ErrNotFound || (err == nil && len(user.Attributes) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	stored.Attributes = user.Attributes
+	return p.Store.Put(sessionKey(session.ID), &stored)
+}
+
+// login returns a new session for the credentials in the login form, or nil when they
+// are not valid.
+func (p SessionProvider) login(w http.ResponseWriter, r *http.Request) (*saml.Session, error) {
+	user := User{}
+	err := p.Store.Get(userKey(r.PostForm.Get("user")), &user)
+	if err == samlidp.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := VerifyPassword(user.HashedPassword, r.PostForm.Get("password")); err != nil {
+		return nil, nil
+	}
+
+	session := NewSession(user, SessionMaxAge)
+	if err := p.Store.Put(sessionKey(session.ID), session); err != nil {
+		return nil, err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    session.ID,
+		MaxAge:   int(SessionMaxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.URL.Scheme == "https",
+		Path:     "/",
+	})
+	return &session.Session, nil
+}
+
+func randomBytes(n int) []byte {
+	rv := make([]byte, n)
+	if _, err := rand.Read(rv); err != nil {
+		panic(err)
+	}
+	return rv
+}
@@ -0,0 +1,106 @@
+package users_test
+
+import (
+	. "github.com/DennisDenuto/saml-idp/users"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlidp"
+	"golang.org/x/crypto/argon2"
+)
+
+type stubSessionProvider struct {
+	session *saml.Session
+}
+
+func (p stubSessionProvider) GetSession(w http.ResponseWriter, r *http.Request, req *saml.IdpAuthnRequest) *saml.Session {
+	return p.session
+}
+
+var _ = Describe("SessionProvider", func() {
+	var store *samlidp.MemoryStore
+	var session *saml.Session
+	var sessionProvider SessionProvider
+
+	getSession := func() *saml.Session {
+		return sessionProvider.GetSession(httptest.NewRecorder(), httptest.NewRequest("GET", "/sso", nil), &saml.IdpAuthnRequest{})
+	}
+
+	BeforeEach(func() {
+		store = &samlidp.MemoryStore{}
+		session = &saml.Session{ID: "session-id", UserName: "bob"}
+		Expect(store.Put("/sessions/session-id", session)).To(Succeed())
+		Expect(store.Put("/users/bob", User{
+			User:       samlidp.User{Name: "bob"},
+			Attributes: map[string][]string{"department": {"Engineering"}},
+		})).To(Succeed())
+		sessionProvider = SessionProvider{SessionProvider: stubSessionProvider{session}, Store: store}
+	})
+
+	It("should copy the attributes of the user onto the session", func() {
+		Expect(getSession()).To(Equal(session))
+		Expect(SessionAttributes(store, session)).To(Equal(map[string][]string{"department": {"Engineering"}}))
+
+		stored := saml.Session{}
+		Expect(store.Get("/sessions/session-id", &stored)).To(Succeed())
+		Expect(stored.UserName).To(Equal("bob"))
+	})
+
+	It("should keep the attributes copied when the session was created", func() {
+		getSession()
+		Expect(store.Put("/users/bob", User{
+			User:       samlidp.User{Name: "bob"},
+			Attributes: map[string][]string{"department": {"Sales"}},
+		})).To(Succeed())
+		getSession()
+		Expect(SessionAttributes(store, session)).To(Equal(map[string][]string{"department": {"Engineering"}}))
+	})
+
+	It("should pass on the lack of a session", func() {
+		sessionProvider.SessionProvider = stubSessionProvider{}
+		Expect(getSession()).To(BeNil())
+	})
+
+	Context("when the login form is posted", func() {
+		salt := []byte("0123456789abcdef")
+		argon2idHash := "$argon2id$v=19$m=1024,t=1,p=1$" + encodeBase64(salt) + "$" +
+			encodeBase64(argon2.IDKey([]byte("secret"), salt, 1, 1024, 1, 32))
+
+		login := func(password string) (*httptest.ResponseRecorder, *saml.Session) {
+			r := httptest.NewRequest("POST", "/login", strings.NewReader(url.Values{"user": {"alice"}, "password": {password}}.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			Expect(r.ParseForm()).To(Succeed())
+			w := httptest.NewRecorder()
+			return w, sessionProvider.GetSession(w, r, &saml.IdpAuthnRequest{})
+		}
+
+		BeforeEach(func() {
+			Expect(store.Put("/users/alice", User{
+				User:       samlidp.User{Name: "alice", HashedPassword: []byte(argon2idHash), Email: "alice@example.com"},
+				Attributes: map[string][]string{"department": {"Sales"}},
+			})).To(Succeed())
+			sessionProvider.SessionProvider = stubSessionProvider{}
+		})
+
+		It("should start a session for a user with an argon2id hashed password", func() {
+			w, session := login("secret")
+			Expect(session).NotTo(BeNil())
+			Expect(session.UserName).To(Equal("alice"))
+			Expect(session.UserEmail).To(Equal("alice@example.com"))
+			Expect(w.Header().Get("Set-Cookie")).To(HavePrefix("session=" + session.ID))
+			Expect(SessionAttributes(store, session)).To(Equal(map[string][]string{"department": {"Sales"}}))
+		})
+
+		It("should fall back to the wrapped SessionProvider for a wrong password", func() {
+			w, session := login("wrong")
+			Expect(session).To(BeNil())
+			Expect(w.Header().Get("Set-Cookie")).To(BeEmpty())
+		})
+	})
+})